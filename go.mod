@@ -3,6 +3,7 @@ module github.com/gfphoenix78/stream_cast
 go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/golang/snappy v0.0.4
 	gopkg.in/yaml.v3 v3.0.1
 )
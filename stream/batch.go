@@ -0,0 +1,292 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Batch syntax:
+// policy:
+//   mode: parallel        # sequential(default)/parallel
+//   concurrency: 4        # parallel only, 0 runs all at once
+//   on_failure: continue  # stop(default)/continue
+// streams:
+//   - name: db
+//     input:
+//       ...
+//     encoder:
+//       ...
+//     output:
+//       ...
+//   - name: logs
+//     ...
+//
+// metrics:               # optional, see metrics.go
+//   listen: 127.0.0.1:9464
+//
+// A stream may also be a graph, see graph.go.
+// A file without `streams` is a batch of a single stream named "default".
+// On failure, `stop` doesn't start the remaining streams, the running ones
+// are left to finish.
+
+const (
+	PolicySequential = "sequential"
+	PolicyParallel   = "parallel"
+	PolicyStop       = "stop"
+	PolicyContinue   = "continue"
+)
+
+type Policy struct {
+	Mode        string
+	Concurrency int
+	OnFailure   string `yaml:"on_failure"`
+}
+
+// Job is a named stream of a batch. Its resources are opened when it runs.
+type Job struct {
+	Name  string
+	plan  *Plan
+	graph *Graph // set if the job is a graph
+}
+
+func (reg *Registry) newJob(name string, node *yaml.Node, src sources) (*Job, error) {
+	var err error
+	job := &Job{Name: name}
+	if isGraph(node) {
+		job.graph, err = reg.newGraph(node, src)
+	} else {
+		job.plan, err = reg.newPlan(node, src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+type Batch struct {
+	Policy  Policy
+	Metrics MetricsConfig
+	Jobs    []*Job
+
+	// if set, the jobs are tracked while they run
+	Monitor *Metrics
+
+	// if set, the streams drain when the context of Run is done: they stop
+	// reading and flush what they read, see DrainContext and Graph.Drain.
+	Drain bool
+}
+
+// Report is the outcome of a job.
+type Report struct {
+	Name     string
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+	Skipped  bool   // not started, because an earlier job failed
+	Partial  bool   // drained before the end of the input, the output is complete up to Bytes
+	Stats    *Stats // nil for graphs and streams that failed to open
+}
+
+func (r *Report) Status() string {
+	switch {
+	case r.Skipped:
+		return "skipped"
+	case r.Partial:
+		return "partial"
+	case r.Err != nil:
+		return "failed"
+	}
+	return "ok"
+}
+
+func LoadBatch(r io.Reader) (*Batch, error) {
+	return DefaultRegistry.LoadBatch(r)
+}
+
+// LoadBatch is LoadBatch with the types of the registry.
+func (reg *Registry) LoadBatch(r io.Reader) (*Batch, error) {
+	node, src, err := loadDocument(r)
+	if err != nil {
+		return nil, err
+	}
+	return reg.newBatch(node, src)
+}
+
+func (reg *Registry) newBatch(node *yaml.Node, src sources) (*Batch, error) {
+	var batch Batch
+	if i := getChildByTag(node, "policy"); i >= 0 && i+1 < len(node.Content) {
+		if err := node.Content[i+1].Decode(&batch.Policy); err != nil {
+			return nil, fmt.Errorf("policy: %w", err)
+		}
+	}
+	switch batch.Policy.Mode {
+	case "":
+		batch.Policy.Mode = PolicySequential
+	case PolicySequential, PolicyParallel:
+	default:
+		return nil, fmt.Errorf("policy: invalid mode: %v", batch.Policy.Mode)
+	}
+	switch batch.Policy.OnFailure {
+	case "":
+		batch.Policy.OnFailure = PolicyStop
+	case PolicyStop, PolicyContinue:
+	default:
+		return nil, fmt.Errorf("policy: invalid on_failure: %v", batch.Policy.OnFailure)
+	}
+	if batch.Policy.Concurrency < 0 {
+		return nil, fmt.Errorf("policy: invalid concurrency: %v", batch.Policy.Concurrency)
+	}
+	if i := getChildByTag(node, "metrics"); i >= 0 && i+1 < len(node.Content) {
+		if err := node.Content[i+1].Decode(&batch.Metrics); err != nil {
+			return nil, fmt.Errorf("metrics: %w", err)
+		}
+	}
+
+	if getChildByTag(node, "streams") < 0 {
+		job, err := reg.newJob("default", node, src)
+		if err != nil {
+			return nil, err
+		}
+		batch.Jobs = []*Job{job}
+		return &batch, nil
+	}
+	streams := getList(node, "streams")
+	if len(streams) == 0 {
+		return nil, fmt.Errorf("invalid 'streams', needs a non-empty list")
+	}
+	names := make(map[string]bool)
+	for i, n := range streams {
+		if n.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("streams[%v]: needs a map", i)
+		}
+		var job struct{ Name string }
+		if err := n.Decode(&job); err != nil {
+			return nil, fmt.Errorf("streams[%v]: %w", i, err)
+		}
+		if job.Name == "" {
+			return nil, fmt.Errorf("streams[%v]: `name` is missing", i)
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("streams[%v]: duplicated name: %v", i, job.Name)
+		}
+		names[job.Name] = true
+		j, err := reg.newJob(job.Name, n, src)
+		if err != nil {
+			return nil, fmt.Errorf("streams[%v]: %w", i, err)
+		}
+		batch.Jobs = append(batch.Jobs, j)
+	}
+	return &batch, nil
+}
+
+// Run opens, copies and closes the stream of the job.
+func (j *Job) Run(ctx context.Context) Report {
+	return j.run(ctx, nil, false)
+}
+
+// Drain is Run, with the stream drained when ctx is done, see DrainContext.
+func (j *Job) Drain(ctx context.Context) Report {
+	return j.run(ctx, nil, true)
+}
+
+func (j *Job) run(ctx context.Context, m *Metrics, drain bool) (report Report) {
+	report.Name = j.Name
+	start := time.Now()
+	defer func() {
+		report.Duration = time.Since(start)
+		if m != nil {
+			m.Done(report)
+		}
+	}()
+
+	if j.graph != nil {
+		if m != nil {
+			m.start(j.Name)
+		}
+		var err, closeErr error
+		report.Bytes, err, closeErr = j.graph.run(ctx, drain)
+		var ce *CanceledError
+		report.Partial = drain && errors.As(err, &ce) && closeErr == nil
+		report.Err = errors.Join(err, closeErr)
+		return report
+	}
+	s, err := j.plan.OpenContext(ctx)
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	if m != nil {
+		m.Track(j.Name, s)
+	}
+	if drain {
+		report.Bytes, err = s.DrainContext(ctx)
+	} else {
+		report.Bytes, err = s.CopyContext(ctx)
+	}
+	closeErr := s.Close()
+	var ce *CanceledError
+	report.Partial = drain && errors.As(err, &ce) && closeErr == nil
+	report.Err = errors.Join(err, closeErr)
+	report.Stats = s.Stats()
+	return report
+}
+
+// Run runs the jobs as the policy says, the reports are in the order of Jobs.
+func (b *Batch) Run(ctx context.Context) []Report {
+	reports := make([]Report, len(b.Jobs))
+	for i, job := range b.Jobs {
+		reports[i] = Report{Name: job.Name, Skipped: true}
+		if b.Monitor != nil {
+			b.Monitor.add(job.Name)
+		}
+	}
+
+	limit := 1
+	if b.Policy.Mode == PolicyParallel {
+		limit = b.Policy.Concurrency
+		if limit == 0 {
+			limit = len(b.Jobs)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := false
+	sem := make(chan struct{}, limit)
+	for i, job := range b.Jobs {
+		sem <- struct{}{}
+		mu.Lock()
+		stop := failed && b.Policy.OnFailure == PolicyStop
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, job *Job) {
+			defer wg.Done()
+			report := job.run(ctx, b.Monitor, b.Drain)
+			mu.Lock()
+			reports[i] = report
+			failed = failed || report.Err != nil
+			mu.Unlock()
+			<-sem
+		}(i, job)
+	}
+	wg.Wait()
+	if b.Monitor != nil {
+		for _, r := range reports {
+			if r.Skipped {
+				b.Monitor.Done(r)
+			}
+		}
+	}
+	return reports
+}
@@ -0,0 +1,67 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatchPolicy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, testData(4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	streams := fmt.Sprintf(`
+streams:
+  - name: first
+    input: {type: local, name: %[1]v}
+    output: {type: local, name: %[2]v/first}
+  - name: broken
+    input: {type: local, name: %[2]v/missing}
+    output: {type: local, name: %[2]v/broken}
+  - name: last
+    input: {type: local, name: %[1]v}
+    encoder:
+      - type: gzip
+    output: {type: local, name: %[2]v/last}
+`, src, dir)
+
+	tests := []struct {
+		policy string
+		status []string
+	}{
+		{"{}", []string{"ok", "failed", "skipped"}},
+		{"{on_failure: continue}", []string{"ok", "failed", "ok"}},
+		{"{mode: parallel, concurrency: 2, on_failure: continue}", []string{"ok", "failed", "ok"}},
+		{"{mode: parallel}", []string{"ok", "failed", "ok"}},
+	}
+	for _, tt := range tests {
+		batch, err := LoadBatch(strings.NewReader("policy: " + tt.policy + streams))
+		if err != nil {
+			t.Fatalf("%v: LoadBatch: %v", tt.policy, err)
+		}
+		reports := batch.Run(context.Background())
+		for i, r := range reports {
+			if r.Status() != tt.status[i] {
+				t.Errorf("%v: %v: got %v, want %v (%v)", tt.policy, r.Name, r.Status(), tt.status[i], r.Err)
+			}
+		}
+		if reports[0].Bytes != 4096 {
+			t.Errorf("%v: first copied %v bytes", tt.policy, reports[0].Bytes)
+		}
+	}
+
+	for _, config := range []string{
+		"streams:\n  - input: {type: stdin}\n",
+		"streams:\n  - name: a\n  - name: a\n",
+		"policy: {mode: fast}\nstreams:\n  - name: a\n",
+	} {
+		if _, err := LoadBatch(strings.NewReader(config)); err == nil {
+			t.Errorf("LoadBatch(%q): want error", config)
+		}
+	}
+}
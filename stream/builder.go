@@ -0,0 +1,203 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A Builder makes a stream in Go, without a config:
+//
+//	s, err := stream.From(r).
+//		Decode("gzip", nil).
+//		Encode("zlib", &stream.LevelOptions{Level: 9}).
+//		To(w)
+//
+// The stages are in the order the bytes go through them: the encoder added
+// last is the one next to the output. The options of a type are any value
+// that encodes to a yaml map, the option struct of the type or a
+// map[string]any, nil for the defaults. The zero fields of a struct are left
+// out and get their defaults, LevelOptions{} is the default level: a zero
+// that isn't the default is set with a map. They are expanded and checked
+// like the ones of a config. A Builder is used once, the readers and writers
+// it got are closed by the Stream.
+
+type Builder struct {
+	reg      *Registry
+	config   streamConfig
+	reader   io.ReadCloser
+	input    *yaml.Node
+	decoders []*yaml.Node
+	encoders []*yaml.Node // in the order of the config, the last added first
+	err      error
+}
+
+// From starts a stream reading rc.
+func From(rc io.ReadCloser) *Builder {
+	return DefaultRegistry.From(rc)
+}
+
+// FromType starts a stream reading a registered input.
+func FromType(typ string, opts any) *Builder {
+	return DefaultRegistry.FromType(typ, opts)
+}
+
+func (reg *Registry) From(rc io.ReadCloser) *Builder {
+	b := &Builder{reg: reg, reader: rc}
+	if rc == nil {
+		b.err = errors.New("input: nil reader")
+	}
+	return b
+}
+
+func (reg *Registry) FromType(typ string, opts any) *Builder {
+	b := &Builder{reg: reg}
+	b.input, b.err = stageNode(KindInput, typ, opts)
+	return b
+}
+
+// stageNode encodes the options of a stage with its type, like a stage of
+// a config.
+func stageNode(kind Kind, typ string, opts any) (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if opts != nil {
+		if err := node.Encode(opts); err != nil {
+			return nil, fmt.Errorf("%v '%v': %w", kind, typ, err)
+		}
+		if node.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%v '%v': the options should be a map or a struct, not %T", kind, typ, opts)
+		}
+		if getChildByTag(node, "type") >= 0 {
+			return nil, fmt.Errorf("%v '%v': `type` is not an option", kind, typ)
+		}
+		omitZero(node, opts)
+	}
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "type"}
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: typ}
+	node.Content = append([]*yaml.Node{key, value}, node.Content...)
+	return node, nil
+}
+
+// omitZero removes from node the zero fields of opts if it's a struct, like
+// omitempty.
+func omitZero(node *yaml.Node, opts any) {
+	v := reflect.ValueOf(opts)
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() || !v.Field(i).IsZero() {
+			continue
+		}
+		key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if key == "" {
+			key = strings.ToLower(f.Name)
+		}
+		if j := getChildByTag(node, key); j >= 0 && j+1 < len(node.Content) {
+			node.Content = append(node.Content[:j], node.Content[j+2:]...)
+		}
+	}
+}
+
+// Decode adds a decoder after the ones added before.
+func (b *Builder) Decode(typ string, opts any) *Builder {
+	if b.err == nil {
+		var node *yaml.Node
+		node, b.err = stageNode(KindDecoder, typ, opts)
+		b.decoders = append(b.decoders, node)
+	}
+	return b
+}
+
+// Encode adds an encoder after the ones added before, so it wraps the
+// output before them.
+func (b *Builder) Encode(typ string, opts any) *Builder {
+	if b.err == nil {
+		var node *yaml.Node
+		node, b.err = stageNode(KindEncoder, typ, opts)
+		b.encoders = append([]*yaml.Node{node}, b.encoders...)
+	}
+	return b
+}
+
+// Concurrent runs every codec in its own goroutine, like `concurrent: true`.
+func (b *Builder) Concurrent() *Builder {
+	b.config.Concurrent = true
+	return b
+}
+
+// To opens the stream writing wc.
+func (b *Builder) To(wc io.WriteCloser) (*Stream, error) {
+	if b.err == nil && wc == nil {
+		b.err = errors.New("output: nil writer")
+	}
+	return b.open(nil, wc)
+}
+
+// ToType opens the stream writing a registered output.
+func (b *Builder) ToType(typ string, opts any) (*Stream, error) {
+	var node *yaml.Node
+	if b.err == nil {
+		node, b.err = stageNode(KindOutput, typ, opts)
+	}
+	return b.open(node, nil)
+}
+
+// open plans the stages like newPlan and opens them. On failure the reader
+// and the writer given to the builder are closed too.
+func (b *Builder) open(output *yaml.Node, wc io.WriteCloser) (*Stream, error) {
+	plan, err := b.plan(output)
+	if err == nil {
+		plan.reader, plan.writer = b.reader, wc
+		var s *Stream
+		if s, err = plan.Open(); err == nil {
+			return s, nil
+		}
+		// the rollback closed them
+		return nil, err
+	}
+	if b.reader != nil {
+		b.reader.Close()
+	}
+	if wc != nil {
+		wc.Close()
+	}
+	return nil, err
+}
+
+func (b *Builder) plan(output *yaml.Node) (*Plan, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	plan := &Plan{reg: b.reg, config: b.config}
+	var err error
+	if b.input != nil {
+		if plan.Input, err = b.reg.planStage(KindInput, b.input, nil); err != nil {
+			return nil, err
+		}
+	} else {
+		plan.Input = &Stage{Kind: KindInput, Type: "reader"}
+	}
+	if output != nil {
+		if plan.Output, err = b.reg.planStage(KindOutput, output, nil); err != nil {
+			return nil, err
+		}
+	} else {
+		plan.Output = &Stage{Kind: KindOutput, Type: "writer"}
+	}
+	if plan.Decoders, err = b.reg.planList(KindDecoder, b.decoders, nil); err != nil {
+		return nil, err
+	}
+	if plan.Encoders, err = b.reg.planList(KindEncoder, b.encoders, nil); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type closeCounter struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestBuilder(t *testing.T) {
+	data := testData(1 << 16)
+	for _, concurrent := range []bool{false, true} {
+		var packed, unpacked bytes.Buffer
+		b := From(io.NopCloser(bytes.NewReader(data))).
+			Encode("zlib", &LevelOptions{Level: 9}).
+			Encode("gzip", nil)
+		if concurrent {
+			b.Concurrent()
+		}
+		s, err := b.To(&nopWriteCloser{&packed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Copy()
+		if err = errors.Join(err, s.Close()); err != nil {
+			t.Fatal(err)
+		}
+		// gzip was added last, it's the outer format
+		if !bytes.HasPrefix(packed.Bytes(), []byte{0x1f, 0x8b}) {
+			t.Errorf("not gzip: % x", packed.Bytes()[:4])
+		}
+
+		s, err = From(io.NopCloser(&packed)).Decode("gzip", nil).Decode("zlib", nil).To(&nopWriteCloser{&unpacked})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Copy()
+		if err = errors.Join(err, s.Close()); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unpacked.Bytes(), data) {
+			t.Errorf("concurrent %v: got %v bytes", concurrent, unpacked.Len())
+		}
+		if in := s.Stats().Stages[0]; in.Type != "reader" {
+			t.Errorf("input stats: %+v", in)
+		}
+	}
+}
+
+func TestBuilderTypes(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := FromType("local", &LocalOptions{Name: src}).
+		Encode("lzw", &LZWOptions{Order: "MSB", LitWidth: 8}).
+		ToType("local", map[string]any{"name": dst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Copy()
+	if err = errors.Join(err, s.Close()); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = FromType("local", LocalOptions{Name: dst}).
+		Decode("lzw", map[string]any{"order": "MSB"}).
+		To(&nopWriteCloser{io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	_, err = io.Copy(&out, s.Reader())
+	if err = errors.Join(err, s.Close()); err != nil || out.String() != "hello" {
+		t.Errorf("got %q, %v", out.String(), err)
+	}
+}
+
+func TestBuilderZeroOptions(t *testing.T) {
+	data := testData(1 << 16)
+	pack := func(opts any) []byte {
+		var packed bytes.Buffer
+		s, err := From(io.NopCloser(bytes.NewReader(data))).Encode("gzip", opts).To(&nopWriteCloser{&packed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Copy()
+		if err = errors.Join(err, s.Close()); err != nil {
+			t.Fatal(err)
+		}
+		return packed.Bytes()
+	}
+
+	// the zero level is left out, like a config without `level`
+	plan, err := NewPlan(strings.NewReader("input: {type: stdin}\nencoder: [{type: gzip}]\noutput: {type: stdout}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := decodeOptions[LevelOptions](KindEncoder, plan.Encoders[0].node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pack(&LevelOptions{}), pack(want)) {
+		t.Errorf("LevelOptions{} isn't level %v", want.Level)
+	}
+	if bytes.Equal(pack(&LevelOptions{}), pack(map[string]any{"level": 0})) {
+		t.Errorf("LevelOptions{} is level 0")
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	for _, c := range []struct {
+		build func(rc io.ReadCloser) *Builder
+		want  string
+	}{
+		{func(rc io.ReadCloser) *Builder { return From(rc).Encode("gzip", &LevelOptions{Level: 12}) },
+			"encoder[0]: encoder 'gzip': `level`: 12 is out of range [-2, 9]"},
+		{func(rc io.ReadCloser) *Builder { return From(rc).Decode("nope", nil) },
+			"decoder[0]: decoder 'nope' not found"},
+		{func(rc io.ReadCloser) *Builder { return From(rc).Decode("lzw", map[string]any{"order": "XYZ"}) },
+			"invalid value \"XYZ\""},
+		{func(rc io.ReadCloser) *Builder { return From(rc).Encode("zlib", 9) },
+			"should be a map or a struct"},
+		{func(rc io.ReadCloser) *Builder { return From(rc).Encode("zlib", map[string]any{"type": "gzip"}) },
+			"`type` is not an option"},
+	} {
+		rc := &closeCounter{Reader: strings.NewReader("x")}
+		_, err := c.build(rc).To(&nopWriteCloser{io.Discard})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("got %v, want %v", err, c.want)
+		}
+		if rc.closed != 1 {
+			t.Errorf("%v: the reader was closed %v times", c.want, rc.closed)
+		}
+	}
+
+	// the reader is closed when the output fails to open
+	rc := &closeCounter{Reader: strings.NewReader("x")}
+	_, err := From(rc).ToType("local", &LocalOptions{Name: filepath.Join(t.TempDir(), "no", "dir")})
+	var oe *OpenError
+	if !errors.As(err, &oe) || oe.Stage != "output" || rc.closed != 1 {
+		t.Errorf("got %v, closed %v", err, rc.closed)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -21,6 +24,11 @@ import (
 type catReader struct {
 	child  []io.ReadCloser
 	rindex int
+	failed int32 // children that failed, atomic
+}
+
+func (cr *catReader) children() (int, int) {
+	return len(cr.child), len(cr.child) - int(atomic.LoadInt32(&cr.failed))
 }
 
 func (cr *catReader) Read(b []byte) (int, error) {
@@ -38,6 +46,7 @@ func (cr *catReader) Read(b []byte) (int, error) {
 		}
 		if err != nil {
 			if err != io.EOF {
+				atomic.AddInt32(&cr.failed, 1)
 				return nr, err
 			}
 			// switch to the next reader
@@ -60,20 +69,45 @@ func (t *catReader) Close() error {
 	return errors.Join(errs...)
 }
 
-func cat_input(node *yaml.Node) (io.ReadCloser, error) {
-	check_type(node, "cat")
-	inputs := getList(node, "child")
-	if len(inputs) == 0 {
-		return nil, fmt.Errorf("no input set in cat")
+func (cr *catReader) SetReadDeadline(t time.Time) error {
+	var errs []error
+	for _, c := range cr.child {
+		if d, ok := c.(readDeadliner); ok {
+			if err := d.SetReadDeadline(t); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+				errs = append(errs, err)
+			}
+		}
 	}
-	child, err := parseInputList(inputs)
-	var cr = &catReader{child: child}
+	return errors.Join(errs...)
+}
+
+// options of cat and tee, the children are validated by the plan
+type compositeOptions struct {
+	Child yaml.Node `yaml:"child" required:"true" type:"list" desc:"the inputs or outputs"`
+	op    opening   // opens the children
+}
+
+func (opts *compositeOptions) setOpening(op opening) {
+	opts.op = op
+}
+
+func (opts *compositeOptions) Validate() error {
+	if opts.Child.Kind != yaml.SequenceNode || len(opts.Child.Content) == 0 {
+		return fmt.Errorf("`child` needs a non-empty list")
+	}
+	return nil
+}
+
+func cat_input(opts *compositeOptions) (io.ReadCloser, error) {
+	child, err := parseInputList(opts.op, opts.Child.Content)
 	if err != nil {
-		if e := cr.Close(); e != nil {
-			err = errors.Join(err, e)
+		// roll back the opened children
+		for i := len(child) - 1; i >= 0; i-- {
+			err = errors.Join(err, child[i].Close())
 		}
+		return nil, err
 	}
-	return cr, err
+	return &catReader{child: child}, nil
 }
 
 // TEE syntax:
@@ -88,21 +122,39 @@ func cat_input(node *yaml.Node) (io.ReadCloser, error) {
 
 type teeWriter struct {
 	child []io.WriteCloser
+	dead  []bool // children that failed are not written anymore
+	alive int32  // atomic
+}
+
+func newTeeWriter(child []io.WriteCloser) *teeWriter {
+	return &teeWriter{child: child, dead: make([]bool, len(child)), alive: int32(len(child))}
+}
+
+func (t *teeWriter) children() (int, int) {
+	return len(t.child), int(atomic.LoadInt32(&t.alive))
 }
 
 func (t *teeWriter) Write(b []byte) (int, error) {
 	var errs []error
 	N := len(b)
 	nwrite := N
-	for _, w := range t.child {
+	for i, w := range t.child {
+		if t.dead[i] {
+			continue
+		}
 		n, err := w.Write(b)
 		if err != nil {
 			errs = append(errs, err)
 		} else if n != N {
 			// do we need to write again
-			errs = append(errs, fmt.Errorf("partial write: %v/%v", n, N))
+			err = fmt.Errorf("partial write: %v/%v", n, N)
+			errs = append(errs, err)
 			nwrite = n
 		}
+		if err != nil {
+			t.dead[i] = true
+			atomic.AddInt32(&t.alive, -1)
+		}
 	}
 	return nwrite, errors.Join(errs...)
 }
@@ -117,23 +169,33 @@ func (t *teeWriter) Close() error {
 	return errors.Join(errs...)
 }
 
-func tee_output(node *yaml.Node) (io.WriteCloser, error) {
-	check_type(node, "tee")
-	outputs := getList(node, "child")
-	if len(outputs) == 0 {
-		return nil, fmt.Errorf("no output set in tee")
+func (t *teeWriter) SetWriteDeadline(tm time.Time) error {
+	var errs []error
+	for _, c := range t.child {
+		if d, ok := c.(writeDeadliner); ok {
+			if err := d.SetWriteDeadline(tm); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+				errs = append(errs, err)
+			}
+		}
 	}
-	child, err := parseOutputList(outputs)
-	var tw = &teeWriter{child: child}
+	return errors.Join(errs...)
+}
+
+func tee_output(opts *compositeOptions) (io.WriteCloser, error) {
+	child, err := parseOutputList(opts.op, opts.Child.Content)
 	if err != nil {
-		if e := tw.Close(); e != nil {
-			err = errors.Join(err, e)
+		// roll back the opened children
+		for i := len(child) - 1; i >= 0; i-- {
+			err = errors.Join(err, child[i].Close())
 		}
+		return nil, err
 	}
-	return tw, err
+	return newTeeWriter(child), nil
 }
 
 func init() {
-	RegisterInputStream("cat", cat_input)
-	RegisterOutputStream("tee", tee_output)
+	RegisterInput("cat", cat_input)
+	RegisterOutput("tee", tee_output)
+	Describe(KindInput, "cat", "read the children one after the other")
+	Describe(KindOutput, "tee", "write to every child")
 }
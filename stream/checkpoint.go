@@ -0,0 +1,316 @@
+package stream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CHECKPOINT syntax:
+// checkpoint:
+//   file: /var/lib/stream_cast/db.state
+//   interval: 30s   # default 10s
+// input:
+//   type: local     # must be resumable
+// encoder:
+//   - type: gzip    # must be checkpointable
+// output:
+//   type: local     # must be resumable
+//
+// Every interval the encoders end a segment, the output is synced and the
+// bytes consumed from the input and delivered to the output are written to
+// the state file. A rerun of the same config resumes from there: the input
+// is reopened at its offset, the output is cut at its offset and appended.
+// The state file is removed once the stream is closed successfully.
+//
+// Checkpoints need to know how many input bytes the output holds, so a
+// stream with a checkpoint has no decoder and isn't concurrent.
+
+const defaultCheckpointInterval = 10 * time.Second
+
+// ResumeInputFunc opens an input that skips the first offset bytes.
+type ResumeInputFunc func(node *yaml.Node, offset int64) (io.ReadCloser, error)
+
+// ResumeOutputFunc opens an output that keeps its first offset bytes,
+// drops the rest and appends after them.
+type ResumeOutputFunc func(node *yaml.Node, offset int64) (io.WriteCloser, error)
+
+// Checkpointer is implemented by the encoders that can end a segment: after
+// Checkpoint everything written so far is in the next stage and decodes on
+// its own, and a new encoder appending to it makes a valid stream.
+type Checkpointer interface {
+	Checkpoint() error
+}
+
+// RegisterResumableInput declares that the input type can resume.
+func (reg *Registry) RegisterResumableInput(name string, fn ResumeInputFunc) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.resumeInputs[name]; ok {
+		return fmt.Errorf("resumable input '%v': %w", name, ErrDuplicateType)
+	}
+	reg.resumeInputs[name] = fn
+	return nil
+}
+
+// RegisterResumableOutput declares that the output type can resume.
+func (reg *Registry) RegisterResumableOutput(name string, fn ResumeOutputFunc) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.resumeOutputs[name]; ok {
+		return fmt.Errorf("resumable output '%v': %w", name, ErrDuplicateType)
+	}
+	reg.resumeOutputs[name] = fn
+	return nil
+}
+
+// RegisterCheckpointEncoder declares that the encoders of the type
+// implement Checkpointer.
+func (reg *Registry) RegisterCheckpointEncoder(name string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.checkpointEncoders[name] = true
+}
+
+func RegisterResumableInput(name string, fn ResumeInputFunc) {
+	must(DefaultRegistry.RegisterResumableInput(name, fn))
+}
+
+func RegisterResumableOutput(name string, fn ResumeOutputFunc) {
+	must(DefaultRegistry.RegisterResumableOutput(name, fn))
+}
+
+func RegisterCheckpointEncoder(name string) {
+	DefaultRegistry.RegisterCheckpointEncoder(name)
+}
+
+// Resumable tells if a stream type can be part of a checkpointed stream.
+func (reg *Registry) Resumable(kind Kind, name string) bool {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	var ok bool
+	switch kind {
+	case KindInput:
+		_, ok = reg.resumeInputs[name]
+	case KindOutput:
+		_, ok = reg.resumeOutputs[name]
+	case KindEncoder:
+		ok = reg.checkpointEncoders[name]
+	}
+	return ok
+}
+
+func Resumable(kind Kind, name string) bool {
+	return DefaultRegistry.Resumable(kind, name)
+}
+
+type checkpointConfig struct {
+	File     string
+	Interval time.Duration
+}
+
+// checkpointState is the content of the state file.
+type checkpointState struct {
+	Config string `json:"config"` // hash of the stream config
+	Input  int64  `json:"input"`  // bytes consumed from the input
+	Output int64  `json:"output"` // bytes delivered to the output
+}
+
+type checkpoint struct {
+	config checkpointConfig
+	hash   string
+	base   checkpointState // where this run started
+	done   bool            // Copy reached the end of the input
+}
+
+func configHash(node *yaml.Node) (string, error) {
+	b, err := yaml.Marshal(node)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// checkCheckpoint validates the checkpoint section of a plan.
+func (p *Plan) checkCheckpoint(node *yaml.Node) error {
+	config := p.config.Checkpoint
+	if config.File == "" {
+		return fmt.Errorf("checkpoint: `file` is missing")
+	}
+	if config.Interval < 0 {
+		return fmt.Errorf("checkpoint: invalid interval: %v", config.Interval)
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultCheckpointInterval
+	}
+	if p.config.Concurrent {
+		return fmt.Errorf("checkpoint: a concurrent stream can't checkpoint")
+	}
+	if len(p.Decoders) > 0 {
+		return fmt.Errorf("checkpoint: a stream with decoders can't checkpoint")
+	}
+	if !p.reg.Resumable(KindInput, p.Input.Type) {
+		return fmt.Errorf("checkpoint: input '%v' can't resume", p.Input.Type)
+	}
+	for i, stage := range p.Encoders {
+		if !p.reg.Resumable(KindEncoder, stage.Type) {
+			return fmt.Errorf("checkpoint: encoder[%v] '%v' can't checkpoint", i, stage.Type)
+		}
+	}
+	if !p.reg.Resumable(KindOutput, p.Output.Type) {
+		return fmt.Errorf("checkpoint: output '%v' can't resume", p.Output.Type)
+	}
+	hash, err := configHash(node)
+	if err != nil {
+		return err
+	}
+	p.checkpoint = &checkpoint{config: *config, hash: hash}
+	return nil
+}
+
+// load reads the state file of a previous run, if any.
+func (c *checkpoint) load() error {
+	b, err := os.ReadFile(c.config.File)
+	if errors.Is(err, os.ErrNotExist) {
+		c.base = checkpointState{Config: c.hash}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, &c.base); err != nil {
+		return fmt.Errorf("checkpoint %v: %w", c.config.File, err)
+	}
+	if c.base.Config != c.hash {
+		return fmt.Errorf("checkpoint %v: written for another config", c.config.File)
+	}
+	return nil
+}
+
+// save writes the state file atomically.
+func (c *checkpoint) save(state checkpointState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.config.File), filepath.Base(c.config.File)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.config.File)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *Stream) openResumed(ctx context.Context) (io.ReadCloser, io.WriteCloser, *OpenError) {
+	c := s.checkpoint
+	in, out := s.plan.Input, s.plan.Output
+	if err := c.load(); err != nil {
+		return nil, nil, &OpenError{Stage: "input", Type: in.Type, Err: err}
+	}
+	reg := s.registry()
+	reg.mu.RLock()
+	resumeInput, resumeOutput := reg.resumeInputs[in.Type], reg.resumeOutputs[out.Type]
+	reg.mu.RUnlock()
+	input, err := withRetry(ctx, in.node, &s.reconnects, func() (io.ReadCloser, error) {
+		return resumeInput(in.node, c.base.Input)
+	})
+	if err != nil {
+		return nil, nil, &OpenError{Stage: "input", Type: in.Type, Err: err}
+	}
+	output, err := withRetry(ctx, out.node, &s.reconnects, func() (io.WriteCloser, error) {
+		return resumeOutput(out.node, c.base.Output)
+	})
+	if err != nil {
+		return input, nil, &OpenError{Stage: "output", Type: out.Type, Err: err}
+	}
+	return input, output, nil
+}
+
+// saveCheckpoint ends a segment in every encoder, outer to inner, syncs the output
+// and records the offsets.
+func (s *Stream) saveCheckpoint(consumed int64) error {
+	c := s.checkpoint
+	for i := len(s.encoder) - 1; i >= 0; i-- {
+		if err := s.encoder[i].(Checkpointer).Checkpoint(); err != nil {
+			return fmt.Errorf("checkpoint encoder[%v]: %w", i, err)
+		}
+	}
+	if f, ok := s.output.(interface{ Sync() error }); ok {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("checkpoint output: %w", err)
+		}
+	}
+	return c.save(checkpointState{
+		Config: c.hash,
+		Input:  c.base.Input + consumed,
+		Output: c.base.Output + s.wmeters[0].bytes.Load(),
+	})
+}
+
+// copyCheckpoint is io.Copy with a checkpoint every interval.
+func (s *Stream) copyCheckpoint(w io.Writer, r io.Reader) (int64, error) {
+	c := s.checkpoint
+	buf := make([]byte, defaultBufferSize)
+	last := time.Now()
+	var n int64
+	for {
+		nr, er := r.Read(buf)
+		if nr > 0 {
+			nw, ew := w.Write(buf[:nr])
+			n += int64(nw)
+			if ew == nil && nw != nr {
+				ew = io.ErrShortWrite
+			}
+			if ew != nil {
+				return n, ew
+			}
+		}
+		if er == io.EOF {
+			c.done = true
+			return n, nil
+		}
+		if er != nil {
+			return n, er
+		}
+		if time.Since(last) >= c.config.Interval {
+			if err := s.saveCheckpoint(n); err != nil {
+				return n, err
+			}
+			last = time.Now()
+		}
+	}
+}
+
+// finishCheckpoint removes the state file of a stream that is done.
+func (s *Stream) finishCheckpoint(closeErr error) error {
+	c := s.checkpoint
+	if closeErr != nil || !c.done {
+		return closeErr
+	}
+	if err := os.Remove(c.config.File); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// flakyReader fails after limit bytes, like a dropped connection
+type flakyReader struct {
+	io.ReadCloser
+	limit int
+}
+
+func (fr *flakyReader) Read(b []byte) (int, error) {
+	if fr.limit <= 0 {
+		return 0, errors.New("connection lost")
+	}
+	if len(b) > fr.limit {
+		b = b[:fr.limit]
+	}
+	n, err := fr.ReadCloser.Read(b)
+	fr.limit -= n
+	return n, err
+}
+
+func TestCheckpointResume(t *testing.T) {
+	limit := 300000
+	RegisterInputStream("flaky", func(node *yaml.Node) (io.ReadCloser, error) {
+		return nil, errors.New("not resumed")
+	})
+	RegisterResumableInput("flaky", func(node *yaml.Node, offset int64) (io.ReadCloser, error) {
+		rc, err := local_resume_input(node, offset)
+		if err != nil || limit == 0 {
+			return rc, err
+		}
+		return &flakyReader{ReadCloser: rc, limit: limit}, nil
+	})
+	defer func() {
+		DefaultRegistry.Unregister(KindInput, "flaky")
+	}()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst.gz")
+	state := filepath.Join(dir, "state")
+	data := testData(1 << 20)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf(`
+checkpoint: {file: %v, interval: 1ns}
+input: {type: flaky, name: %v}
+encoder:
+  - type: gzip
+output: {type: local, name: %v}
+`, state, src, dst)
+
+	run := func() error {
+		s, err := NewStream(strings.NewReader(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Copy()
+		return errors.Join(err, s.Close())
+	}
+	if err := run(); err == nil || !strings.Contains(err.Error(), "connection lost") {
+		t.Fatalf("first run: got %v", err)
+	}
+	b, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatalf("no state after the failure: %v", err)
+	}
+	var st checkpointState
+	if err = json.Unmarshal(b, &st); err != nil || st.Input == 0 || st.Input > int64(limit) || st.Output == 0 {
+		t.Fatalf("state: %s", b)
+	}
+
+	limit = 0
+	if err := run(); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if _, err = os.Stat(state); !os.IsNotExist(err) {
+		t.Errorf("state file left after success: %v", err)
+	}
+	packed, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(packed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("resumed output: %v bytes, %v", len(got), err)
+	}
+}
+
+func TestCheckpointPlan(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+	for _, config := range []string{
+		"checkpoint: {interval: 1s}\ninput: {type: local, name: a}\noutput: {type: local, name: b}\n",
+		"checkpoint: {file: s}\nconcurrent: true\ninput: {type: local, name: a}\noutput: {type: local, name: b}\n",
+		"checkpoint: {file: s}\ninput: {type: local, name: a}\ndecoder: [{type: gzip}]\noutput: {type: local, name: b}\n",
+		"checkpoint: {file: s}\ninput: {type: stdin}\noutput: {type: local, name: b}\n",
+		"checkpoint: {file: s}\ninput: {type: local, name: a}\nencoder: [{type: zlib}]\noutput: {type: local, name: b}\n",
+		"checkpoint: {file: s}\ninput: {type: local, name: a}\noutput: {type: tcp, port: 1}\n",
+	} {
+		if _, err := NewPlan(strings.NewReader(config)); err == nil || !strings.Contains(err.Error(), "checkpoint") {
+			t.Errorf("NewPlan(%q): got %v, want a checkpoint error", config, err)
+		}
+	}
+	if !Resumable(KindInput, "local") || !Resumable(KindOutput, "local") || Resumable(KindOutput, "tcp") ||
+		!Resumable(KindEncoder, "gzip") || !Resumable(KindEncoder, "snappy") || Resumable(KindEncoder, "zlib") {
+		t.Errorf("unexpected capabilities")
+	}
+
+	// a state file of another config
+	os.WriteFile(state, []byte(`{"config":"other","input":10,"output":10}`), 0600)
+	_, err := NewStream(strings.NewReader(fmt.Sprintf(`
+checkpoint: {file: %v}
+input: {type: local, name: %v}
+output: {type: local, name: %v}
+`, state, state, filepath.Join(dir, "dst"))))
+	var oe *OpenError
+	if !errors.As(err, &oe) || !strings.Contains(err.Error(), "another config") {
+		t.Errorf("got %v, want a config mismatch", err)
+	}
+}
+
+func TestHTTPResume(t *testing.T) {
+	data := testData(1 << 12)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ranged", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	})
+	mux.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	open := func(path string, offset int64) ([]byte, error) {
+		var node yaml.Node
+		if err := yaml.Unmarshal([]byte(fmt.Sprintf("{type: http, url: %v%v}", srv.URL, path)), &node); err != nil {
+			t.Fatal(err)
+		}
+		rc, err := http_resume_input(node.Content[0], offset)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	if b, err := open("/ranged", 100); err != nil || !bytes.Equal(b, data[100:]) {
+		t.Errorf("ranged: %v bytes, %v", len(b), err)
+	}
+	if b, err := open("/plain", 0); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("plain at 0: %v bytes, %v", len(b), err)
+	}
+	if _, err := open("/plain", 100); err == nil || !strings.Contains(err.Error(), "can't resume at 100") {
+		t.Errorf("plain: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CanceledError is returned by CopyContext when ctx is done before the
+// copy completes. It unwraps to ctx.Err().
+type CanceledError struct {
+	N   int64 // bytes copied before the copy was interrupted
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("copy canceled after %v bytes: %v", e.N, e.Err)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// implemented by net.Conn, os.File, asyncReader, catReader and teeWriter
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+func setReadDeadline(r io.Reader, t time.Time) {
+	if d, ok := r.(readDeadliner); ok {
+		// regular files and blocking fds don't support deadlines,
+		// their reads don't block forever or can't be interrupted anyway
+		d.SetReadDeadline(t)
+	}
+}
+
+func setWriteDeadline(w io.Writer, t time.Time) {
+	if d, ok := w.(writeDeadliner); ok {
+		d.SetWriteDeadline(t)
+	}
+}
+
+// withDeadline returns an input that supports read deadlines: rc if it does,
+// or rc read in a goroutine, like a pipe on stdin or the body of an http
+// response. A regular file is returned as is, its reads don't block.
+func withDeadline(rc io.ReadCloser) io.ReadCloser {
+	if d, ok := rc.(readDeadliner); ok {
+		err := d.SetReadDeadline(time.Time{})
+		if err == nil {
+			return rc
+		}
+		if f, ok := rc.(*os.File); ok && errors.Is(err, os.ErrNoDeadline) {
+			if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+				return rc
+			}
+		}
+	}
+	return newAsyncReader(rc)
+}
+
+// asyncReader reads rc in a goroutine, a chunk ahead of its Read, so that a
+// Read can give up at a deadline. The goroutine ends with rc.
+type asyncReader struct {
+	rc   io.ReadCloser
+	data chan []byte // a chunk read, its buffer is reused after an ack
+	ack  chan struct{}
+	rerr error // after the last chunk
+	done chan struct{}
+	once sync.Once
+	cur  []byte // owned by Read
+	held bool   // the goroutine waits for an ack
+	err  error
+
+	mu      sync.Mutex
+	expired chan struct{} // closed at the deadline
+	timer   *time.Timer
+	gen     int // of the deadline, a stale timer doesn't expire a new one
+}
+
+func newAsyncReader(rc io.ReadCloser) *asyncReader {
+	ar := &asyncReader{
+		rc:      rc,
+		data:    make(chan []byte),
+		ack:     make(chan struct{}),
+		done:    make(chan struct{}),
+		expired: make(chan struct{}),
+	}
+	go ar.read()
+	return ar
+}
+
+func (ar *asyncReader) read() {
+	defer close(ar.data)
+	buf := make([]byte, defaultBufferSize)
+	for {
+		n, err := ar.rc.Read(buf)
+		if n > 0 {
+			select {
+			case ar.data <- buf[:n]:
+			case <-ar.done:
+				return
+			}
+			select {
+			case <-ar.ack:
+			case <-ar.done:
+				return
+			}
+		}
+		if err != nil {
+			ar.rerr = err
+			return
+		}
+	}
+}
+
+func (ar *asyncReader) Read(b []byte) (int, error) {
+	if len(ar.cur) == 0 && ar.err == nil {
+		if ar.held {
+			select {
+			case ar.ack <- struct{}{}:
+			case <-ar.done:
+			}
+			ar.held = false
+		}
+		ar.mu.Lock()
+		expired := ar.expired
+		ar.mu.Unlock()
+		select {
+		case buf, ok := <-ar.data:
+			if !ok {
+				ar.err = ar.rerr
+				break
+			}
+			ar.cur, ar.held = buf, true
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	if len(ar.cur) > 0 {
+		n := copy(b, ar.cur)
+		ar.cur = ar.cur[n:]
+		return n, nil
+	}
+	return 0, ar.err
+}
+
+// SetReadDeadline is like the one of net.Conn, a pending Read sees it too.
+func (ar *asyncReader) SetReadDeadline(t time.Time) error {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	ar.gen++
+	if ar.timer != nil {
+		ar.timer.Stop()
+		ar.timer = nil
+	}
+	select {
+	case <-ar.expired:
+		ar.expired = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return nil
+	}
+	if d := time.Until(t); d > 0 {
+		gen := ar.gen
+		ar.timer = time.AfterFunc(d, func() {
+			ar.mu.Lock()
+			defer ar.mu.Unlock()
+			if ar.gen == gen {
+				close(ar.expired)
+			}
+		})
+	} else {
+		close(ar.expired)
+	}
+	return nil
+}
+
+// Close closes rc, a read in progress ends with it or is left behind.
+func (ar *asyncReader) Close() error {
+	ar.once.Do(func() { close(ar.done) })
+	return ar.rc.Close()
+}
+
+// interruptWriteTimeout bounds a write of the output pump once the stream
+// is interrupted, so a peer that stopped reading can't block Close.
+var interruptWriteTimeout = 5 * time.Second
+
+// interrupt unblocks the pending reads and writes of a running Copy. In
+// concurrent mode the output is written by a pump, not by Copy: only a
+// blocked write into the pipe of the last encoder fails, the queued chunks
+// still go to the output, so Close can write the trailers after them. A
+// write of the pump that makes no progress within interruptWriteTimeout
+// fails though, and the stream with it.
+func (s *Stream) interrupt(err error) {
+	setReadDeadline(s.input, time.Unix(1, 0))
+	if n := len(s.wpipes); n > 0 {
+		s.wpipes[n-1].pipe.abortWrite(err)
+		s.wpipes[0].setWriteTimeout(interruptWriteTimeout)
+	} else {
+		setWriteDeadline(s.output, time.Unix(1, 0))
+	}
+	for _, pr := range s.rpipes {
+		pr.pipe.CloseRead(err)
+	}
+}
+
+// errStopped ends the Copy of a drained stream at its next read.
+var errStopped = errors.New("stream: stopped reading")
+
+// stoppableReader is the reader of Copy, it fails once the stream stops
+// reading, even if the input doesn't support deadlines like a regular file.
+type stoppableReader struct {
+	io.Reader
+	stopped *int32
+}
+
+func (sr stoppableReader) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(sr.stopped) != 0 {
+		return 0, errStopped
+	}
+	return sr.Reader.Read(b)
+}
+
+// stopReading unblocks the pending reads of a running Copy and ends it at
+// its next read. The bytes already read are still written.
+func (s *Stream) stopReading(err error) {
+	atomic.StoreInt32(&s.stopped, 1)
+	setReadDeadline(s.input, time.Unix(1, 0))
+	for _, pr := range s.rpipes {
+		pr.pipe.CloseRead(err)
+	}
+}
+
+// resume clears the deadlines and the abort set by interrupt, so Close can
+// still flush the encoders into the output. The timeout of the output pump
+// is kept.
+func (s *Stream) resume() {
+	setReadDeadline(s.input, time.Time{})
+	if n := len(s.wpipes); n > 0 {
+		s.wpipes[n-1].pipe.resumeWrite()
+	} else {
+		setWriteDeadline(s.output, time.Time{})
+	}
+}
+
+// CopyContext is like Copy, but interrupts the blocked reads and writes
+// when ctx is done and returns a *CanceledError. The stream still needs
+// to be closed, Close flushes whatever was encoded so far.
+func (s *Stream) CopyContext(ctx context.Context) (int64, error) {
+	return s.copyContext(ctx, s.interrupt)
+}
+
+// DrainContext is like CopyContext, but when ctx is done it only stops
+// reading the input: the bytes read so far go through the encoders to the
+// output, so that Close leaves a complete, if partial, output.
+func (s *Stream) DrainContext(ctx context.Context) (int64, error) {
+	return s.copyContext(ctx, s.stopReading)
+}
+
+func (s *Stream) copyContext(ctx context.Context, interrupt func(err error)) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, &CanceledError{Err: err}
+	}
+
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			interrupt(&CanceledError{Err: ctx.Err()})
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+
+	n, err := s.Copy()
+	close(stop)
+	if <-interrupted {
+		s.resume()
+		if err != nil {
+			return n, &CanceledError{N: n, Err: ctx.Err()}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,365 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestCopyContextDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// send a few bytes, then stall
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	dst := filepath.Join(t.TempDir(), "dst.gz")
+	for _, concurrent := range []bool{false, true} {
+		s, err := NewStream(strings.NewReader(fmt.Sprintf(`
+concurrent: %v
+input:
+  type: tcp
+  host: %v
+  port: %v
+encoder:
+  - type: gzip
+output:
+  type: local
+  name: %v
+`, concurrent, host, port, dst)))
+		if err != nil {
+			t.Fatalf("NewStream: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_, err = s.CopyContext(ctx)
+		cancel()
+		var ce *CanceledError
+		if !errors.As(err, &ce) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("CopyContext: got %v, want a deadline CanceledError", err)
+		}
+		if err = s.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		// the gzip trailer must have been written
+		file, err := os.Open(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(zr); err != nil || string(b) != "hello" {
+			t.Errorf("concurrent=%v: got %q, %v", concurrent, b, err)
+		}
+		file.Close()
+	}
+}
+
+// stallReader reads r, then blocks until release and fails like a read
+// past its deadline.
+type stallReader struct {
+	io.Reader
+	release chan struct{}
+}
+
+func (sr *stallReader) Read(b []byte) (int, error) {
+	n, err := sr.Reader.Read(b)
+	if err == io.EOF {
+		<-sr.release
+		return 0, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (sr *stallReader) Close() error {
+	return nil
+}
+
+func TestCopyContextConcurrent(t *testing.T) {
+	// more than the socket buffers, incompressible
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	input := &stallReader{Reader: bytes.NewReader(data), release: make(chan struct{})}
+	reg := DefaultRegistry.Clone()
+	reg.RegisterInputStream("stall", func(node *yaml.Node) (io.ReadCloser, error) {
+		return input, nil
+	})
+
+	out, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	canceled := make(chan struct{})
+	received := make(chan []byte, 1)
+	go func() {
+		// the output pump is blocked on a full socket until ctx is done
+		conn, err := out.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		conn.(*net.TCPConn).SetReadBuffer(256 << 10)
+		<-canceled
+		b, _ := io.ReadAll(conn)
+		received <- b
+	}()
+
+	s, err := reg.NewStream(strings.NewReader(fmt.Sprintf(`
+concurrent: true
+buffer: {size: 4096, depth: 4096}
+input: {type: stall}
+encoder:
+  - type: gzip
+    level: 1
+output: tcp://%v
+`, out.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// every byte is read and queued, then the input stalls
+		for s.rmeters[0].bytes.Load() < int64(len(data)) {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		// Copy is still running, the output pump must keep going
+		time.Sleep(50 * time.Millisecond)
+		close(input.release)
+		close(canceled)
+	}()
+	n, err := s.CopyContext(ctx)
+	var ce *CanceledError
+	if !errors.As(err, &ce) || n != int64(len(data)) {
+		t.Fatalf("CopyContext: %v bytes, %v", n, err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// the trailer follows the queued chunks
+	zr, err := gzip.NewReader(bytes.NewReader(<-received))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(zr); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %v bytes, %v", len(got), err)
+	}
+}
+
+func TestCopyContextStalledOutput(t *testing.T) {
+	defer func(d time.Duration) { interruptWriteTimeout = d }(interruptWriteTimeout)
+	interruptWriteTimeout = 100 * time.Millisecond
+
+	out, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stalled := make(chan struct{})
+	defer close(stalled)
+	go func() {
+		// never reads
+		conn, err := out.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-stalled
+	}()
+
+	reg := DefaultRegistry.Clone()
+	reg.RegisterInputStream("random", func(node *yaml.Node) (io.ReadCloser, error) {
+		return io.NopCloser(rand.New(rand.NewSource(1))), nil
+	})
+	s, err := reg.NewStream(strings.NewReader(fmt.Sprintf(`
+concurrent: true
+input: {type: random}
+encoder:
+  - type: gzip
+    level: 1
+output: tcp://%v
+`, out.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = s.CopyContext(ctx)
+	var ce *CanceledError
+	if !errors.As(err, &ce) {
+		t.Fatalf("CopyContext: %v", err)
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	select {
+	case err = <-closed:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on the stalled output")
+	}
+}
+
+// slowWriter makes a copy last long enough to be drained
+type slowWriter struct {
+	io.Writer
+}
+
+func (sw slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return sw.Writer.Write(b)
+}
+
+func (sw slowWriter) Close() error {
+	return nil
+}
+
+func TestDrainContext(t *testing.T) {
+	data := testData(1 << 24)
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packed bytes.Buffer
+	s, err := From(file).Encode("gzip", nil).To(slowWriter{&packed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// a regular file has no deadline, the copy stops at its next read
+	n, err := s.DrainContext(ctx)
+	var ce *CanceledError
+	if !errors.As(err, &ce) || n == 0 || n == int64(len(data)) {
+		t.Fatalf("DrainContext: %v bytes, %v", n, err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil || int64(len(got)) != n || !bytes.Equal(got, data[:n]) {
+		t.Errorf("got %v bytes of %v, %v", len(got), n, err)
+	}
+}
+
+// hangingReader returns its data, then blocks forever like an idle pipe
+type hangingReader struct {
+	data []byte
+}
+
+func (hr *hangingReader) Read(b []byte) (int, error) {
+	if len(hr.data) == 0 {
+		select {}
+	}
+	n := copy(b, hr.data)
+	hr.data = hr.data[n:]
+	return n, nil
+}
+
+func (hr *hangingReader) Close() error {
+	return nil
+}
+
+func TestDrainNoDeadline(t *testing.T) {
+	var packed bytes.Buffer
+	s, err := From(&hangingReader{data: []byte("hello")}).Encode("gzip", nil).To(&nopWriteCloser{&packed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.DrainContext(ctx)
+		done <- errors.Join(err, s.Close())
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the drain waits for the input")
+	}
+	var ce *CanceledError
+	if !errors.As(err, &ce) || ce.N != 5 {
+		t.Fatalf("DrainContext: %v", err)
+	}
+	zr, err := gzip.NewReader(&packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(zr); err != nil || string(got) != "hello" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestBatchDrain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		time.Sleep(time.Second)
+	}()
+
+	dst := filepath.Join(t.TempDir(), "dst.gz")
+	batch, err := LoadBatch(strings.NewReader(fmt.Sprintf(`
+input: tcp://%v
+encoder:
+  - type: gzip
+output: file://%v
+`, ln.Addr(), dst)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.Drain = true
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	reports := batch.Run(ctx)
+	if r := reports[0]; !r.Partial || r.Status() != "partial" || r.Bytes != 5 {
+		t.Errorf("report: %+v", r)
+	}
+}
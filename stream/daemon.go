@@ -0,0 +1,360 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Daemon runs every config of a directory, a pipeline per file:
+//
+//	/etc/stream_cast.d/
+//	  relay.yaml
+//	  backup.toml
+//
+// The files are polled: an added file is started, a changed one is drained
+// and started again, a removed one is drained. Reload polls at once. A
+// pipeline that fails is restarted after a backoff, doubled after every
+// failure in a row; an invalid config waits for the file to change. The
+// files of the includes aren't watched. The names of the pipelines are the
+// names of the files, the status of every pipeline is served over http.
+
+const (
+	defaultPollInterval   = 2 * time.Second
+	defaultRestartBackoff = time.Second
+	defaultMaxRestart     = time.Minute
+)
+
+const (
+	PipelineStarting = "starting"
+	PipelineRunning  = "running"
+	PipelineBackoff  = "backoff"  // failed, waiting to restart
+	PipelineInvalid  = "invalid"  // the config is invalid, waiting for a change
+	PipelineFinished = "finished" // every stream completed
+	PipelineStopped  = "stopped"
+)
+
+// PipelineStatus is the state of the pipeline of a file.
+type PipelineStatus struct {
+	Name     string         `json:"name"`
+	State    string         `json:"state"`
+	Since    time.Time      `json:"since"`
+	Restarts int            `json:"restarts"`
+	Error    string         `json:"error,omitempty"`
+	Streams  []StreamStatus `json:"streams,omitempty"` // the reports of the last run
+}
+
+// StreamStatus is the report of a stream of a pipeline.
+type StreamStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Bytes  int64  `json:"bytes"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Daemon struct {
+	Dir      string
+	Registry *Registry     // DefaultRegistry if nil
+	Interval time.Duration // between the polls of the directory
+	// the backoff before a restart, doubled up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	mu        sync.Mutex
+	pipelines map[string]*pipeline
+	reload    chan struct{}
+}
+
+func NewDaemon(dir string) *Daemon {
+	return &Daemon{
+		Dir:            dir,
+		Interval:       defaultPollInterval,
+		InitialBackoff: defaultRestartBackoff,
+		MaxBackoff:     defaultMaxRestart,
+		pipelines:      make(map[string]*pipeline),
+		reload:         make(chan struct{}, 1),
+	}
+}
+
+type pipeline struct {
+	path   string
+	hash   [sha256.Size]byte
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	status PipelineStatus
+}
+
+func (p *pipeline) set(state string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.State, p.status.Since = state, time.Now()
+	p.status.Error = ""
+	if err != nil {
+		p.status.Error = Redact(err.Error())
+	}
+}
+
+// isConfigFile reports whether a file of the directory is a config.
+func isConfigFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json", ".toml":
+		return true
+	}
+	return false
+}
+
+// namedReader is a config read before it's loaded, the name is for the
+// format and the includes.
+type namedReader struct {
+	*bytes.Reader
+	name string
+}
+
+func (nr namedReader) Name() string {
+	return nr.name
+}
+
+func (d *Daemon) registry() *Registry {
+	if d.Registry != nil {
+		return d.Registry
+	}
+	return DefaultRegistry
+}
+
+// load checks and loads the config of a file.
+func (d *Daemon) load(path string, data []byte) (*Batch, error) {
+	reg := d.registry()
+	if err := reg.Check(namedReader{bytes.NewReader(data), path}).Err(); err != nil {
+		return nil, err
+	}
+	return reg.LoadBatch(namedReader{bytes.NewReader(data), path})
+}
+
+// Reload makes Run poll the directory at once.
+func (d *Daemon) Reload() {
+	select {
+	case d.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs the pipelines until ctx is done, then drains them all.
+func (d *Daemon) Run(ctx context.Context) error {
+	if _, err := os.ReadDir(d.Dir); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		d.poll(ctx)
+		select {
+		case <-ctx.Done():
+			d.mu.Lock()
+			var stopped []*pipeline
+			for name, p := range d.pipelines {
+				stopped = append(stopped, p)
+				delete(d.pipelines, name)
+			}
+			d.mu.Unlock()
+			stop(stopped)
+			return nil
+		case <-ticker.C:
+		case <-d.reload:
+		}
+	}
+}
+
+// poll starts, restarts and stops the pipelines after the files of the
+// directory. The lock isn't held while the pipelines drain, the status is
+// still served.
+func (d *Daemon) poll(ctx context.Context) {
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		// a directory that disappears stops nothing, it may come back
+		return
+	}
+	type config struct {
+		name, path string
+		data       []byte
+		hash       [sha256.Size]byte
+	}
+	var changed []config
+	var stopped []*pipeline
+	seen := make(map[string]bool)
+	d.mu.Lock()
+	for _, e := range entries {
+		if e.IsDir() || !isConfigFile(e.Name()) {
+			continue
+		}
+		path := filepath.Join(d.Dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		seen[e.Name()] = true
+		hash := sha256.Sum256(data)
+		if p, ok := d.pipelines[e.Name()]; ok {
+			if p.hash == hash {
+				continue
+			}
+			stopped = append(stopped, p)
+		}
+		changed = append(changed, config{e.Name(), path, data, hash})
+	}
+	for name, p := range d.pipelines {
+		if !seen[name] {
+			stopped = append(stopped, p)
+			delete(d.pipelines, name)
+		}
+	}
+	d.mu.Unlock()
+
+	// a changed pipeline is listed as it was until it's drained
+	stop(stopped)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range changed {
+		d.pipelines[c.name] = d.start(ctx, c.name, c.path, c.data, c.hash)
+	}
+}
+
+// stop drains the pipelines, all at once.
+func stop(list []*pipeline) {
+	for _, p := range list {
+		p.cancel()
+	}
+	for _, p := range list {
+		<-p.done
+	}
+}
+
+func (d *Daemon) start(ctx context.Context, name, path string, data []byte, hash [sha256.Size]byte) *pipeline {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &pipeline{path: path, hash: hash, cancel: cancel, done: make(chan struct{})}
+	p.status = PipelineStatus{Name: name, State: PipelineStarting, Since: time.Now()}
+	go func() {
+		defer close(p.done)
+		d.supervise(ctx, p, data)
+	}()
+	return p
+}
+
+// supervise runs the config of a pipeline until it finishes, restarting it
+// when it fails.
+func (d *Daemon) supervise(ctx context.Context, p *pipeline, data []byte) {
+	rc := retryConfig{InitialBackoff: d.InitialBackoff, MaxBackoff: d.MaxBackoff, Jitter: defaultRetryJitter}
+	failures := 0
+	for {
+		// a new batch for every run, its streams are opened when it runs
+		batch, err := d.load(p.path, data)
+		if err != nil {
+			p.set(PipelineInvalid, err)
+			<-ctx.Done()
+			p.set(PipelineStopped, nil)
+			return
+		}
+		batch.Drain = true
+		p.set(PipelineRunning, nil)
+		start := time.Now()
+		reports := batch.Run(ctx)
+
+		var errs []error
+		p.mu.Lock()
+		p.status.Streams = nil
+		for _, r := range reports {
+			st := StreamStatus{Name: r.Name, Status: r.Status(), Bytes: r.Bytes}
+			if r.Err != nil {
+				st.Error = Redact(r.Err.Error())
+				errs = append(errs, fmt.Errorf("%v: %w", r.Name, r.Err))
+			}
+			p.status.Streams = append(p.status.Streams, st)
+		}
+		p.mu.Unlock()
+
+		if ctx.Err() != nil {
+			p.set(PipelineStopped, nil)
+			return
+		}
+		if len(errs) == 0 {
+			p.set(PipelineFinished, nil)
+			<-ctx.Done()
+			return
+		}
+
+		// a run that lasted resets the backoff
+		if time.Since(start) > d.MaxBackoff {
+			failures = 0
+		}
+		failures++
+		p.set(PipelineBackoff, errors.Join(errs...))
+		timer := time.NewTimer(rc.backoff(failures))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			p.set(PipelineStopped, nil)
+			return
+		case <-timer.C:
+		}
+		p.mu.Lock()
+		p.status.Restarts++
+		p.mu.Unlock()
+	}
+}
+
+// Status returns the status of the pipelines, sorted by name.
+func (d *Daemon) Status() []PipelineStatus {
+	d.mu.Lock()
+	list := make([]PipelineStatus, 0, len(d.pipelines))
+	for _, p := range d.pipelines {
+		p.mu.Lock()
+		st := p.status
+		st.Streams = append([]StreamStatus(nil), st.Streams...)
+		p.mu.Unlock()
+		list = append(list, st)
+	}
+	d.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// ServeHTTP serves the status of the pipelines as JSON on /status, and
+// /healthz fails if a pipeline is invalid or waits to restart.
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/status":
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(d.Status())
+	case "/healthz":
+		var failed []string
+		for _, st := range d.Status() {
+			if st.State == PipelineBackoff || st.State == PipelineInvalid {
+				failed = append(failed, fmt.Sprintf("%v: %v: %v", st.Name, st.State, st.Error))
+			}
+		}
+		if len(failed) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "failed\n%v\n", strings.Join(failed, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	default:
+		http.NotFound(w, r)
+	}
+}
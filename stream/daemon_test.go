@@ -0,0 +1,204 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// waitStatus polls the daemon until ok accepts the status of name.
+func waitStatus(t *testing.T, d *Daemon, name string, ok func(st *PipelineStatus) bool) PipelineStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var found *PipelineStatus
+		list := d.Status()
+		for i := range list {
+			if list[i].Name == name {
+				found = &list[i]
+			}
+		}
+		if ok(found) {
+			if found == nil {
+				return PipelineStatus{}
+			}
+			return *found
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v: %+v", name, found)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	data := testData(1 << 12)
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, config string) {
+		if err := os.WriteFile(filepath.Join(confDir, name), []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := filepath.Join(dir, "dst")
+	write("copy.yaml", "input: file://"+src+"\noutput: file://"+dst+"\n")
+	write("broken.yaml", "input: file://"+filepath.Join(dir, "missing")+"\noutput: file://"+dst+".2\n")
+	write("invalid.yaml", "input: {type: nope}\n")
+	write("notes.txt", "not a config")
+
+	d := NewDaemon(confDir)
+	d.Interval = time.Hour // polls on Reload only
+	d.InitialBackoff = 10 * time.Millisecond
+	d.MaxBackoff = 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Run(ctx)
+	}()
+
+	st := waitStatus(t, d, "copy.yaml", func(st *PipelineStatus) bool {
+		return st != nil && st.State == PipelineFinished
+	})
+	if len(st.Streams) != 1 || st.Streams[0].Bytes != int64(len(data)) {
+		t.Errorf("copy.yaml: %+v", st)
+	}
+	if b, err := os.ReadFile(dst); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("dst: %v bytes, %v", len(b), err)
+	}
+	waitStatus(t, d, "broken.yaml", func(st *PipelineStatus) bool {
+		return st != nil && st.Restarts >= 2 && st.Error != ""
+	})
+	waitStatus(t, d, "invalid.yaml", func(st *PipelineStatus) bool {
+		return st != nil && st.State == PipelineInvalid
+	})
+	if len(d.Status()) != 3 {
+		t.Errorf("status: %+v", d.Status())
+	}
+
+	srv := httptest.NewServer(d)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("healthz: %v", resp.Status)
+	}
+
+	// the fixed config is restarted, the removed one is stopped
+	os.Remove(dst)
+	write("broken.yaml", "input: file://"+src+"\noutput: file://"+dst+".2\n")
+	os.Remove(filepath.Join(confDir, "invalid.yaml"))
+	d.Reload()
+	st = waitStatus(t, d, "broken.yaml", func(st *PipelineStatus) bool {
+		return st != nil && st.State == PipelineFinished
+	})
+	if st.Restarts != 0 {
+		t.Errorf("broken.yaml: %+v", st)
+	}
+	waitStatus(t, d, "invalid.yaml", func(st *PipelineStatus) bool {
+		return st == nil
+	})
+	if _, err := os.Stat(dst); err == nil {
+		t.Errorf("the unchanged copy.yaml ran again")
+	}
+
+	resp, err = http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []PipelineStatus
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || len(list) != 2 || list[0].Name != "broken.yaml" || list[1].Name != "copy.yaml" {
+		t.Errorf("status: %+v, %v", list, err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Status()) != 0 {
+		t.Errorf("status after Run: %+v", d.Status())
+	}
+}
+
+// blockingReader blocks until release, it has no deadline
+type blockingReader struct {
+	release chan struct{}
+}
+
+func (br blockingReader) Read(b []byte) (int, error) {
+	<-br.release
+	return 0, io.EOF
+}
+
+func (br blockingReader) Close() error {
+	return nil
+}
+
+func TestDaemonSlowDrain(t *testing.T) {
+	release := make(chan struct{})
+	reg := DefaultRegistry.Clone()
+	reg.RegisterInputStream("block", func(node *yaml.Node) (io.ReadCloser, error) {
+		return blockingReader{release}, nil
+	})
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	confDir := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(confDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.yaml", "b.yaml"} {
+		config := "input: {type: block}\noutput: file://" + dst + "." + name + "\n"
+		if err := os.WriteFile(filepath.Join(confDir, name), []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewDaemon(confDir)
+	d.Registry = reg
+	d.Interval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Run(ctx)
+	}()
+	for _, name := range []string{"a.yaml", "b.yaml"} {
+		waitStatus(t, d, name, func(st *PipelineStatus) bool {
+			return st != nil && st.State == PipelineRunning
+		})
+	}
+
+	// the drain of a.yaml blocks, the status is still served
+	os.Remove(filepath.Join(confDir, "a.yaml"))
+	d.Reload()
+	waitStatus(t, d, "a.yaml", func(st *PipelineStatus) bool {
+		return st == nil
+	})
+	if list := d.Status(); len(list) != 1 || list[0].State != PipelineRunning {
+		t.Errorf("status: %+v", list)
+	}
+	close(release)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,166 @@
+package stream
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The registered types can be listed with their options, for the users who
+// write configs. The options come from the struct of the typed
+// registration helpers, the `desc` tag of a field describes it and the
+// `type` tag overrides the name of its type.
+
+// Describe sets the one line description of a type.
+func (reg *Registry) Describe(kind Kind, name, desc string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.descriptions[kind][name] = desc
+}
+
+func Describe(kind Kind, name, desc string) {
+	DefaultRegistry.Describe(kind, name, desc)
+}
+
+type OptionInfo struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Default     string   `json:"default,omitempty"`
+	Required    bool     `json:"required,omitempty"`
+	Min         string   `json:"min,omitempty"`
+	Max         string   `json:"max,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+	Secret      bool     `json:"secret,omitempty"`
+	Arg         int      `json:"arg,omitempty"` // position in an inline stage
+}
+
+type TypeInfo struct {
+	Kind        Kind   `json:"kind"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// nil if the type was registered without an options struct, its
+	// options are unknown
+	Options   []OptionInfo `json:"options"`
+	Resumable bool         `json:"resumable,omitempty"`
+}
+
+var kinds = []Kind{KindInput, KindDecoder, KindEncoder, KindOutput}
+
+func optionTypeName(f reflect.StructField) string {
+	if name := f.Tag.Get("type"); name != "" {
+		return name
+	}
+	t := f.Type
+	switch {
+	case t == reflect.TypeOf(time.Duration(0)):
+		return "duration"
+	case t == reflect.TypeOf(yaml.Node{}):
+		return "any"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		// a list of stages is tagged `type:"list"`
+		return "array"
+	}
+	return "map"
+}
+
+func (spec *optionSpec) info() []OptionInfo {
+	options := []OptionInfo{}
+	for _, f := range spec.fields {
+		sf := spec.typ.Field(f.index)
+		options = append(options, OptionInfo{
+			Name:        f.name,
+			Type:        optionTypeName(sf),
+			Description: sf.Tag.Get("desc"),
+			Default:     f.def,
+			Required:    f.required,
+			Min:         sf.Tag.Get("min"),
+			Max:         sf.Tag.Get("max"),
+			Enum:        f.enum,
+			Secret:      f.secret,
+			Arg:         f.arg,
+		})
+	}
+	return options
+}
+
+func keys[V any](m map[string]V) []string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (reg *Registry) typeNames(kind Kind) []string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	var names []string
+	switch kind {
+	case KindInput:
+		names = keys(reg.inputs)
+	case KindDecoder:
+		names = keys(reg.decoders)
+	case KindEncoder:
+		names = keys(reg.encoders)
+	case KindOutput:
+		names = keys(reg.outputs)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupType describes a registered type.
+func (reg *Registry) LookupType(kind Kind, name string) (TypeInfo, bool) {
+	if !reg.registered(kind, name) {
+		return TypeInfo{}, false
+	}
+	info := TypeInfo{
+		Kind:      kind,
+		Name:      name,
+		Resumable: reg.Resumable(kind, name),
+	}
+	reg.mu.RLock()
+	info.Description = reg.descriptions[kind][name]
+	spec, ok := reg.options[kind][name]
+	reg.mu.RUnlock()
+	if ok {
+		info.Options = spec.info()
+	}
+	return info, true
+}
+
+// Types describes every registered type: inputs, decoders, encoders and
+// outputs, sorted by name.
+func (reg *Registry) Types() []TypeInfo {
+	var types []TypeInfo
+	for _, kind := range kinds {
+		for _, name := range reg.typeNames(kind) {
+			if info, ok := reg.LookupType(kind, name); ok {
+				types = append(types, info)
+			}
+		}
+	}
+	return types
+}
+
+func LookupType(kind Kind, name string) (TypeInfo, bool) {
+	return DefaultRegistry.LookupType(kind, name)
+}
+
+func Types() []TypeInfo {
+	return DefaultRegistry.Types()
+}
@@ -0,0 +1,45 @@
+package stream
+
+import (
+	"io"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestTypes(t *testing.T) {
+	found := make(map[string]TypeInfo)
+	for _, info := range Types() {
+		found[string(info.Kind)+"/"+info.Name] = info
+	}
+	for _, name := range []string{"input/cat", "output/tee", "decoder/snappy", "encoder/snappy", "input/tcp"} {
+		if info, ok := found[name]; !ok || info.Description == "" {
+			t.Errorf("%v: %+v", name, info)
+		}
+	}
+
+	info, ok := LookupType(KindEncoder, "gzip")
+	if !ok || !info.Resumable || len(info.Options) != 1 {
+		t.Fatalf("gzip: %+v", info)
+	}
+	if opt := info.Options[0]; opt.Name != "level" || opt.Type != "integer" || opt.Default != "-1" ||
+		opt.Min != "-2" || opt.Max != "9" {
+		t.Errorf("gzip level: %+v", opt)
+	}
+	info, _ = LookupType(KindOutput, "tcp")
+	if opt := info.Options[1]; opt.Name != "port" || !opt.Required {
+		t.Errorf("tcp port: %+v", opt)
+	}
+	if info, _ = LookupType(KindDecoder, "gzip"); info.Options == nil || len(info.Options) != 0 {
+		t.Errorf("gzip decoder has no option: %+v", info)
+	}
+
+	RegisterInputStream("untyped", func(node *yaml.Node) (io.ReadCloser, error) { return nil, nil })
+	defer DefaultRegistry.Unregister(KindInput, "untyped")
+	if info, ok = LookupType(KindInput, "untyped"); !ok || info.Options != nil {
+		t.Errorf("untyped: %+v", info)
+	}
+	if _, ok = LookupType(KindInput, "nope"); ok {
+		t.Errorf("nope is not registered")
+	}
+}
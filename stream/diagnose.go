@@ -0,0 +1,375 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Check walks a whole config and reports every problem it finds, where
+// NewPlan stops at the first one:
+//
+//	error: encoder[1].type (line 7, column 11): unknown encoder 'gzp', did you mean 'gzip'?
+//	error: output.child[2].name (line 12, column 9): is missing
+//	warning: concurent (line 2, column 1): unknown key, did you mean 'concurrent'?
+//
+// Warnings don't stop a config from running.
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is a problem of a config. Path is the path of the key, like
+// `output.child[2].type`, Line and Column are 0 if unknown. File is set if
+// the line is the one of an included file, for its profiles and its keys.
+type Diagnostic struct {
+	Severity   Severity `json:"severity"`
+	Path       string   `json:"path,omitempty"`
+	File       string   `json:"file,omitempty"`
+	Line       int      `json:"line,omitempty"`
+	Column     int      `json:"column,omitempty"`
+	Message    string   `json:"message"`
+	Suggestion string   `json:"suggestion,omitempty"` // a close name
+}
+
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	b.WriteString(string(d.Severity))
+	b.WriteString(": ")
+	b.WriteString(d.Path)
+	if d.Line > 0 {
+		if d.Path != "" {
+			b.WriteString(" ")
+		}
+		fmt.Fprintf(&b, "(%v, column %v)", where(d.File, d.Line), d.Column)
+	}
+	if d.Path != "" || d.Line > 0 {
+		b.WriteString(": ")
+	}
+	b.WriteString(d.Message)
+	if d.Suggestion != "" {
+		fmt.Fprintf(&b, ", did you mean '%v'?", d.Suggestion)
+	}
+	return Redact(b.String())
+}
+
+type Diagnostics []Diagnostic
+
+// Err returns the diagnostics as an error if one of them is an error.
+func (ds Diagnostics) Err() error {
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			return ds
+		}
+	}
+	return nil
+}
+
+func (ds Diagnostics) Error() string {
+	var lines []string
+	for _, d := range ds {
+		lines = append(lines, d.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Check reads a config and returns its diagnostics.
+func Check(r io.Reader) Diagnostics {
+	return DefaultRegistry.Check(r)
+}
+
+// Check is Check with the types of the registry.
+func (reg *Registry) Check(r io.Reader) Diagnostics {
+	root, src, err := loadDocument(r)
+	if err != nil {
+		return Diagnostics{{Severity: SeverityError, Message: err.Error()}}
+	}
+	c := &checker{reg: reg, src: src}
+	// the stages are expanded in place, the plan expands its own copy
+	c.document(src.copy(root))
+	// in the order of the files, the config first
+	sort.SliceStable(c.diags, func(i, j int) bool {
+		a, b := c.diags[i], c.diags[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+	if c.errors == 0 {
+		// what the walk doesn't check, like the graph links
+		if _, err = reg.newBatch(root, src); err != nil {
+			c.add(SeverityError, "", nil, err.Error(), "")
+		}
+	}
+	return c.diags
+}
+
+type checker struct {
+	reg    *Registry
+	src    sources
+	file   string // of the stage being checked, if it's another file
+	diags  Diagnostics
+	errors int
+}
+
+func (c *checker) add(sev Severity, path string, node *yaml.Node, msg, suggestion string) {
+	d := Diagnostic{Severity: sev, Path: path, Message: msg, Suggestion: suggestion}
+	if node != nil {
+		d.File, d.Line, d.Column = c.file, node.Line, node.Column
+	}
+	if sev == SeverityError {
+		c.errors++
+	}
+	c.diags = append(c.diags, d)
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func index(path string, i int) string {
+	return fmt.Sprintf("%v[%v]", path, i)
+}
+
+// the top level keys, `name` for the streams of a batch
+var (
+	streamKeys = []string{"input", "decoder", "encoder", "output", "concurrent", "buffer", "checkpoint"}
+	graphKeys  = []string{"graph"}
+	batchKeys  = []string{"streams", "policy", "metrics"}
+)
+
+// keys warns about the keys of node that aren't known.
+func (c *checker) keys(path string, node *yaml.Node, known ...[]string) {
+	var names []string
+	for _, k := range known {
+		names = append(names, k...)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if !contains(names, key.Value) {
+			c.add(SeverityWarning, join(path, key.Value), key, "unknown key, it's ignored", suggest(key.Value, names))
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checker) document(root *yaml.Node) {
+	if root.Kind != yaml.MappingNode {
+		c.add(SeverityError, "", root, "the config should be a map", "")
+		return
+	}
+	if getChildByTag(root, "streams") < 0 {
+		c.job("", root, batchKeys)
+		return
+	}
+	c.keys("", root, batchKeys)
+	streams := root.Content[getChildByTag(root, "streams")+1]
+	if streams.Kind != yaml.SequenceNode || len(streams.Content) == 0 {
+		c.add(SeverityError, "streams", streams, "needs a non-empty list", "")
+		return
+	}
+	names := make(map[string]bool)
+	for i, n := range streams.Content {
+		path := index("streams", i)
+		if n.Kind != yaml.MappingNode {
+			c.add(SeverityError, path, n, "needs a map", "")
+			continue
+		}
+		if j := getChildByTag(n, "name"); j < 0 {
+			c.add(SeverityError, join(path, "name"), n, "is missing", "")
+		} else if name := n.Content[j+1]; names[name.Value] {
+			c.add(SeverityError, join(path, "name"), name, fmt.Sprintf("duplicated name: %v", name.Value), "")
+		} else {
+			names[name.Value] = true
+		}
+		c.job(path, n, []string{"name"})
+	}
+}
+
+// job checks a stream or a graph, extra are the other keys it may have.
+func (c *checker) job(path string, node *yaml.Node, extra []string) {
+	if isGraph(node) {
+		c.keys(path, node, graphKeys, extra)
+		c.graph(path, node)
+		return
+	}
+	c.keys(path, node, streamKeys, extra)
+	for _, kind := range []Kind{KindInput, KindOutput} {
+		i := getChildByTag(node, string(kind))
+		if i < 0 {
+			c.add(SeverityError, join(path, string(kind)), node, "is missing", "")
+			continue
+		}
+		c.stage(kind, join(path, string(kind)), node.Content[i+1])
+	}
+	var config streamConfig
+	node.Decode(&config)
+	for _, kind := range []Kind{KindDecoder, KindEncoder} {
+		i := getChildByTag(node, string(kind))
+		if i < 0 {
+			continue
+		}
+		list, p := node.Content[i+1], join(path, string(kind))
+		if list.Kind != yaml.SequenceNode {
+			c.add(SeverityError, p, list, "needs a list", "")
+			continue
+		}
+		for j, n := range list.Content {
+			c.stage(kind, index(p, j), n)
+			if k := getChildByTag(n, "buffer"); k >= 0 && !config.Concurrent {
+				c.add(SeverityWarning, join(index(p, j), "buffer"), n.Content[k],
+					"ignored, the stream isn't concurrent", "")
+			}
+		}
+	}
+}
+
+func (c *checker) graph(path string, node *yaml.Node) {
+	list := node.Content[getChildByTag(node, "graph")+1]
+	p := join(path, "graph")
+	if list.Kind != yaml.SequenceNode || len(list.Content) == 0 {
+		c.add(SeverityError, p, list, "needs a non-empty list", "")
+		return
+	}
+	for i, n := range list.Content {
+		np := index(p, i)
+		if n.Kind != yaml.MappingNode {
+			c.add(SeverityError, np, n, "needs a map", "")
+			continue
+		}
+		kinds := []string{string(KindInput), string(KindDecoder), string(KindEncoder), string(KindOutput)}
+		c.keys(np, n, []string{"id", "from"}, kinds)
+		if getChildByTag(n, "id") < 0 {
+			c.add(SeverityError, join(np, "id"), n, "is missing", "")
+		}
+		found := false
+		for j := 0; j+1 < len(n.Content); j += 2 {
+			if key := n.Content[j].Value; contains(kinds, key) {
+				found = true
+				c.stage(Kind(key), join(np, key), n.Content[j+1])
+			}
+		}
+		if !found {
+			c.add(SeverityError, np, n, "needs one of input/decoder/encoder/output", "")
+		}
+	}
+}
+
+// stage checks a stage and its children.
+func (c *checker) stage(kind Kind, path string, node *yaml.Node) {
+	if file, ok := c.src[node]; ok {
+		defer func(file string) { c.file = file }(c.file)
+		c.file = file
+	}
+	if err := c.reg.expandURL(kind, node); err != nil {
+		c.add(SeverityError, path, node, err.Error(), "")
+		return
+	}
+	if node.Kind != yaml.MappingNode {
+		c.add(SeverityError, path, node, fmt.Sprintf("%v should be a map", kind), "")
+		return
+	}
+	i := getChildByTag(node, "type")
+	if i < 0 {
+		c.add(SeverityError, join(path, "type"), node, "is missing", "")
+		return
+	}
+	value := node.Content[i+1]
+	typ := value.Value
+	if !c.reg.registered(kind, typ) {
+		c.add(SeverityError, join(path, "type"), value, fmt.Sprintf("unknown %v '%v'", kind, typ),
+			suggest(typ, c.reg.typeNames(kind)))
+		return
+	}
+	if err := expandStage(node); err != nil {
+		c.add(SeverityError, path, node, err.Error(), "")
+		return
+	}
+
+	if spec := c.reg.optionSpec(kind, typ); spec != nil {
+		_, errs := spec.decodeAll(kind, node)
+		for _, oe := range errs {
+			pos := &yaml.Node{Line: oe.Line, Column: oe.Column}
+			p, suggestion := path, ""
+			if oe.Option != "" {
+				p = join(path, oe.Option)
+			}
+			if errors.Is(oe.Err, errUnknownOption) {
+				suggestion = suggest(oe.Option, spec.names(kind))
+			}
+			c.add(SeverityError, p, pos, oe.Err.Error(), suggestion)
+		}
+	} else if fn := c.reg.validator(kind, typ); fn != nil {
+		if err := fn(node); err != nil {
+			c.add(SeverityError, path, node, err.Error(), "")
+		}
+	}
+
+	if kind == KindInput || kind == KindOutput {
+		if j := getChildByTag(node, "retry"); j >= 0 {
+			if _, err := parseRetry(node); err != nil {
+				c.add(SeverityError, join(path, "retry"), node.Content[j+1], err.Error(), "")
+			}
+		}
+		for j, n := range getList(node, "child") {
+			c.stage(kind, index(join(path, "child"), j), n)
+		}
+	}
+}
+
+// suggest returns the closest name to s, if it's close enough to be a typo:
+// a third of s may be wrong.
+func suggest(s string, names []string) string {
+	best, bestDist := "", len(s)/3+2
+	for _, name := range names {
+		if d := editDistance(s, name); d < bestDist && d < len(s) {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
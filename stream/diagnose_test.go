@@ -0,0 +1,121 @@
+package stream
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestCheck(t *testing.T) {
+	diags := Check(strings.NewReader(`
+concurent: true
+input:
+  type: local
+  nme: /etc/hostname
+decoder:
+  - type: gzp
+encoder:
+  - type: gzip
+    levle: 3
+    buffer: {size: 10}
+  - {type: lzw, litwidth: 12}
+output:
+  type: tee
+  child:
+    - {type: stdout}
+    - {type: local}
+    - {tpe: local}
+`))
+	want := []string{
+		"warning: concurent (line 2, column 1): unknown key, it's ignored, did you mean 'concurrent'?",
+		"error: input.name (line 4, column 3): is missing",
+		"error: input.nme (line 5, column 3): unknown option, did you mean 'name'?",
+		"error: decoder[0].type (line 7, column 11): unknown decoder 'gzp', did you mean 'gzip'?",
+		"error: encoder[0].levle (line 10, column 5): unknown option, did you mean 'level'?",
+		"warning: encoder[0].buffer (line 11, column 5): ignored, the stream isn't concurrent",
+		"error: encoder[1].litwidth (line 12, column 27): 12 is out of range [2, 8]",
+		"error: output.child[1].name (line 17, column 7): is missing",
+		"error: output.child[2].type (line 18, column 7): is missing",
+	}
+	if got := diags.Error(); got != strings.Join(want, "\n") {
+		t.Errorf("got:\n%v\nwant:\n%v", got, strings.Join(want, "\n"))
+	}
+	if diags.Err() == nil {
+		t.Errorf("the diagnostics have errors")
+	}
+}
+
+func TestCheckJobs(t *testing.T) {
+	for _, c := range []struct {
+		config string
+		want   []string
+	}{
+		{"input: {type: stdin}\noutput: {type: stdout}\n", nil},
+		{"input: {type: stdin}\noutput: {type: stdout}\nname: x\n",
+			[]string{"warning: name (line 3, column 1): unknown key, it's ignored"}},
+		{`
+streams:
+  - name: a
+    input: {type: stdin}
+  - name: a
+    graph:
+      - {id: in, input: {type: stdn}}
+      - {id: out, from: in, outptu: {type: stdout}}
+`, []string{
+			"error: streams[0].output (line 3, column 5): is missing",
+			"error: streams[1].name (line 5, column 11): duplicated name: a",
+			"error: streams[1].graph[0].input.type (line 7, column 32): unknown input 'stdn', did you mean 'stdin'?",
+			"error: streams[1].graph[1] (line 8, column 9): needs one of input/decoder/encoder/output",
+			"warning: streams[1].graph[1].outptu (line 8, column 29): unknown key, it's ignored, did you mean 'output'?",
+		}},
+		// found by the plan once the walk is clean
+		{"input: {type: stdin}\noutput: {type: stdout}\nconcurrent: true\ncheckpoint: {file: x}\n",
+			[]string{"error: checkpoint: a concurrent stream can't checkpoint"}},
+		{"[input]\ntype = \"stdin\"\n[output]\ntype = \"local\"\nnme = \"x\"\n", []string{
+			"error: output.nme: unknown option, did you mean 'name'?",
+			"error: output.name: is missing",
+		}},
+	} {
+		r := strings.NewReader(c.config)
+		diags := Check(r)
+		if strings.HasPrefix(c.config, "[") {
+			diags = Check(WithFormat(strings.NewReader(c.config), FormatTOML))
+		}
+		var got []string
+		for _, d := range diags {
+			got = append(got, d.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+			t.Errorf("%v\ngot:\n%v\nwant:\n%v", c.config, strings.Join(got, "\n"), strings.Join(c.want, "\n"))
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	names := []string{"gzip", "zlib", "flate", "lzw", "snappy"}
+	for s, want := range map[string]string{"gzp": "gzip", "zlb": "zlib", "snapy": "snappy", "zstd": "", "x": ""} {
+		if got := suggest(s, names); got != want {
+			t.Errorf("suggest(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestTypeMissing(t *testing.T) {
+	for config, want := range map[string]string{
+		"input: {type: stdin}\ndecoder: [{level: 1}]\noutput: {type: stdout}\n": "decoder[0]: decoder: line 2: `type` is missing",
+		"input: {type: stdin}\noutput: {name: x}\n":                             "output: line 2: `type` is missing",
+	} {
+		_, err := NewPlan(strings.NewReader(config))
+		if err == nil || err.Error() != want {
+			t.Errorf("got %v, want %v", err, want)
+		}
+	}
+	var node yaml.Node
+	yaml.Unmarshal([]byte("{type: nope}"), &node)
+	if _, err := parseOutputList(opening{NewRegistry(), context.Background(), nil}, node.Content); err == nil ||
+		err.Error() != "child[0]: output 'nope' not found" {
+		t.Errorf("output list: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// encoder:
+//   - type: exec
+//     command: zstd           # looked up in PATH
+//     args: [-q, -c, -19]
+//     env: {ZSTD_NBTHREADS: "4"}
+//     dir: /tmp
+//     ok_status: [0]          # the exit statuses that are a success
+//
+// The bytes go to the stdin of the process and come back from its stdout,
+// for a decoder as for an encoder. The end of its stderr is in the errors.
+
+type ExecOptions struct {
+	Command  string            `yaml:"command" required:"true" arg:"1" desc:"executable, looked up in PATH"`
+	Args     []string          `yaml:"args" desc:"arguments"`
+	Env      map[string]string `yaml:"env" desc:"added to the environment"`
+	Dir      string            `yaml:"dir" desc:"working directory"`
+	OKStatus []int             `yaml:"ok_status" default:"[0]" desc:"exit statuses that are a success"`
+}
+
+func (opts *ExecOptions) Validate() error {
+	if len(opts.OKStatus) == 0 {
+		return errors.New("`ok_status` needs at least one status")
+	}
+	return nil
+}
+
+func (opts *ExecOptions) command() *exec.Cmd {
+	cmd := exec.Command(opts.Command, opts.Args...)
+	cmd.Dir = opts.Dir
+	if len(opts.Env) > 0 {
+		cmd.Env = os.Environ()
+		var keys []string
+		for k := range opts.Env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			cmd.Env = append(cmd.Env, k+"="+opts.Env[k])
+		}
+	}
+	return cmd
+}
+
+// tailBuffer keeps the last bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+const stderrTail = 1024
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.buf = append(tb.buf, p...)
+	if len(tb.buf) > stderrTail {
+		tb.buf = tb.buf[len(tb.buf)-stderrTail:]
+	}
+	return len(p), nil
+}
+
+func (tb *tailBuffer) String() string {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return strings.TrimSpace(string(tb.buf))
+}
+
+// process is the running command of a codec.
+type process struct {
+	cmd    *exec.Cmd
+	stderr tailBuffer
+	ok     []int
+}
+
+func startProcess(opts *ExecOptions) *process {
+	p := &process{cmd: opts.command(), ok: opts.OKStatus}
+	p.cmd.Stderr = &p.stderr
+	return p
+}
+
+func (p *process) error(err error) error {
+	if msg := p.stderr.String(); msg != "" {
+		return fmt.Errorf("%v: %w: %v", p.cmd.Path, err, msg)
+	}
+	return fmt.Errorf("%v: %w", p.cmd.Path, err)
+}
+
+// wait waits for the exit and checks the status.
+func (p *process) wait() error {
+	err := p.cmd.Wait()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		for _, status := range p.ok {
+			if ee.ExitCode() == status {
+				return nil
+			}
+		}
+	} else if err == nil {
+		for _, status := range p.ok {
+			if status == 0 {
+				return nil
+			}
+		}
+		err = errors.New("exit status 0")
+	}
+	return p.error(err)
+}
+
+// execWriter writes to the stdin of the process, a goroutine copies its
+// stdout to the next stage.
+type execWriter struct {
+	*process
+	stdin  io.WriteCloser
+	copied chan error
+	closed bool
+}
+
+func exec_encoder(opts *ExecOptions, w io.WriteCloser) (io.WriteCloser, error) {
+	p := startProcess(opts)
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.cmd.Start(); err != nil {
+		return nil, err
+	}
+	ew := &execWriter{process: p, stdin: stdin, copied: make(chan error, 1)}
+	go func() {
+		_, err := io.Copy(w, stdout)
+		if err != nil {
+			// don't block the process on a full pipe
+			io.Copy(io.Discard, stdout)
+		}
+		ew.copied <- err
+	}()
+	return ew, nil
+}
+
+func (ew *execWriter) Write(b []byte) (int, error) {
+	n, err := ew.stdin.Write(b)
+	if err != nil {
+		return n, ew.error(err)
+	}
+	return n, nil
+}
+
+// Close ends the stdin of the process, and waits for its output and its
+// exit.
+func (ew *execWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	ew.stdin.Close()
+	copyErr := <-ew.copied
+	return errors.Join(copyErr, ew.wait())
+}
+
+// execReader reads the stdout of the process, a goroutine copies the stage
+// before it to its stdin.
+type execReader struct {
+	*process
+	r       io.Reader // the stage before
+	stdin   io.WriteCloser
+	stdout  io.ReadCloser
+	fed     chan struct{} // closed once r is copied
+	feedErr error
+	err     error // set at the end of stdout
+	done    bool
+}
+
+func exec_decoder(opts *ExecOptions, r io.ReadCloser) (io.ReadCloser, error) {
+	p := startProcess(opts)
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.cmd.Start(); err != nil {
+		return nil, err
+	}
+	er := &execReader{process: p, r: r, stdin: stdin, stdout: stdout, fed: make(chan struct{})}
+	go func() {
+		_, err := io.Copy(stdin, r)
+		// set before the process sees the end of its input
+		er.feedErr = err
+		close(er.fed)
+		stdin.Close()
+	}()
+	return er, nil
+}
+
+func (er *execReader) Read(b []byte) (int, error) {
+	if er.done {
+		return 0, er.err
+	}
+	n, err := er.stdout.Read(b)
+	if err == io.EOF {
+		er.done = true
+		er.err = er.wait()
+		select {
+		case <-er.fed:
+			// the process may exit without reading everything
+			if er.feedErr != nil && er.err == nil && !errors.Is(er.feedErr, os.ErrClosed) &&
+				!errors.Is(er.feedErr, syscall.EPIPE) {
+				er.err = er.feedErr
+			}
+		default:
+		}
+		if er.err == nil {
+			er.err = io.EOF
+		}
+		return n, er.err
+	}
+	return n, err
+}
+
+// Close stops the process if it's still running, and waits for the
+// goroutine copying the stage before, which is closed next.
+func (er *execReader) Close() error {
+	if !er.done {
+		er.done = true
+		er.err = io.EOF
+		er.stdout.Close()
+		er.cmd.Process.Kill()
+		er.cmd.Wait()
+	}
+	select {
+	case <-er.fed:
+		return nil
+	default:
+	}
+	// the next write fails, a read blocked in the stage before ends at its
+	// deadline, a pump isn't closed by its Close. A read blocked further up
+	// ends at the deadline Stream.Close sets on the input.
+	er.stdin.Close()
+	r := er.r
+	if mr, ok := r.(*meteredReader); ok {
+		r = mr.ReadCloser
+	}
+	if pr, ok := r.(*pumpReader); ok {
+		pr.Close()
+	} else {
+		setReadDeadline(r, time.Now())
+	}
+	<-er.fed
+	return nil
+}
+
+func init() {
+	RegisterDecoder("exec", exec_decoder)
+	RegisterEncoder("exec", exec_encoder)
+	Describe(KindDecoder, "exec", "run a command, from its stdin to its stdout")
+	Describe(KindEncoder, "exec", "run a command, from its stdin to its stdout")
+}
@@ -0,0 +1,276 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func needCommands(t *testing.T, names ...string) {
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("no %v: %v", name, err)
+		}
+	}
+}
+
+func runStream(t *testing.T, config string) error {
+	s, err := NewStream(strings.NewReader(config))
+	if err != nil {
+		return err
+	}
+	_, err = s.Copy()
+	return errors.Join(err, s.Close())
+}
+
+func TestExecCodec(t *testing.T) {
+	needCommands(t, "gzip", "sh")
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := testData(1 << 18)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrent := range []bool{false, true} {
+		// gzip by the command, decoded by the package
+		err := runStream(t, fmt.Sprintf(`
+concurrent: %v
+input: {type: local, name: %v}
+encoder:
+  - {type: exec, command: gzip, args: [-c, "-${SC_EXEC_LEVEL:-9}"]}
+output: {type: local, name: %v/packed.gz}
+`, concurrent, src, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, _ := os.Open(filepath.Join(dir, "packed.gz"))
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(zr)
+		f.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("encoded by gzip: %v bytes, %v", len(got), err)
+		}
+
+		// and back by the command, with env and dir
+		err = runStream(t, fmt.Sprintf(`
+concurrent: %v
+input: {type: local, name: %v/packed.gz}
+decoder:
+  - type: exec
+    command: sh
+    args: [-c, 'test "$SC_MARK" = yes && test -f packed.gz && gzip -dc']
+    env: {SC_MARK: "yes"}
+    dir: %v
+output: {type: local, name: %v/unpacked}
+`, concurrent, dir, dir, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ = os.ReadFile(filepath.Join(dir, "unpacked")); !bytes.Equal(got, data) {
+			t.Errorf("decoded by gzip: %v bytes", len(got))
+		}
+	}
+}
+
+func TestExecStatus(t *testing.T) {
+	needCommands(t, "sh")
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, testData(1<<16), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		codec, want string
+	}{
+		{`{type: exec, command: sh, args: [-c, "cat; echo oops >&2; exit 3"]}`, "exit status 3: oops"},
+		{`{type: exec, command: sh, args: [-c, "cat; exit 3"], ok_status: [0, 3]}`, ""},
+		{`{type: exec, command: sh, args: [-c, "head -c 10; exit 1"], ok_status: [1]}`, ""},
+		{`{type: exec, command: /nope}`, "no such file"},
+	} {
+		for _, kind := range []string{"decoder", "encoder"} {
+			err := runStream(t, fmt.Sprintf("input: {type: local, name: %v}\n%v: [%v]\noutput: {type: local, name: %v/dst}\n",
+				src, kind, c.codec, dir))
+			if (c.want == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), c.want)) {
+				t.Errorf("%v %v: got %v, want %v", kind, c.codec, err, c.want)
+			}
+		}
+	}
+
+	if _, err := NewPlan(strings.NewReader("input: {type: stdin}\nencoder: [{type: exec, command: x, ok_status: []}]\noutput: {type: stdout}\n")); err == nil {
+		t.Errorf("an empty ok_status")
+	}
+}
+
+// slowReader reads slowly and records the reads after its Close
+type slowReader struct {
+	closed, lateRead atomic.Bool
+}
+
+func (sr *slowReader) Read(b []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	if sr.closed.Load() {
+		sr.lateRead.Store(true)
+		return 0, os.ErrClosed
+	}
+	return len(b), nil
+}
+
+func (sr *slowReader) Close() error {
+	sr.closed.Store(true)
+	return nil
+}
+
+// its reads end on their own, it isn't read in a goroutine
+func (sr *slowReader) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func TestExecClose(t *testing.T) {
+	needCommands(t, "sh", "head")
+	input := &slowReader{}
+	reg := DefaultRegistry.Clone()
+	reg.RegisterInputStream("slow", func(node *yaml.Node) (io.ReadCloser, error) {
+		return input, nil
+	})
+	// the process exits before its input ends
+	s, err := reg.NewStream(strings.NewReader(fmt.Sprintf(`
+input: {type: slow}
+decoder: [{type: exec, command: sh, args: [-c, "head -c 10"]}]
+output: {type: local, name: %v/dst}
+`, t.TempDir())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Copy(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	time.Sleep(50 * time.Millisecond)
+	if input.lateRead.Load() {
+		t.Errorf("the input was read after its Close")
+	}
+}
+
+func TestExecCloseIdle(t *testing.T) {
+	needCommands(t, "sh", "head")
+	idle := make(chan struct{})
+	defer close(idle)
+	// serves 16 bytes, plain or gzipped, then nothing
+	serve := func(gzipped bool) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				if gzipped {
+					zw := gzip.NewWriter(conn)
+					zw.Write(testData(16))
+					zw.Flush()
+				} else {
+					conn.Write(testData(16))
+				}
+				go func() {
+					<-idle
+					conn.Close()
+				}()
+			}
+		}()
+		return ln.Addr().String()
+	}
+	plain, gzipped := serve(false), serve(true)
+
+	for _, concurrent := range []bool{false, true} {
+		for _, c := range []struct{ addr, decoders string }{
+			{plain, ""},
+			{gzipped, "{type: gzip}, "},
+		} {
+			s, err := NewStream(strings.NewReader(fmt.Sprintf(`
+concurrent: %v
+input: tcp://%v
+decoder: [%v{type: exec, command: sh, args: [-c, "head -c 10"]}]
+output: {type: local, name: %v/dst}
+`, concurrent, c.addr, c.decoders, t.TempDir())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the process exits, the feeder waits for the idle input
+			if _, err = s.Copy(); err != nil {
+				t.Fatal(err)
+			}
+			closed := make(chan error, 1)
+			go func() {
+				closed <- s.Close()
+			}()
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("concurrent=%v %v: Close hangs", concurrent, c.decoders)
+			}
+		}
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	needCommands(t, "sh", "tr")
+	dir := writeFiles(t, map[string]string{
+		"upper.yaml": `
+name: upper
+description: upper case
+decoder: {command: tr, args: [a-z, A-Z]}
+encoder: {command: ./upper.sh}
+`,
+		"upper.sh":   "#!/bin/sh\ntr -d \"$1\" | tr a-z A-Z\n",
+		"bad.json":   `{"name": "bad", "decoder": {"comand": "x"}}`,
+		"README.txt": "not a manifest",
+	})
+	os.Chmod(filepath.Join(dir, "upper.sh"), 0700)
+
+	reg := DefaultRegistry.Clone()
+	names, err := reg.LoadPlugins(dir)
+	if len(names) != 1 || names[0] != "upper" {
+		t.Errorf("plugins: %v", names)
+	}
+	if err == nil || !strings.Contains(err.Error(), "bad.json: decoder: line 1, column 29: `comand`: unknown option") {
+		t.Errorf("bad manifest: %v", err)
+	}
+	if info, ok := reg.LookupType(KindEncoder, "upper"); !ok || info.Description != "upper case" || len(info.Options) != 2 {
+		t.Errorf("upper: %+v", info)
+	}
+	if _, err = reg.LoadPlugins(dir); !errors.Is(err, ErrDuplicateType) {
+		t.Errorf("loaded twice: %v", err)
+	}
+
+	var out bytes.Buffer
+	s, err := reg.From(io.NopCloser(strings.NewReader("hello"))).
+		Encode("upper", map[string]any{"args": []string{"l"}}).
+		To(&nopWriteCloser{&out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Copy()
+	if err = errors.Join(err, s.Close()); err != nil || out.String() != "HEO" {
+		t.Errorf("got %q, %v", out.String(), err)
+	}
+}
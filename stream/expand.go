@@ -0,0 +1,230 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The option values of a stage are expanded before it's checked or opened:
+//
+// input:
+//   type: local
+//   name: ${DATA_DIR:-${HOME}/sc}/in.dat   # $$ is a literal $
+// output:
+//   type: tcp
+//   port: ${SC_PORT}                       # empty if unset
+//   token: {file: /run/secrets/sc_token}   # trailing newline removed
+//   # or token: {env: SC_TOKEN}, an error if unset
+//
+// The values read by a {file: } or {env: } reference and the options of a
+// type tagged `secret:"true"` are secrets: Redact hides them in the errors
+// and in the logs, if they have 4 bytes or more. A process that loads configs
+// over and over, like the daemon, keeps the maxSecrets last ones seen.
+
+const redacted = "******"
+
+var secrets = struct {
+	sync.RWMutex
+	seen   []string // the last seen last
+	values []string // longest first
+}{}
+
+// the shorter secrets would hide the same letters of every message
+const minSecretLen = 4
+
+const maxSecrets = 1024
+
+// addSecret makes Redact hide v. Past maxSecrets, the secret seen the
+// longest ago is forgotten.
+func addSecret(v string) {
+	if len(v) < minSecretLen {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for i, s := range secrets.seen {
+		if s == v {
+			// seen again, forgotten last
+			copy(secrets.seen[i:], secrets.seen[i+1:])
+			secrets.seen[len(secrets.seen)-1] = v
+			return
+		}
+	}
+	secrets.seen = append(secrets.seen, v)
+	if len(secrets.seen) > maxSecrets {
+		secrets.seen = append(secrets.seen[:0:0], secrets.seen[1:]...)
+	}
+	secrets.values = append(secrets.values[:0], secrets.seen...)
+	sort.Slice(secrets.values, func(i, j int) bool {
+		return len(secrets.values[i]) > len(secrets.values[j])
+	})
+}
+
+// Redact replaces the secrets of the configs loaded so far in s.
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, v := range secrets.values {
+		s = strings.ReplaceAll(s, v, redacted)
+	}
+	return s
+}
+
+// RedactWriter is for log.SetOutput, it writes p to w with Redact.
+type RedactWriter struct {
+	W io.Writer
+}
+
+func (rw RedactWriter) Write(p []byte) (int, error) {
+	if _, err := rw.W.Write([]byte(Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// closingBrace returns the index of the } that closes s[0], the ${ } in
+// between nest.
+func closingBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '{':
+			depth++
+		case s[i] == '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// expandString replaces ${VAR} and ${VAR:-default} with the environment.
+func expandString(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i+1 == len(s) {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		s = s[i+1:]
+		switch s[0] {
+		case '$':
+			b.WriteByte('$')
+			s = s[1:]
+			continue
+		case '{':
+		default:
+			b.WriteByte('$')
+			continue
+		}
+		end := closingBrace(s)
+		if end < 0 {
+			return "", fmt.Errorf("unclosed ${ in %q", "$"+s)
+		}
+		name, def, hasDef := strings.Cut(s[1:end], ":-")
+		if name == "" {
+			return "", errors.New("empty variable name in ${}")
+		}
+		v, ok := os.LookupEnv(name)
+		if (!ok || v == "") && hasDef {
+			// the default may hold variables too
+			var err error
+			if v, err = expandString(def); err != nil {
+				return "", err
+			}
+		}
+		b.WriteString(v)
+		s = s[end+1:]
+	}
+}
+
+// reference reads a {file: path} or {env: NAME} value.
+func reference(node *yaml.Node) (string, bool, error) {
+	if node.Kind != yaml.MappingNode || len(node.Content) != 2 ||
+		node.Content[1].Kind != yaml.ScalarNode {
+		return "", false, nil
+	}
+	arg := node.Content[1].Value
+	switch node.Content[0].Value {
+	case "file":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return "", true, err
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", true, fmt.Errorf("environment variable %v is not set", arg)
+		}
+		return v, true, nil
+	}
+	return "", false, nil
+}
+
+// expandValue expands a value of a stage in place.
+func expandValue(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "$") {
+			return nil
+		}
+		v, err := expandString(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %v, column %v: %w", node.Line, node.Column, err)
+		}
+		node.Value = v
+		// a number or a boolean once expanded
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+	case yaml.MappingNode:
+		v, ok, err := reference(node)
+		if err != nil {
+			return fmt.Errorf("line %v, column %v: `%v`: %w", node.Line, node.Column, node.Content[0].Value, err)
+		}
+		if ok {
+			addSecret(v)
+			*node = yaml.Node{Kind: yaml.ScalarNode, Style: yaml.DoubleQuotedStyle, Tag: "!!str",
+				Value: v, Line: node.Line, Column: node.Column}
+			return nil
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := expandValue(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, n := range node.Content {
+			if err := expandValue(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandStage expands the options of a stage but not its children, they
+// are stages of their own.
+func expandStage(node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		if key == "type" || key == "child" {
+			continue
+		}
+		if err := expandValue(node.Content[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestExpandString(t *testing.T) {
+	t.Setenv("SC_A", "a")
+	t.Setenv("SC_EMPTY", "")
+	for in, want := range map[string]string{
+		"${SC_A}/x":               "a/x",
+		"${SC_UNSET}":             "",
+		"${SC_UNSET:-def}":        "def",
+		"${SC_EMPTY:-def}":        "def",
+		"${SC_A:-def}${SC_A}":     "aa",
+		"$$HOME $${SC_A} $5 end$": "$HOME ${SC_A} $5 end$",
+	} {
+		if got, err := expandString(in); err != nil || got != want {
+			t.Errorf("%q: got %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"${SC_A", "${}", "${:-x}"} {
+		if _, err := expandString(in); err == nil {
+			t.Errorf("%q should fail", in)
+		}
+	}
+}
+
+func TestExpandConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "src"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("s3cr3t-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SC_DIR", dir)
+	t.Setenv("SC_LEVEL", "9")
+	t.Setenv("SC_TOKEN", "s3cr3t-from-env")
+
+	plan, err := NewPlan(strings.NewReader(`
+input:
+  type: local
+  name: ${SC_DIR}/src
+encoder:
+  - type: gzip
+    level: ${SC_LEVEL}
+output: {type: local, name: "${SC_OUT:-${SC_DIR}/dst}"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := decodeOptions[LevelOptions](KindEncoder, plan.Encoders[0].node)
+	if err != nil || opts.Level != 9 {
+		t.Errorf("level: %+v, %v", opts, err)
+	}
+	if name := plan.Output.node.Content[3].Value; name != dir+"/dst" {
+		t.Errorf("output name: %v", name)
+	}
+
+	// the references are secrets
+	plan, err = NewPlan(strings.NewReader(`
+input: {type: tcp, port: 1, token: {file: ` + secret + `}}
+output: {type: tcp, port: 1, token: {env: SC_TOKEN}}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := decodeOptions[tcp_config](KindInput, plan.Input.node)
+	if cfg.Token != "s3cr3t-from-file" {
+		t.Errorf("token: %q", cfg.Token)
+	}
+	msg := Redact("token s3cr3t-from-file or s3cr3t-from-env")
+	if msg != "token ****** or ******" {
+		t.Errorf("redact: %v", msg)
+	}
+
+	var buf bytes.Buffer
+	logger := log.New(RedactWriter{W: &buf}, "", 0)
+	logger.Print("tried s3cr3t-from-env")
+	if buf.String() != "tried ******\n" {
+		t.Errorf("log: %q", buf.String())
+	}
+
+	// a secret is hidden in the errors about it
+	t.Setenv("SC_ORDER", "hunter22-order")
+	_, err = NewPlan(strings.NewReader(`
+input: {type: stdin}
+decoder: [{type: lzw, order: {env: SC_ORDER}}]
+output: {type: stdout}
+`))
+	if err == nil || strings.Contains(err.Error(), "hunter22") || !strings.Contains(err.Error(), "******") {
+		t.Errorf("got %v", err)
+	}
+
+	for config, want := range map[string]string{
+		"input: {type: tcp, port: 1, token: {env: SC_NOPE}}\noutput: {type: stdout}\n": "line 1, column 36: `env`: environment variable SC_NOPE is not set",
+		"input: {type: tcp, port: 1, token: {file: /nope}}\noutput: {type: stdout}\n":  "`file`: open /nope",
+		"input: {type: local, name: ${SC_X}\noutput: {type: stdout}\n":                 "",
+	} {
+		_, err := NewPlan(strings.NewReader(config))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %v", config, err, want)
+		}
+	}
+}
+
+func TestSecretsBounded(t *testing.T) {
+	secrets.Lock()
+	saved := secrets.seen
+	secrets.seen, secrets.values = nil, nil
+	secrets.Unlock()
+	defer func() {
+		secrets.Lock()
+		secrets.seen, secrets.values = saved, append([]string(nil), saved...)
+		sort.Slice(secrets.values, func(i, j int) bool {
+			return len(secrets.values[i]) > len(secrets.values[j])
+		})
+		secrets.Unlock()
+	}()
+
+	// a reload adds the same secrets again
+	for i := 0; i < 3; i++ {
+		addSecret("first-secret")
+	}
+	for i := 0; i < maxSecrets; i++ {
+		addSecret(fmt.Sprintf("rotated-%04d", i))
+		if i == maxSecrets/2 {
+			addSecret("first-secret")
+		}
+	}
+	if n := len(secrets.values); n != maxSecrets {
+		t.Errorf("%v secrets, want %v", n, maxSecrets)
+	}
+	if msg := Redact("first-secret rotated-0000 rotated-0001"); msg != "****** rotated-0000 ******" {
+		t.Errorf("redact: %v", msg)
+	}
+}
@@ -3,23 +3,25 @@ package stream
 import (
 	"compress/flate"
 	"io"
-
-	"gopkg.in/yaml.v3"
 )
 
-// support options: level, dict
+// LevelOptions are the options of the deflate based encoders: flate, gzip
+// and zlib. -1 is the default compression, -2 huffman only.
+type LevelOptions struct {
+	Level int `yaml:"level" default:"-1" min:"-2" max:"9" desc:"compression level, -1 default, -2 huffman only"`
+}
 
-func flate_decoder(node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error) {
-	check_type(node, "flate")
+func flate_decoder(opts *NoOptions, r io.ReadCloser) (io.ReadCloser, error) {
 	return flate.NewReader(r), nil
 }
 
-func flate_encoder(node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error) {
-	check_type(node, "flate")
-	return flate.NewWriter(w, flate.DefaultCompression)
+func flate_encoder(opts *LevelOptions, w io.WriteCloser) (io.WriteCloser, error) {
+	return flate.NewWriter(w, opts.Level)
 }
 
 func init() {
-	RegisterDecoderStream("flate", flate_decoder)
-	RegisterEncoderStream("flate", flate_encoder)
+	RegisterDecoder("flate", flate_decoder)
+	RegisterEncoder("flate", flate_encoder)
+	Describe(KindDecoder, "flate", "raw deflate (RFC 1951)")
+	Describe(KindEncoder, "flate", "raw deflate (RFC 1951)")
 }
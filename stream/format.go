@@ -0,0 +1,132 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// A config is YAML, JSON or TOML, the format of a file is picked from its
+// extension (.json, .toml, YAML for the others), the one of a reader with
+// WithFormat. The same keys make the same stream:
+//
+//	[input]
+//	type = "local"
+//	name = "/var/log/app.log"
+//
+//	[[encoder]]
+//	type = "gzip"
+//	level = 9
+//
+//	[output]
+//	type = "stdout"
+//
+// The positions in the errors about a TOML config are lost.
+
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+// FormatOf returns the format of a config file from its name.
+func FormatOf(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatYAML
+}
+
+type formatReader struct {
+	io.Reader
+	format string
+}
+
+// Name is the name of the file the reader reads, for the includes.
+func (fr *formatReader) Name() string {
+	if f, ok := fr.Reader.(interface{ Name() string }); ok {
+		return f.Name()
+	}
+	return ""
+}
+
+// WithFormat makes NewPlan, LoadGraph and LoadBatch read r as a config of
+// format, whatever the name of the file.
+func WithFormat(r io.Reader, format string) io.Reader {
+	return &formatReader{Reader: r, format: format}
+}
+
+// formatOf returns the format of the config read by r.
+func formatOf(r io.Reader) string {
+	if fr, ok := r.(*formatReader); ok && fr.format != "" {
+		return fr.format
+	}
+	if f, ok := r.(interface{ Name() string }); ok {
+		return FormatOf(f.Name())
+	}
+	return FormatYAML
+}
+
+// jsonError adds the line and the column to a syntax error.
+func jsonError(data []byte, err error) error {
+	var se *json.SyntaxError
+	if !errors.As(err, &se) {
+		return fmt.Errorf("json: %w", err)
+	}
+	before := data[:se.Offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(se.Offset) - bytes.LastIndexByte(before, '\n') - 1
+	return fmt.Errorf("json: line %v, column %v: %w", line, column, err)
+}
+
+// decodeDocument decodes a config into the nodes of a YAML document.
+func decodeDocument(r io.Reader, format string) (*yaml.Node, error) {
+	var doc yaml.Node
+	switch format {
+	case FormatYAML, "yml":
+		// a file without a document is empty, not an EOF
+		if err := yaml.NewDecoder(r).Decode(&doc); err != nil && err != io.EOF {
+			return nil, err
+		}
+	case FormatJSON:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		var v any
+		if err = json.Unmarshal(data, &v); err != nil {
+			return nil, jsonError(data, err)
+		}
+		// JSON is YAML, parsed again for the positions
+		if err = yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		var v map[string]any
+		if _, err := toml.NewDecoder(r).Decode(&v); err != nil {
+			return nil, err
+		}
+		var root yaml.Node
+		if err := root.Encode(v); err != nil {
+			return nil, err
+		}
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{&root}}
+	default:
+		return nil, fmt.Errorf("unknown config format '%v', should be one of %v, %v, %v",
+			format, FormatYAML, FormatJSON, FormatTOML)
+	}
+	if len(doc.Content) == 0 {
+		return nil, errors.New("empty config")
+	}
+	return doc.Content[0], nil
+}
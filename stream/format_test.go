@@ -0,0 +1,143 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormats(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"s.yaml": `
+input: {type: local, name: src}
+encoder:
+  - {type: zlib}
+  - {type: gzip, level: 9}
+output: {type: tcp, port: "9000", token: t}
+`,
+		"s.json": `{
+  "input": {"type": "local", "name": "src"},
+  "encoder": [{"type": "zlib"}, {"type": "gzip", "level": 9}],
+  "output": {"type": "tcp", "port": "9000", "token": "t"}
+}`,
+		"s.toml": `
+[input]
+type = "local"
+name = "src"
+
+[[encoder]]
+type = "zlib"
+
+[[encoder]]
+type = "gzip"
+level = 9
+
+[output]
+type = "tcp"
+port = "9000"
+token = "t"
+`,
+	})
+	for _, name := range []string{"s.yaml", "s.json", "s.toml"} {
+		plan, err := loadPlan(t, filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if plan.Input.Type != "local" || plan.Output.Type != "tcp" || stageTypes(plan.Encoders) != "zlib,gzip" {
+			t.Errorf("%v: %+v", name, plan)
+		}
+		level, err := decodeOptions[LevelOptions](KindEncoder, plan.Encoders[1].node)
+		if err != nil || level.Level != 9 {
+			t.Errorf("%v: level %+v, %v", name, level, err)
+		}
+	}
+
+	// the format of a reader
+	data, _ := os.ReadFile(filepath.Join(dir, "s.toml"))
+	if _, err := NewPlan(WithFormat(strings.NewReader(string(data)), FormatTOML)); err != nil {
+		t.Errorf("toml reader: %v", err)
+	}
+	for _, c := range []struct {
+		config, format, want string
+	}{
+		{"{\n  \"input\": {\"type\": \"stdin\"},\n  \"output\": {\"type\": \"stdout\",}\n}", FormatJSON,
+			"json: line 3, column 31: invalid character '}'"},
+		{"[input]\ntype = stdin\n", FormatTOML, "toml: line 2"},
+		{"{\"input\": {\"type\": \"stdin\"},\n \"output\": {\"type\": \"stdout\", \"nme\": 1}}", FormatJSON,
+			"line 2, column 31: `nme`: unknown option"},
+		{"input = {type = \"stdin\"}\noutput = {type = \"local\", nme = \"x\"}\n", FormatTOML,
+			"output 'local': `nme`: unknown option"},
+		{"input: {type: stdin}", "xml", "unknown config format 'xml'"},
+		{"", FormatYAML, "empty config"},
+		{"# nothing yet\n", FormatYAML, "empty config"},
+	} {
+		_, err := NewPlan(WithFormat(strings.NewReader(c.config), c.format))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: got %v, want %v", c.format, err, c.want)
+		}
+	}
+}
+
+func TestIncludeFormats(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"profiles.toml": "[[profiles.archive]]\ntype = \"zlib\"\n\n[[profiles.archive]]\ntype = \"gzip\"\n",
+		"main.json":     `{"include": "profiles.toml", "input": {"type": "stdin"}, "encoder": [{"use": "archive"}], "output": {"type": "stdout"}}`,
+	})
+	plan, err := loadPlan(t, filepath.Join(dir, "main.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stageTypes(plan.Encoders); got != "zlib,gzip" {
+		t.Errorf("encoders: %v", got)
+	}
+}
+
+func TestOptionsInterface(t *testing.T) {
+	type limit struct {
+		Size int    `yaml:"size"`
+		Name string `yaml:"name"`
+	}
+	var got limit
+	var keys []string
+	RegisterInputOptions("limited", func(opts Options) (io.ReadCloser, error) {
+		keys = opts.Keys()
+		if err := opts.Decode(&got); err != nil {
+			return nil, err
+		}
+		var size int
+		if ok, err := opts.Get("size", &size); !ok || err != nil {
+			return nil, errors.Join(errors.New("no size"), err)
+		}
+		if ok, _ := opts.Get("nope", &size); ok {
+			return nil, errors.New("nope is not set")
+		}
+		return io.NopCloser(io.LimitReader(strings.NewReader("hello"), int64(size))), nil
+	})
+	defer DefaultRegistry.Unregister(KindInput, "limited")
+
+	for _, format := range []string{FormatJSON, FormatTOML} {
+		config := `{"input": {"type": "limited", "size": 3, "name": "n"}, "output": {"type": "stdout"}}`
+		if format == FormatTOML {
+			config = "input = {type = \"limited\", size = 3, name = \"n\"}\noutput = {type = \"stdout\"}\n"
+		}
+		s, err := NewStream(WithFormat(strings.NewReader(config), format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(s.Reader())
+		if string(b) != "hel" || got.Size != 3 || got.Name != "n" || len(keys) != 2 {
+			t.Errorf("%v: read %q, options %+v, keys %v", format, b, got, keys)
+		}
+		s.input.Close()
+	}
+
+	_, err := NewStream(strings.NewReader("input: {type: limited, size: big}\noutput: {type: stdout}\n"))
+	var oe *OptionError
+	if !errors.As(err, &oe) || oe.Line != 1 {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,547 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// GRAPH syntax:
+// graph:
+//   - id: src
+//     input:
+//       type: local
+//       name: /tmp/a.gz
+//   - id: plain
+//     decoder:
+//       type: gzip
+//     from: src
+//   - id: raw
+//     output:
+//       type: local
+//       name: /tmp/a
+//     from: plain
+//   - id: packed
+//     encoder:
+//       type: zlib
+//     from: plain
+//   - id: copy
+//     output:
+//       type: tcp
+//       ...
+//     from: [packed]
+//
+// Every node holds one of input/decoder/encoder/output and reads the nodes
+// listed in `from`. A node read by several nodes is copied to each of them,
+// a node reading several nodes concatenates them in order (like cat).
+// Branches that fork from a node may not merge again: the merge would read
+// one branch to the end while the fork waits for the other one.
+
+type graphNode struct {
+	id    string
+	kind  Kind
+	stage *Stage
+	from  []string
+	to    []*graphNode
+	line  int
+}
+
+func (n *graphNode) String() string {
+	return fmt.Sprintf("%v '%v' (line %v)", n.kind, n.id, n.line)
+}
+
+type Graph struct {
+	nodes []*graphNode // topological order
+	byID  map[string]*graphNode
+	reg   *Registry
+}
+
+func LoadGraph(r io.Reader) (*Graph, error) {
+	return DefaultRegistry.LoadGraph(r)
+}
+
+// LoadGraph is LoadGraph with the types of the registry.
+func (reg *Registry) LoadGraph(r io.Reader) (*Graph, error) {
+	node, src, err := loadDocument(r)
+	if err != nil {
+		return nil, err
+	}
+	return reg.newGraph(node, src)
+}
+
+func isGraph(node *yaml.Node) bool {
+	return getChildByTag(node, "graph") >= 0
+}
+
+func (reg *Registry) parseGraphNode(node *yaml.Node, src sources) (*graphNode, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %v: graph node needs a map", node.Line)
+	}
+	gn := &graphNode{line: node.Line}
+	var conf *yaml.Node // map of the stage
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		switch key.Value {
+		case "id":
+			gn.id = value.Value
+		case "from":
+			switch value.Kind {
+			case yaml.ScalarNode:
+				gn.from = []string{value.Value}
+			case yaml.SequenceNode:
+				if err := value.Decode(&gn.from); err != nil {
+					return nil, fmt.Errorf("line %v: invalid 'from': %w", value.Line, err)
+				}
+			default:
+				return nil, fmt.Errorf("line %v: invalid 'from', needs an id or a list", value.Line)
+			}
+		case string(KindInput), string(KindDecoder), string(KindEncoder), string(KindOutput):
+			if gn.kind != "" {
+				return nil, fmt.Errorf("line %v: node has both %v and %v", key.Line, gn.kind, key.Value)
+			}
+			gn.kind, conf = Kind(key.Value), value
+		default:
+			return nil, fmt.Errorf("line %v: unknown key in graph node: %v", key.Line, key.Value)
+		}
+	}
+	if gn.id == "" {
+		return nil, fmt.Errorf("line %v: `id` is missing", node.Line)
+	}
+	if gn.kind == "" {
+		return nil, fmt.Errorf("line %v: node '%v' needs one of input/decoder/encoder/output", node.Line, gn.id)
+	}
+	stage, err := reg.planStage(gn.kind, conf, src)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", gn, err)
+	}
+	gn.stage = stage
+	return gn, nil
+}
+
+func (reg *Registry) newGraph(node *yaml.Node, src sources) (*Graph, error) {
+	list := getList(node, "graph")
+	if len(list) == 0 {
+		return nil, fmt.Errorf("invalid 'graph', needs a non-empty list")
+	}
+	g := &Graph{byID: make(map[string]*graphNode), reg: reg}
+	var nodes []*graphNode
+	for _, n := range list {
+		gn, err := reg.parseGraphNode(n, src)
+		if err != nil {
+			return nil, err
+		}
+		if prev, ok := g.byID[gn.id]; ok {
+			return nil, fmt.Errorf("%v: duplicated id, first defined at line %v", gn, prev.line)
+		}
+		g.byID[gn.id] = gn
+		nodes = append(nodes, gn)
+	}
+
+	// edges
+	for _, gn := range nodes {
+		if gn.kind == KindInput && len(gn.from) > 0 {
+			return nil, fmt.Errorf("%v: an input can't read from other nodes", gn)
+		}
+		if gn.kind != KindInput && len(gn.from) == 0 {
+			return nil, fmt.Errorf("%v: `from` is missing", gn)
+		}
+		for _, id := range gn.from {
+			up, ok := g.byID[id]
+			if !ok {
+				return nil, fmt.Errorf("%v: reads unknown node '%v'", gn, id)
+			}
+			if up.kind == KindOutput {
+				return nil, fmt.Errorf("%v: can't read from %v", gn, up)
+			}
+			up.to = append(up.to, gn)
+		}
+	}
+	for _, gn := range nodes {
+		if gn.kind != KindOutput && len(gn.to) == 0 {
+			return nil, fmt.Errorf("%v: not read by any node", gn)
+		}
+	}
+
+	if err := g.sort(nodes); err != nil {
+		return nil, err
+	}
+	if err := g.checkMerges(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// sort orders the nodes so that every node comes after the nodes it reads,
+// and reports the first cycle found.
+func (g *Graph) sort(nodes []*graphNode) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*graphNode]int)
+	var path []string
+	var visit func(gn *graphNode) error
+	visit = func(gn *graphNode) error {
+		switch state[gn] {
+		case visited:
+			return nil
+		case visiting:
+			i := 0
+			for path[i] != gn.id {
+				i++
+			}
+			cycle := append(path[i:], gn.id)
+			return fmt.Errorf("graph has a cycle: %v", strings.Join(cycle, " -> "))
+		}
+		state[gn] = visiting
+		path = append(path, gn.id)
+		for _, id := range gn.from {
+			if err := visit(g.byID[id]); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[gn] = visited
+		g.nodes = append(g.nodes, gn)
+		return nil
+	}
+	for _, gn := range nodes {
+		if err := visit(gn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMerges rejects nodes that read several branches of the same fork.
+func (g *Graph) checkMerges() error {
+	ancestors := make(map[string]map[string]bool)
+	for _, gn := range g.nodes {
+		anc := make(map[string]bool)
+		for i, id := range gn.from {
+			branch := map[string]bool{id: true}
+			for a := range ancestors[id] {
+				branch[a] = true
+			}
+			for a := range branch {
+				if anc[a] {
+					return fmt.Errorf("%v: merges branches forked from '%v' at from[%v]", gn, a, i)
+				}
+			}
+			for a := range branch {
+				anc[a] = true
+			}
+		}
+		ancestors[gn.id] = anc
+	}
+	return nil
+}
+
+// lazyReader opens a decoder on the first Read, so that decoders reading
+// their header don't block before the graph starts running.
+type lazyReader struct {
+	open func() (io.ReadCloser, error)
+	rc   io.ReadCloser
+	err  error
+}
+
+func (lr *lazyReader) Read(b []byte) (int, error) {
+	if lr.rc == nil && lr.err == nil {
+		lr.rc, lr.err = lr.open()
+	}
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	return lr.rc.Read(b)
+}
+
+func (lr *lazyReader) Close() error {
+	if lr.rc != nil {
+		return lr.rc.Close()
+	}
+	return nil
+}
+
+// pipeReadCloser and pipeWriteCloser are the two ends of a bufferPipe
+type pipeReadCloser struct {
+	*bufferPipe
+}
+
+func (pr pipeReadCloser) Close() error {
+	pr.CloseRead(nil)
+	return nil
+}
+
+type pipeWriteCloser struct {
+	*bufferPipe
+}
+
+func (pw pipeWriteCloser) Close() error {
+	pw.CloseWrite(nil)
+	return nil
+}
+
+type graphRun struct {
+	reg     *Registry
+	readers map[string][]io.Reader // per node, one per reading node
+	pipes   []*bufferPipe
+	inputs  []io.ReadCloser
+	outputs []io.WriteCloser
+	closers []io.Closer // inputs and decoders, closed after the run
+	opened  []io.Closer // every stage, in the order of opening
+	tasks   []func() error
+
+	mu    sync.Mutex
+	err   error // first error
+	bytes int64 // written to the outputs
+
+	stopped int32 // atomic, see drain
+}
+
+func (gr *graphRun) newPipe() *bufferPipe {
+	p := newBufferPipe(bufferConfig{})
+	gr.pipes = append(gr.pipes, p)
+	return p
+}
+
+func (gr *graphRun) take(id string) io.Reader {
+	r := gr.readers[id][0]
+	gr.readers[id] = gr.readers[id][1:]
+	return r
+}
+
+func (gr *graphRun) upstream(gn *graphNode) io.Reader {
+	if len(gn.from) == 1 {
+		return gr.take(gn.from[0])
+	}
+	cr := &catReader{}
+	for _, id := range gn.from {
+		cr.child = append(cr.child, io.NopCloser(gr.take(id)))
+	}
+	return cr
+}
+
+// fail records the first error and unblocks every stage.
+func (gr *graphRun) fail(err error) {
+	gr.mu.Lock()
+	first := gr.err == nil
+	if first {
+		gr.err = err
+	}
+	gr.mu.Unlock()
+	if !first {
+		return
+	}
+	past := time.Unix(1, 0)
+	for _, r := range gr.inputs {
+		setReadDeadline(r, past)
+	}
+	for _, w := range gr.outputs {
+		setWriteDeadline(w, past)
+	}
+	for _, p := range gr.pipes {
+		p.CloseRead(err)
+	}
+}
+
+// drain stops reading the inputs, the stages flush what they read and close
+// as at the end of the inputs.
+func (gr *graphRun) drain() {
+	atomic.StoreInt32(&gr.stopped, 1)
+	for _, r := range gr.inputs {
+		setReadDeadline(r, time.Unix(1, 0))
+	}
+}
+
+// drainedReader is the read side of a task, it ends at the first error
+// once the graph stopped reading: the error comes from the stop, a stopped
+// input, a deadline or a decoder cut short.
+type drainedReader struct {
+	io.Reader
+	stopped *int32
+}
+
+func (dr drainedReader) Read(b []byte) (int, error) {
+	n, err := dr.Reader.Read(b)
+	if err != nil && atomic.LoadInt32(dr.stopped) != 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (gr *graphRun) open(ctx context.Context, gn *graphNode) (io.Reader, error) {
+	switch gn.kind {
+	case KindInput:
+		r, err := gr.reg.openInput(ctx, gn.stage.Type, gn.stage.node, nil)
+		if err != nil {
+			return nil, err
+		}
+		r = withDeadline(r)
+		gr.inputs = append(gr.inputs, r)
+		gr.closers = append(gr.closers, r)
+		gr.opened = append(gr.opened, r)
+		return stoppableReader{Reader: r, stopped: &gr.stopped}, nil
+
+	case KindDecoder:
+		up := io.NopCloser(gr.upstream(gn))
+		dec, _ := gr.reg.decoder(gn.stage.Type)
+		lr := &lazyReader{open: func() (io.ReadCloser, error) {
+			return dec(gn.stage.node, up)
+		}}
+		gr.closers = append(gr.closers, lr)
+		gr.opened = append(gr.opened, lr)
+		return lr, nil
+
+	case KindEncoder:
+		up := drainedReader{gr.upstream(gn), &gr.stopped}
+		p := gr.newPipe()
+		enc, _ := gr.reg.encoder(gn.stage.Type)
+		w, err := enc(gn.stage.node, pipeWriteCloser{p})
+		if err != nil {
+			return nil, err
+		}
+		gr.opened = append(gr.opened, w)
+		gr.tasks = append(gr.tasks, func() error {
+			_, err := io.Copy(w, up)
+			if e := w.Close(); err == nil {
+				err = e
+			}
+			p.CloseWrite(err)
+			return err
+		})
+		return pipeReadCloser{p}, nil
+
+	default: // KindOutput
+		up := drainedReader{gr.upstream(gn), &gr.stopped}
+		w, err := gr.reg.openOutput(ctx, gn.stage.Type, gn.stage.node, nil)
+		if err != nil {
+			return nil, err
+		}
+		gr.outputs = append(gr.outputs, w)
+		gr.opened = append(gr.opened, w)
+		gr.tasks = append(gr.tasks, func() error {
+			n, err := io.Copy(w, up)
+			gr.mu.Lock()
+			gr.bytes += n
+			gr.mu.Unlock()
+			if e := w.Close(); err == nil {
+				err = e
+			}
+			return err
+		})
+		return nil, nil
+	}
+}
+
+// fork copies r to a new pipe for every node reading gn.
+func (gr *graphRun) fork(gn *graphNode, r io.Reader) {
+	if len(gn.to) == 1 {
+		gr.readers[gn.id] = []io.Reader{r}
+		return
+	}
+	var pipes []io.Writer
+	for range gn.to {
+		p := gr.newPipe()
+		pipes = append(pipes, p)
+		gr.readers[gn.id] = append(gr.readers[gn.id], pipeReadCloser{p})
+	}
+	gr.tasks = append(gr.tasks, func() error {
+		_, err := io.Copy(io.MultiWriter(pipes...), drainedReader{r, &gr.stopped})
+		for _, p := range pipes {
+			p.(*bufferPipe).CloseWrite(err)
+		}
+		return err
+	})
+}
+
+// rollback closes the opened stages in reverse order. Nothing ran yet, so
+// the encoders have nobody to flush to.
+func (gr *graphRun) rollback(oe *OpenError) error {
+	for _, p := range gr.pipes {
+		p.CloseRead(nil)
+	}
+	var errs []error
+	for i := len(gr.opened) - 1; i >= 0; i-- {
+		if err := gr.opened[i].Close(); !errors.Is(err, errPipeClosed) {
+			errs = append(errs, err)
+		}
+	}
+	oe.CloseErr = errors.Join(errs...)
+	return oe
+}
+
+// Run opens every node, copies the inputs to the outputs and closes
+// everything. It returns the number of bytes written to the outputs.
+func (g *Graph) Run(ctx context.Context) (int64, error) {
+	n, err, closeErr := g.run(ctx, false)
+	return n, errors.Join(err, closeErr)
+}
+
+// Drain is Run, but when ctx is done it only stops reading the inputs: the
+// bytes read so far go through the stages, and the encoders and the outputs
+// are closed as at the end of the inputs. It returns a *CanceledError if
+// nothing else failed, see DrainContext.
+func (g *Graph) Drain(ctx context.Context) (int64, error) {
+	n, err, closeErr := g.run(ctx, true)
+	return n, errors.Join(err, closeErr)
+}
+
+// run returns the error of the run and the ones of closing the inputs and
+// the decoders apart.
+func (g *Graph) run(ctx context.Context, drain bool) (int64, error, error) {
+	gr := &graphRun{reg: g.reg, readers: make(map[string][]io.Reader)}
+	for _, gn := range g.nodes {
+		r, err := gr.open(ctx, gn)
+		if err != nil {
+			return 0, gr.rollback(&OpenError{
+				Stage: fmt.Sprintf("%v '%v'", gn.kind, gn.id), Type: gn.stage.Type, Err: err}), nil
+		}
+		if r != nil {
+			gr.fork(gn, r)
+		}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if drain {
+				gr.drain()
+			} else {
+				gr.fail(&CanceledError{Err: ctx.Err()})
+			}
+		case <-stop:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, task := range gr.tasks {
+		wg.Add(1)
+		go func(task func() error) {
+			defer wg.Done()
+			if err := task(); err != nil {
+				gr.fail(err)
+			}
+		}(task)
+	}
+	wg.Wait()
+	close(stop)
+
+	var errs []error
+	for i := len(gr.closers) - 1; i >= 0; i-- {
+		errs = append(errs, gr.closers[i].Close())
+	}
+	err := gr.err
+	if err == nil && atomic.LoadInt32(&gr.stopped) != 0 {
+		err = &CanceledError{N: gr.bytes, Err: ctx.Err()}
+	}
+	return gr.bytes, err, errors.Join(errs...)
+}
@@ -0,0 +1,212 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphRun(t *testing.T) {
+	dir := t.TempDir()
+	data := testData(1 << 20)
+	var packed bytes.Buffer
+	zw := gzip.NewWriter(&packed)
+	zw.Write(data)
+	zw.Close()
+	if err := os.WriteFile(filepath.Join(dir, "a.gz"), packed.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b"), []byte("tail"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := LoadGraph(strings.NewReader(fmt.Sprintf(`
+graph:
+  - id: raw
+    output: {type: local, name: %[1]v/raw}
+    from: plain
+  - id: src
+    input: {type: local, name: %[1]v/a.gz}
+  - id: plain
+    decoder: {type: gzip}
+    from: src
+  - id: z
+    encoder: {type: zlib}
+    from: plain
+  - id: packed
+    output: {type: local, name: %[1]v/a.z}
+    from: z
+  - id: tail
+    input: {type: local, name: %[1]v/b}
+  - id: merged
+    output: {type: local, name: %[1]v/merged}
+    from: [plain, tail]
+`, dir)))
+	if err != nil {
+		t.Fatalf("LoadGraph: %v", err)
+	}
+	n, err := g.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	raw, _ := os.ReadFile(filepath.Join(dir, "raw"))
+	if !bytes.Equal(raw, data) {
+		t.Errorf("raw: got %v bytes", len(raw))
+	}
+	merged, _ := os.ReadFile(filepath.Join(dir, "merged"))
+	if !bytes.Equal(merged, append(data, "tail"...)) {
+		t.Errorf("merged: got %v bytes", len(merged))
+	}
+	file, err := os.Open(filepath.Join(dir, "a.z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := zlib.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(zr); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("a.z: got %v bytes, %v", len(got), err)
+	}
+	if fi, _ := file.Stat(); n != int64(len(raw)+len(merged))+fi.Size() {
+		t.Errorf("Run: %v bytes written", n)
+	}
+}
+
+func TestGraphDrain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// send a few bytes, then stall
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		time.Sleep(time.Second)
+	}()
+
+	dir := t.TempDir()
+	batch, err := LoadBatch(strings.NewReader(fmt.Sprintf(`
+graph:
+  - id: src
+    input: tcp://%v
+  - id: gz
+    encoder: {type: gzip}
+    from: src
+  - id: z
+    encoder: {type: zlib}
+    from: src
+  - id: a
+    output: file://%[2]v/a.gz
+    from: gz
+  - id: b
+    output: file://%[2]v/b.z
+    from: z
+`, ln.Addr(), dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.Drain = true
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	reports := batch.Run(ctx)
+	var ce *CanceledError
+	if r := reports[0]; !r.Partial || !errors.As(r.Err, &ce) {
+		t.Errorf("report: %+v", r)
+	}
+
+	// both trailers were written
+	for name, open := range map[string]func(io.Reader) (io.Reader, error){
+		"a.gz": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"b.z":  func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	} {
+		packed, _ := os.ReadFile(filepath.Join(dir, name))
+		zr, err := open(bytes.NewReader(packed))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if got, err := io.ReadAll(zr); err != nil || string(got) != "hello" {
+			t.Errorf("%v: got %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestGraphValidate(t *testing.T) {
+	tests := []struct {
+		graph string
+		err   string
+	}{
+		{`
+  - id: a
+    input: {type: stdin}
+  - id: b
+    decoder: {type: gzip}
+    from: [a, c]
+  - id: c
+    decoder: {type: gzip}
+    from: b
+  - id: o
+    output: {type: stdout}
+    from: c
+`, "cycle: b -> c -> b"},
+		{`
+  - id: a
+    input: {type: stdin}
+  - id: o
+    output: {type: stdout}
+    from: x
+`, "unknown node 'x'"},
+		{`
+  - id: a
+    input: {type: stdin}
+  - id: b
+    decoder: {type: gzip}
+    from: a
+  - id: o
+    output: {type: stdout}
+    from: [a, b]
+`, "merges branches forked from 'a'"},
+		{`
+  - id: a
+    input: {type: stdin}
+  - id: b
+    decoder: {type: gzip}
+    from: a
+`, "not read by any node"},
+		{`
+  - id: a
+    input: {type: nope}
+`, "input 'nope' not found"},
+		{`
+  - id: a
+    input: {type: stdin}
+  - id: a
+    output: {type: stdout}
+    from: a
+`, "duplicated id"},
+	}
+	for _, tt := range tests {
+		_, err := LoadGraph(strings.NewReader("graph:" + tt.graph))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("got %v, want %v", err, tt.err)
+		}
+	}
+}
@@ -3,21 +3,41 @@ package stream
 import (
 	"compress/gzip"
 	"io"
-
-	"gopkg.in/yaml.v3"
 )
 
-func gzip_decoder(node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error) {
-	check_type(node, "gzip")
+// options: level, see LevelOptions
+
+func gzip_decoder(opts *NoOptions, r io.ReadCloser) (io.ReadCloser, error) {
 	return gzip.NewReader(r)
 }
 
-func gzip_encoder(node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error) {
-	check_type(node, "gzip")
-	return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+// gzipWriter ends a gzip member at every checkpoint, the members are
+// concatenated into a multistream file.
+type gzipWriter struct {
+	*gzip.Writer
+	w io.Writer
+}
+
+func (gw *gzipWriter) Checkpoint() error {
+	if err := gw.Writer.Close(); err != nil {
+		return err
+	}
+	gw.Writer.Reset(gw.w)
+	return nil
+}
+
+func gzip_encoder(opts *LevelOptions, w io.WriteCloser) (io.WriteCloser, error) {
+	zw, err := gzip.NewWriterLevel(w, opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipWriter{Writer: zw, w: w}, nil
 }
 
 func init() {
-	RegisterDecoderStream("gzip", gzip_decoder)
-	RegisterEncoderStream("gzip", gzip_encoder)
+	RegisterDecoder("gzip", gzip_decoder)
+	RegisterEncoder("gzip", gzip_encoder)
+	RegisterCheckpointEncoder("gzip")
+	Describe(KindDecoder, "gzip", "gzip format (RFC 1952), concatenated members included")
+	Describe(KindEncoder, "gzip", "gzip format (RFC 1952)")
 }
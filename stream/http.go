@@ -0,0 +1,182 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HTTPOptions are the options of the http input and output. The input
+// reads the body of the response, the output sends its bytes as the body of
+// the request.
+type HTTPOptions struct {
+	URL    string            `yaml:"url" required:"true" arg:"1" desc:"http or https URL"`
+	Method string            `yaml:"method" desc:"GET for an input, PUT for an output by default"`
+	Header map[string]string `yaml:"header" desc:"added to the request"`
+}
+
+func (opts *HTTPOptions) Validate() error {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return redactURLError(err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("`url` needs http or https, not '%v'", u.Scheme)
+	}
+	return nil
+}
+
+func (opts *HTTPOptions) request(method string, body io.Reader) (*http.Request, error) {
+	if opts.Method != "" {
+		method = opts.Method
+	}
+	req, err := http.NewRequest(method, opts.URL, body)
+	if err != nil {
+		return nil, redactURLError(err)
+	}
+	var names []string
+	for name := range opts.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		req.Header.Set(name, opts.Header[name])
+	}
+	return req, nil
+}
+
+// redactURLError hides the secrets of the URL of a *url.Error, see
+// redactURL.
+func redactURLError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = redactURL(ue.URL)
+	}
+	return err
+}
+
+// do sends the request, the URL of its errors is redacted.
+func do(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	return resp, redactURLError(err)
+}
+
+// httpStatusError is a response that isn't a success.
+type httpStatusError struct {
+	Method string
+	URL    string
+	Status string
+	Code   int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%v %v: %v", e.Method, e.URL, e.Status)
+}
+
+func (e *httpStatusError) Unwrap() error {
+	if e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden {
+		return ErrAuth
+	}
+	return nil
+}
+
+func checkResponse(req *http.Request, resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return &httpStatusError{Method: req.Method, URL: redactURL(req.URL.String()), Status: resp.Status, Code: resp.StatusCode}
+}
+
+func http_input(opts *HTTPOptions) (io.ReadCloser, error) {
+	req, err := opts.request(http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkResponse(req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// http_resume_input asks for the body from offset with a Range header, the
+// server has to answer with the partial content.
+func http_resume_input(node *yaml.Node, offset int64) (io.ReadCloser, error) {
+	opts, err := decodeOptions[HTTPOptions](KindInput, node)
+	if err != nil {
+		return nil, err
+	}
+	req, err := opts.request(http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+	}
+	resp, err := do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkResponse(req, resp); err == nil && offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		err = fmt.Errorf("%v %v: %v, the server can't resume at %v", req.Method, redactURL(req.URL.String()), resp.Status, offset)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// httpWriter streams the bytes to the body of a request, Close waits for
+// the response.
+type httpWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (hw *httpWriter) Write(b []byte) (int, error) {
+	return hw.pw.Write(b)
+}
+
+func (hw *httpWriter) Close() error {
+	hw.pw.Close()
+	return <-hw.done
+}
+
+func http_output(opts *HTTPOptions) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	req, err := opts.request(http.MethodPut, pr)
+	if err != nil {
+		return nil, err
+	}
+	hw := &httpWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := do(req)
+		if err == nil {
+			err = checkResponse(req, resp)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		// the writes fail with the error of the request
+		pr.CloseWithError(err)
+		hw.done <- err
+	}()
+	return hw, nil
+}
+
+func init() {
+	RegisterResumableInput("http", http_resume_input)
+	RegisterInput("http", http_input)
+	RegisterOutput("http", http_output)
+	Describe(KindInput, "http", "read the body of the response to a GET")
+	Describe(KindOutput, "http", "send the bytes as the body of a PUT")
+}
@@ -0,0 +1,394 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// include:                  # a path or a list, relative to the file, of
+//                           # any format, see format.go
+//   - common.yaml
+// profiles:
+//   archive:                # a chain of codecs
+//     - {type: zlib}
+//     - {type: gzip, level: 9}
+//   backup:                 # an endpoint
+//     type: tee
+//     child:
+//       - {type: local, name: /backup/a}
+//       - {type: local, name: /backup/b}
+// input: {type: stdin}
+// encoder:
+//   - use: archive          # replaced by the codecs of the chain
+// output:
+//   use: backup             # the other keys override the profile
+//
+// The profiles of the included files are merged with the ones of the file,
+// a name is defined once. The other keys of an included file are used if
+// the file doesn't have them. A profile may use other profiles.
+
+// where is the position of an error, the line alone if the config isn't a
+// file.
+func where(file string, line int) string {
+	if file == "" {
+		return fmt.Sprintf("line %v", line)
+	}
+	return fmt.Sprintf("%v:%v", file, line)
+}
+
+// sources maps the stages that come from another file than the config, the
+// profiles and the keys of the included files, to their file: the lines of
+// their errors are the ones of that file.
+type sources map[*yaml.Node]string
+
+// copy is copyNode, the copies keep the file of the nodes.
+func (src sources) copy(node *yaml.Node) *yaml.Node {
+	c := *node
+	c.Content = nil
+	for _, n := range node.Content {
+		c.Content = append(c.Content, src.copy(n))
+	}
+	if file, ok := src[node]; ok {
+		src[&c] = file
+	}
+	return &c
+}
+
+// wrap prefixes err with the file and the line of node, if it comes from
+// another file.
+func (src sources) wrap(node *yaml.Node, err error) error {
+	if file, ok := src[node]; ok && err != nil {
+		return fmt.Errorf("%v: %w", where(file, node.Line), err)
+	}
+	return err
+}
+
+type profile struct {
+	name  string
+	node  *yaml.Node // a sequence for a chain, a map for an endpoint
+	file  string
+	line  int
+	state int // 0, resolving, resolved
+}
+
+const (
+	profileResolving = iota + 1
+	profileResolved
+)
+
+type loader struct {
+	files    []string // the include stack, absolute paths
+	profiles map[string]*profile
+	using    []string              // the profiles being resolved
+	origin   map[*yaml.Node]string // file of the top level values
+	src      sources
+}
+
+// loadDocument decodes a config and resolves its includes and profiles.
+// The file name of r is used for the relative includes and the errors.
+func loadDocument(r io.Reader) (*yaml.Node, sources, error) {
+	ld := &loader{
+		profiles: make(map[string]*profile),
+		origin:   make(map[*yaml.Node]string),
+		src:      make(sources),
+	}
+	var file string
+	if f, ok := r.(interface{ Name() string }); ok {
+		file = f.Name()
+		if abs, err := filepath.Abs(file); err == nil {
+			ld.files = append(ld.files, abs)
+		}
+	}
+	root, err := ld.load(r, file, formatOf(r), false)
+	if err != nil || root.Kind != yaml.MappingNode {
+		return root, ld.src, err
+	}
+	for i := 1; i < len(root.Content); i += 2 {
+		value := root.Content[i]
+		if err = ld.resolve(value, ld.origin[value]); err != nil {
+			return nil, nil, err
+		}
+	}
+	// the stages of an included file
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		from := ld.origin[value]
+		if from == file {
+			continue
+		}
+		switch Kind(key.Value) {
+		case KindInput, KindOutput:
+			ld.from(value, from)
+		case KindDecoder, KindEncoder:
+			if value.Kind == yaml.SequenceNode {
+				for _, n := range value.Content {
+					ld.from(n, from)
+				}
+			}
+		}
+	}
+	return root, ld.src, nil
+}
+
+// from records the file of a stage, unless it comes from a profile.
+func (ld *loader) from(node *yaml.Node, file string) {
+	if _, ok := ld.src[node]; !ok {
+		ld.src[node] = file
+	}
+}
+
+// includeList reads the paths of `include`.
+func includeList(node *yaml.Node) ([]*yaml.Node, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []*yaml.Node{node}, nil
+	case yaml.SequenceNode:
+		for _, n := range node.Content {
+			if n.Kind != yaml.ScalarNode {
+				return nil, errors.New("`include` needs a path or a list of paths")
+			}
+		}
+		return node.Content, nil
+	}
+	return nil, errors.New("`include` needs a path or a list of paths")
+}
+
+func (ld *loader) load(r io.Reader, file, format string, included bool) (*yaml.Node, error) {
+	root, err := decodeDocument(r, format)
+	if err != nil {
+		if included {
+			return nil, fmt.Errorf("%v: %w", file, err)
+		}
+		return nil, err
+	}
+	if root.Kind != yaml.MappingNode {
+		return root, nil
+	}
+
+	if i := getChildByTag(root, "include"); i >= 0 && i+1 < len(root.Content) {
+		paths, err := includeList(root.Content[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", where(file, root.Content[i].Line), err)
+		}
+		for _, p := range paths {
+			if err = ld.include(root, file, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if i := getChildByTag(root, "profiles"); i >= 0 && i+1 < len(root.Content) {
+		if err := ld.define(root.Content[i+1], file); err != nil {
+			return nil, err
+		}
+	}
+
+	var content []*yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if key.Value == "include" || key.Value == "profiles" {
+			continue
+		}
+		if _, ok := ld.origin[value]; !ok {
+			ld.origin[value] = file
+		}
+		content = append(content, key, value)
+	}
+	root.Content = content
+	return root, nil
+}
+
+// include loads the file of path into root, the keys of root win.
+func (ld *loader) include(root *yaml.Node, file string, path *yaml.Node) error {
+	name := path.Value
+	if !filepath.IsAbs(name) && file != "" {
+		name = filepath.Join(filepath.Dir(file), name)
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return fmt.Errorf("%v: include: %w", where(file, path.Line), err)
+	}
+	for i, f := range ld.files {
+		if f == abs {
+			cycle := append(ld.files[i:], abs)
+			return fmt.Errorf("%v: include cycle: %v", where(file, path.Line), strings.Join(cycle, " -> "))
+		}
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("%v: include: %w", where(file, path.Line), err)
+	}
+	defer f.Close()
+	ld.files = append(ld.files, abs)
+	inc, err := ld.load(f, name, FormatOf(name), true)
+	ld.files = ld.files[:len(ld.files)-1]
+	if err != nil {
+		return err
+	}
+	if inc.Kind != yaml.MappingNode {
+		return fmt.Errorf("%v: needs a map", where(name, inc.Line))
+	}
+	for i := 0; i+1 < len(inc.Content); i += 2 {
+		if getChildByTag(root, inc.Content[i].Value) < 0 {
+			root.Content = append(root.Content, inc.Content[i], inc.Content[i+1])
+		}
+	}
+	return nil
+}
+
+// define adds the profiles of a file.
+func (ld *loader) define(node *yaml.Node, file string) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("%v: `profiles` needs a map", where(file, node.Line))
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if p, ok := ld.profiles[key.Value]; ok {
+			return fmt.Errorf("%v: profile '%v' is already defined at %v",
+				where(file, key.Line), key.Value, where(p.file, p.line))
+		}
+		if value.Kind != yaml.SequenceNode && value.Kind != yaml.MappingNode {
+			return fmt.Errorf("%v: profile '%v' needs a list of codecs or a map",
+				where(file, key.Line), key.Value)
+		}
+		ld.profiles[key.Value] = &profile{name: key.Value, node: value, file: file, line: key.Line}
+	}
+	return nil
+}
+
+func isUse(node *yaml.Node) bool {
+	return node.Kind == yaml.MappingNode && getChildByTag(node, "use") >= 0
+}
+
+// resolve replaces the `use` of node and its children.
+func (ld *loader) resolve(node *yaml.Node, file string) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		if isUse(node) {
+			nodes, err := ld.use(node, file, false)
+			if err != nil {
+				return err
+			}
+			// the node is replaced in place, it's from the file of the copy
+			*node = *nodes[0]
+			if f, ok := ld.src[nodes[0]]; ok {
+				ld.src[node] = f
+			}
+			return nil
+		}
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := ld.resolve(node.Content[i], file); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		var content []*yaml.Node
+		for _, n := range node.Content {
+			if isUse(n) {
+				nodes, err := ld.use(n, file, true)
+				if err != nil {
+					return err
+				}
+				content = append(content, nodes...)
+				continue
+			}
+			if err := ld.resolve(n, file); err != nil {
+				return err
+			}
+			content = append(content, n)
+		}
+		node.Content = content
+	}
+	return nil
+}
+
+// use returns copies of the profile that node uses, the codecs of a chain
+// or the endpoint with the keys of node.
+func (ld *loader) use(node *yaml.Node, file string, inList bool) ([]*yaml.Node, error) {
+	value := node.Content[getChildByTag(node, "use")+1]
+	if value.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("%v: `use` needs a profile name", where(file, value.Line))
+	}
+	p, ok := ld.profiles[value.Value]
+	if !ok {
+		return nil, fmt.Errorf("%v: unknown profile '%v'", where(file, value.Line), value.Value)
+	}
+	if err := ld.resolveProfile(p); err != nil {
+		return nil, err
+	}
+
+	if p.node.Kind == yaml.SequenceNode {
+		if !inList {
+			return nil, fmt.Errorf("%v: profile '%v' (%v) is a chain of codecs, it's used in a decoder or encoder list",
+				where(file, value.Line), p.name, where(p.file, p.line))
+		}
+		if len(node.Content) > 2 {
+			return nil, fmt.Errorf("%v: profile '%v' (%v) is a chain of codecs, it has no options",
+				where(file, value.Line), p.name, where(p.file, p.line))
+		}
+		var nodes []*yaml.Node
+		for _, n := range p.node.Content {
+			c := ld.src.copy(n)
+			if p.file != file {
+				ld.src[c] = p.file
+			}
+			nodes = append(nodes, c)
+		}
+		return nodes, nil
+	}
+
+	c := ld.src.copy(p.node)
+	if p.file != file {
+		ld.src[c] = p.file
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, v := node.Content[i], node.Content[i+1]
+		if key.Value == "use" {
+			continue
+		}
+		if err := ld.resolve(v, file); err != nil {
+			return nil, err
+		}
+		if j := getChildByTag(c, key.Value); j >= 0 {
+			c.Content[j+1] = v
+		} else {
+			c.Content = append(c.Content, key, v)
+		}
+	}
+	return []*yaml.Node{c}, nil
+}
+
+// resolveProfile replaces the `use` of a profile, once.
+func (ld *loader) resolveProfile(p *profile) error {
+	switch p.state {
+	case profileResolved:
+		return nil
+	case profileResolving:
+		i := 0
+		for ld.using[i] != p.name {
+			i++
+		}
+		cycle := append(ld.using[i:], p.name)
+		return fmt.Errorf("%v: profile cycle: %v", where(p.file, p.line), strings.Join(cycle, " -> "))
+	}
+	p.state = profileResolving
+	ld.using = append(ld.using, p.name)
+	err := ld.resolve(p.node, p.file)
+	ld.using = ld.using[:len(ld.using)-1]
+	p.state = profileResolved
+	return err
+}
+
+func copyNode(node *yaml.Node) *yaml.Node {
+	c := *node
+	c.Content = nil
+	for _, n := range node.Content {
+		c.Content = append(c.Content, copyNode(n))
+	}
+	return &c
+}
@@ -0,0 +1,209 @@
+package stream
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func loadPlan(t *testing.T, path string) (*Plan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return NewPlan(f)
+}
+
+func stageTypes(stages []*Stage) string {
+	var types []string
+	for _, s := range stages {
+		types = append(types, s.Type)
+	}
+	return strings.Join(types, ",")
+}
+
+func TestProfiles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"common.yaml": `
+profiles:
+  archive:
+    - {type: zlib}
+    - {type: gzip, level: 9}
+  backup:
+    type: tee
+    child:
+      - {type: local, name: /tmp/a/x}
+      - {type: local, name: /tmp/b/x}
+`,
+		"stream.yaml": `
+include: common.yaml
+profiles:
+  twice:
+    - use: archive
+    - use: archive
+  src: {type: local, name: in}
+input: {use: src, name: other}
+encoder:
+  - {type: snappy}
+  - use: twice
+output:
+  use: backup
+`,
+	})
+	plan, err := loadPlan(t, filepath.Join(dir, "stream.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stageTypes(plan.Encoders); got != "snappy,zlib,gzip,zlib,gzip" {
+		t.Errorf("encoders: %v", got)
+	}
+	if plan.Output.Type != "tee" || len(plan.Output.Children) != 2 {
+		t.Errorf("output: %+v", plan.Output)
+	}
+	if opts, err := decodeOptions[LocalOptions](KindInput, plan.Input.node); err != nil || opts.Name != "other" {
+		t.Errorf("input: %+v, %v", opts, err)
+	}
+	// a profile is copied, the uses don't share nodes
+	if plan.Encoders[1].node == plan.Encoders[3].node {
+		t.Errorf("shared node")
+	}
+}
+
+func TestProfileErrors(t *testing.T) {
+	for _, c := range []struct {
+		files map[string]string
+		want  string
+	}{
+		{map[string]string{"main.yaml": "profiles:\n  a: [{use: b}]\n  b: [{use: a}]\ninput: {type: stdin}\nencoder: [{use: a}]\noutput: {type: stdout}\n"},
+			"main.yaml:2: profile cycle: a -> b -> a"},
+		{map[string]string{"main.yaml": "include: a.yaml\n", "a.yaml": "include: [b.yaml]\n", "b.yaml": "include: a.yaml\n"},
+			"b.yaml:1: include cycle: "},
+		{map[string]string{"main.yaml": "input: {use: nope}\noutput: {type: stdout}\n"},
+			"main.yaml:1: unknown profile 'nope'"},
+		{map[string]string{"main.yaml": "include: a.yaml\nprofiles:\n  p: {type: stdin}\n", "a.yaml": "\nprofiles:\n  p: {type: stdin}\n"},
+			"main.yaml:3: profile 'p' is already defined at "},
+		{map[string]string{"main.yaml": "include: a.yaml\ninput: {use: chain}\noutput: {type: stdout}\n", "a.yaml": "profiles:\n  chain: [{type: gzip}]\n"},
+			"main.yaml:2: profile 'chain' ("},
+		{map[string]string{"main.yaml": "include: a.yaml\n", "a.yaml": "input: [\n"},
+			"a.yaml: yaml: line "},
+		{map[string]string{"main.yaml": "include: nope.yaml\n"},
+			"main.yaml:1: include: open "},
+	} {
+		dir := writeFiles(t, c.files)
+		_, err := loadPlan(t, filepath.Join(dir, "main.yaml"))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("got %v, want %v", err, c.want)
+		}
+	}
+}
+
+func TestIncludedStageErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"common.yaml": "profiles:\n  archive:\n    - {type: zlib}\n    - {type: gzip, level: 42}\n" +
+			"  store:\n    type: local\n    nme: x\n" +
+			"output: {type: local}\n",
+		"main.yaml":  "include: common.yaml\ninput: {type: stdin}\nencoder:\n  - use: archive\n",
+		"other.yaml": "include: common.yaml\ninput: {type: stdin}\nencoder:\n  - use: archive\noutput: {type: stdout}\n",
+		"store.yaml": "include: common.yaml\ninput: {type: stdin}\noutput: {use: store}\n",
+	})
+	common := filepath.Join(dir, "common.yaml")
+	for name, want := range map[string]string{
+		"main.yaml":  common + ":8: output 'local': ",
+		"other.yaml": "encoder[1]: " + common + ":4: encoder 'gzip': ",
+		// an endpoint profile replaces the node of the file
+		"store.yaml": common + ":6: output 'local': line 7, column 5: `nme`: unknown option",
+	} {
+		_, err := loadPlan(t, filepath.Join(dir, name))
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%v: got %v, want %v", name, err, want)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	diags := Check(f)
+	var got []string
+	for _, d := range diags {
+		got = append(got, d.String())
+	}
+	want := []string{
+		"error: encoder[1].level (" + common + ":4, column 27): ",
+		"error: output.name (" + common + ":8, column 9): is missing",
+	}
+	if len(got) != 2 || !strings.HasPrefix(got[0], want[0]) || got[1] != want[1] {
+		t.Errorf("Check: %q", got)
+	}
+
+	f, err = os.Open(filepath.Join(dir, "store.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	diags = Check(f)
+	if len(diags) != 2 || diags[0].String() != "error: output.name ("+common+":6, column 5): is missing" ||
+		!strings.HasPrefix(diags[1].String(), "error: output.nme ("+common+":7, column 5): unknown option") {
+		t.Errorf("Check: %v", diags)
+	}
+}
+
+func TestCheckIncludedOrder(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"common.yaml": "profiles:\n  store:\n    type: local\n    nme: x\n",
+		"main.yaml":   "include: common.yaml\ninput: {type: local}\noutput: {use: store}\nconcurent: true\n",
+	})
+	f, err := os.Open(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	for _, d := range Check(f) {
+		got = append(got, d.String())
+	}
+	// the lines of two files don't interleave
+	common := filepath.Join(dir, "common.yaml")
+	want := []string{
+		"error: input.name (line 2, column 8): is missing",
+		"warning: concurent (line 4, column 1): unknown key, it's ignored, did you mean 'concurrent'?",
+		"error: output.name (" + common + ":3, column 5): is missing",
+		"error: output.nme (" + common + ":4, column 5): unknown option, did you mean 'name'?",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Check:\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestIncludeBatch(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"policy.yaml": "policy: {mode: parallel}\nmetrics: {listen: ':0'}\n",
+		"main.yaml":   "include: [policy.yaml]\nmetrics: {listen: ':1'}\ninput: {type: stdin}\noutput: {type: stdout}\n",
+	})
+	f, err := os.Open(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	batch, err := LoadBatch(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keys of the file win over the included ones
+	if batch.Policy.Mode != PolicyParallel || batch.Metrics.Listen != ":1" {
+		t.Errorf("batch: %+v %+v", batch.Policy, batch.Metrics)
+	}
+}
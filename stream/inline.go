@@ -0,0 +1,299 @@
+package stream
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A stage may be written on one line, for the command line:
+//
+//	type[:arg[:arg...]][,key=value...]
+//
+//	local:/tmp/a
+//	tcp:example.com:9000,token=secret
+//	gzip:level=9
+//	exec:zstd,args=[-q,-c]
+//
+// The positional args go to the options tagged `arg:"1"`, `arg:"2"`... of
+// the type, split on ':', the last one gets the rest. An IPv6 address is
+// written in brackets. The values are YAML,
+// except the ones of the string options which are taken as they are. An
+// Inline is the equivalent config of a single stream.
+
+// Inline is a stream given as inline stages.
+type Inline struct {
+	Inputs   []string // several inputs are read by a cat
+	Decoders []string
+	Encoders []string // in the order the bytes go through them, like a Builder
+	Outputs  []string // several outputs are written by a tee
+}
+
+// splitItems splits the items of an inline stage on the commas out of the
+// brackets of a YAML flow value.
+func splitItems(s string) []string {
+	var items []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[', '{':
+			depth++
+		case ']', '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				items = append(items, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, s[start:])
+}
+
+// isOptionItem reports whether an item is key=value, the key being a
+// lower case identifier.
+func isOptionItem(item string) bool {
+	key, _, ok := strings.Cut(item, "=")
+	if !ok || key == "" {
+		return false
+	}
+	for i, c := range key {
+		if !(c >= 'a' && c <= 'z' || c == '_' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// splitArgs splits the positional args in at most n values on the colons
+// out of brackets, an IPv6 address is written [::1] and loses them.
+func splitArgs(s string, n int) []string {
+	var values []string
+	depth, start := 0, 0
+	for i := 0; i < len(s) && len(values) < n-1; i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		case ':':
+			if depth == 0 {
+				values = append(values, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	values = append(values, s[start:])
+	for i, v := range values {
+		if strings.HasPrefix(v, "[") && strings.HasSuffix(v, "]") && strings.Contains(v, ":") {
+			values[i] = v[1 : len(v)-1]
+		}
+	}
+	return values
+}
+
+// inlineValue makes the node of an inline value, a string option takes it
+// as it is.
+func inlineValue(spec *optionSpec, f *optionField, value string) *yaml.Node {
+	if f != nil && spec.typ.Field(f.index).Type.Kind() == reflect.String {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &doc); err != nil || len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	}
+	// the positions would be the ones in the value alone
+	clearPositions(doc.Content[0])
+	return doc.Content[0]
+}
+
+func clearPositions(node *yaml.Node) {
+	node.Line, node.Column = 0, 0
+	for _, n := range node.Content {
+		clearPositions(n)
+	}
+}
+
+// positional returns the `arg` options of a type, in order.
+func (spec *optionSpec) positional() []*optionField {
+	var fields []*optionField
+	for _, f := range spec.fields {
+		if f.arg > 0 {
+			fields = append(fields, f)
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].arg < fields[j].arg })
+	return fields
+}
+
+// ParseStage parses an inline stage into the node of a stage of a config,
+// an input or an output may be a URL too, see url.go.
+func (reg *Registry) ParseStage(kind Kind, s string) (*yaml.Node, error) {
+	if (kind == KindInput || kind == KindOutput) && (s == "-" || strings.Contains(s, "://")) {
+		return reg.ParseURL(kind, s)
+	}
+	typ, rest, _ := strings.Cut(s, ":")
+	if typ == "" {
+		return nil, fmt.Errorf("%v %q: the type is missing", kind, s)
+	}
+	if !reg.registered(kind, typ) {
+		return nil, fmt.Errorf("%v '%v' not found", kind, typ)
+	}
+	spec := reg.optionSpec(kind, typ)
+
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: "type"},
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: typ},
+	}}
+	add := func(key string, value *yaml.Node) error {
+		if getChildByTag(node, key) >= 0 {
+			return fmt.Errorf("%v '%v': `%v` is set twice", kind, typ, key)
+		}
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+		return nil
+	}
+	if rest == "" {
+		return node, nil
+	}
+
+	items := splitItems(rest)
+	if !isOptionItem(items[0]) {
+		var fields []*optionField
+		if spec != nil {
+			fields = spec.positional()
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%v '%v' takes no positional argument, use key=value", kind, typ)
+		}
+		for i, value := range splitArgs(items[0], len(fields)) {
+			if err := add(fields[i].name, inlineValue(spec, fields[i], value)); err != nil {
+				return nil, err
+			}
+		}
+		items = items[1:]
+	}
+	for _, item := range items {
+		if !isOptionItem(item) {
+			return nil, fmt.Errorf("%v '%v': %q should be key=value", kind, typ, item)
+		}
+		key, value, _ := strings.Cut(item, "=")
+		var f *optionField
+		if spec != nil {
+			f = spec.field(key)
+		}
+		if err := add(key, inlineValue(spec, f, value)); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func ParseStage(kind Kind, s string) (*yaml.Node, error) {
+	return DefaultRegistry.ParseStage(kind, s)
+}
+
+// inlineEndpoint makes the input or the output of an inline stream, a cat
+// or a tee if there are several.
+func (reg *Registry) inlineEndpoint(kind Kind, specs []string) (*yaml.Node, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("%v is missing", kind)
+	}
+	var stages []*yaml.Node
+	for _, s := range specs {
+		stage, err := reg.ParseStage(kind, s)
+		if err != nil {
+			return nil, err
+		}
+		stages = append(stages, stage)
+	}
+	if len(stages) == 1 {
+		return stages[0], nil
+	}
+	composite := "cat"
+	if kind == KindOutput {
+		composite = "tee"
+	}
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: "type"},
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: composite},
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: "child"},
+		{Kind: yaml.SequenceNode, Tag: "!!seq", Content: stages},
+	}}, nil
+}
+
+func (reg *Registry) inlineList(kind Kind, specs []string) (*yaml.Node, error) {
+	list := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for i, s := range specs {
+		stage, err := reg.ParseStage(kind, s)
+		if err != nil {
+			return nil, fmt.Errorf("%v[%v]: %w", kind, i, err)
+		}
+		list.Content = append(list.Content, stage)
+	}
+	return list, nil
+}
+
+// InlineConfig returns the config of the inline stream, the mapping that
+// holds input, decoder, encoder and output.
+func (reg *Registry) InlineConfig(in Inline) (*yaml.Node, error) {
+	input, err := reg.inlineEndpoint(KindInput, in.Inputs)
+	if err != nil {
+		return nil, err
+	}
+	decoders, err := reg.inlineList(KindDecoder, in.Decoders)
+	if err != nil {
+		return nil, err
+	}
+	encoders, err := reg.inlineList(KindEncoder, in.Encoders)
+	if err != nil {
+		return nil, err
+	}
+	// the config lists the encoders from the output
+	for i, j := 0, len(encoders.Content)-1; i < j; i, j = i+1, j-1 {
+		encoders.Content[i], encoders.Content[j] = encoders.Content[j], encoders.Content[i]
+	}
+	output, err := reg.inlineEndpoint(KindOutput, in.Outputs)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	section := func(key string, value *yaml.Node) {
+		config.Content = append(config.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	}
+	section("input", input)
+	if len(decoders.Content) > 0 {
+		section("decoder", decoders)
+	}
+	if len(encoders.Content) > 0 {
+		section("encoder", encoders)
+	}
+	section("output", output)
+	return config, nil
+}
+
+func InlineConfig(in Inline) (*yaml.Node, error) {
+	return DefaultRegistry.InlineConfig(in)
+}
+
+// InlineYAML returns the YAML config of the inline stream.
+func (reg *Registry) InlineYAML(in Inline) ([]byte, error) {
+	config, err := reg.InlineConfig(in)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(config)
+}
+
+func InlineYAML(in Inline) ([]byte, error) {
+	return DefaultRegistry.InlineYAML(in)
+}
@@ -0,0 +1,79 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseStage(t *testing.T) {
+	for _, tc := range []struct {
+		kind Kind
+		spec string
+		want string
+	}{
+		{KindInput, "local:/tmp/a", "{type: local, name: /tmp/a}"},
+		{KindOutput, "tcp:example.com:9000,token=0123", "{type: tcp, host: example.com, port: \"9000\", token: \"0123\"}"},
+		{KindOutput, "tcp:[::1]:9000", "{type: tcp, host: '::1', port: \"9000\"}"},
+		{KindEncoder, "gzip:level=9", "{type: gzip, level: 9}"},
+		{KindEncoder, "exec:zstd,args=[-q,-c]", "{type: exec, command: zstd, args: [-q, -c]}"},
+		{KindDecoder, "gzip", "{type: gzip}"},
+	} {
+		node, err := ParseStage(tc.kind, tc.spec)
+		if err != nil {
+			t.Errorf("%v: %v", tc.spec, err)
+			continue
+		}
+		node.Style = yaml.FlowStyle
+		got, _ := yaml.Marshal(node)
+		if strings.TrimSpace(string(got)) != tc.want {
+			t.Errorf("%v: got %s, want %v", tc.spec, got, tc.want)
+		}
+	}
+
+	for _, spec := range []string{"nope:x", ":x", "gzip:9", "local:/a,/b", "gzip:level=1,level=2"} {
+		if _, err := ParseStage(KindEncoder, spec); err == nil {
+			t.Errorf("%v: no error", spec)
+		}
+	}
+}
+
+func TestInlineConfig(t *testing.T) {
+	dir := t.TempDir()
+	data := testData(1 << 12)
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	packed := filepath.Join(dir, "packed")
+	config, err := InlineYAML(Inline{
+		Inputs:   []string{"local:" + src, "local:" + src},
+		Encoders: []string{"zlib:level=9", "gzip"},
+		Outputs:  []string{"local:" + packed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStream(bytes.NewReader(config))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, config)
+	}
+	_, err = s.Copy()
+	if err = errors.Join(err, s.Close()); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(packed)
+	// gzip was given last, it's the outer format
+	if !bytes.HasPrefix(got, []byte{0x1f, 0x8b}) {
+		t.Errorf("not gzip:\n%s", config)
+	}
+
+	if _, err = InlineConfig(Inline{Inputs: []string{"stdin"}}); err == nil {
+		t.Errorf("no output: no error")
+	}
+}
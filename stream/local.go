@@ -1,44 +1,77 @@
 package stream
 
 import (
+	"fmt"
 	"io"
 	"os"
 
 	"gopkg.in/yaml.v3"
 )
 
-type localInputFile struct {
-	Type string
-	Name string
-}
-type localOutputFile struct {
-	Type string
-	Name string
+// LocalOptions are the options of the local input and output.
+type LocalOptions struct {
+	Name string `yaml:"name" required:"true" arg:"1" desc:"file path"`
 	// perm
 	// flag
 }
 
-func local_input(input *yaml.Node) (io.ReadCloser, error) {
-	var config localInputFile
-	err := input.Decode(&config)
+func local_input(opts *LocalOptions) (io.ReadCloser, error) {
+	return os.Open(opts.Name)
+}
+
+func local_output(opts *LocalOptions) (io.WriteCloser, error) {
+	return os.OpenFile(opts.Name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+}
+
+// local_resume_input opens the file at offset
+func local_resume_input(node *yaml.Node, offset int64) (io.ReadCloser, error) {
+	opts, err := decodeOptions[LocalOptions](KindInput, node)
 	if err != nil {
 		return nil, err
 	}
-	// assert config.Type = "local"
-	return os.Open(config.Name)
+	f, err := os.Open(opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
 }
 
-func local_output(node *yaml.Node) (io.WriteCloser, error) {
-	var config localOutputFile
-	err := node.Decode(&config)
+// local_resume_output cuts the file at offset and appends to it
+func local_resume_output(node *yaml.Node, offset int64) (io.WriteCloser, error) {
+	opts, err := decodeOptions[LocalOptions](KindOutput, node)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(opts.Name, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() < offset {
+		err = fmt.Errorf("%v has %v bytes, the checkpoint needs %v", opts.Name, fi.Size(), offset)
+	}
+	if err == nil {
+		err = f.Truncate(offset)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	// assert config.Type = "local"
-	return os.OpenFile(config.Name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	return f, nil
 }
 
 func init() {
-	RegisterInputStream("local", local_input)
-	RegisterOutputStream("local", local_output)
+	RegisterResumableInput("local", local_resume_input)
+	RegisterResumableOutput("local", local_resume_output)
+	RegisterInput("local", local_input)
+	RegisterOutput("local", local_output)
+	Describe(KindInput, "local", "read a file")
+	Describe(KindOutput, "local", "write a file, truncated first")
 }
@@ -3,23 +3,32 @@ package stream
 import (
 	"compress/lzw"
 	"io"
-
-	"gopkg.in/yaml.v3"
 )
 
-// support options: order, lintwidth
+// LZWOptions are the options of the lzw codecs.
+type LZWOptions struct {
+	Order    string `yaml:"order" default:"LSB" enum:"LSB,MSB" desc:"bit ordering, LSB for GIF, MSB for TIFF and PDF"`
+	LitWidth int    `yaml:"litwidth" default:"8" min:"2" max:"8" desc:"bits per literal code"`
+}
+
+func (opts *LZWOptions) order() lzw.Order {
+	if opts.Order == "MSB" {
+		return lzw.MSB
+	}
+	return lzw.LSB
+}
 
-func lzw_decoder(node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error) {
-	check_type(node, "lzw")
-	return lzw.NewReader(r, lzw.LSB, 8), nil
+func lzw_decoder(opts *LZWOptions, r io.ReadCloser) (io.ReadCloser, error) {
+	return lzw.NewReader(r, opts.order(), opts.LitWidth), nil
 }
 
-func lzw_encoder(node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error) {
-	check_type(node, "lzw")
-	return lzw.NewWriter(w, lzw.LSB, 8), nil
+func lzw_encoder(opts *LZWOptions, w io.WriteCloser) (io.WriteCloser, error) {
+	return lzw.NewWriter(w, opts.order(), opts.LitWidth), nil
 }
 
 func init() {
-	RegisterDecoderStream("lzw", lzw_decoder)
-	RegisterEncoderStream("lzw", lzw_encoder)
+	RegisterDecoder("lzw", lzw_decoder)
+	RegisterEncoder("lzw", lzw_encoder)
+	Describe(KindDecoder, "lzw", "Lempel-Ziv-Welch")
+	Describe(KindEncoder, "lzw", "Lempel-Ziv-Welch")
 }
@@ -0,0 +1,271 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// METRICS syntax:
+// metrics:
+//   listen: 127.0.0.1:9464
+//
+// GET /metrics serves the counters of the streams in the prometheus text
+// format, GET /healthz answers 200 until a stream fails, then 503 with the
+// names of the failed streams.
+
+type MetricsConfig struct {
+	Listen string
+}
+
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobOK      = "ok"
+	jobFailed  = "failed"
+	jobSkipped = "skipped"
+	jobPartial = "partial"
+)
+
+type rateSample struct {
+	at     time.Time
+	input  int64
+	output int64
+}
+
+type trackedJob struct {
+	name   string
+	state  string
+	err    error
+	stream *Stream
+	stats  *Stats     // the last snapshot of a finished stream
+	sample rateSample // used to compute the current throughput
+}
+
+// Metrics tracks the jobs of a batch and serves their counters over http.
+type Metrics struct {
+	mu   sync.Mutex
+	jobs []*trackedJob
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) job(name string) *trackedJob {
+	for _, j := range m.jobs {
+		if j.name == name {
+			return j
+		}
+	}
+	j := &trackedJob{name: name, state: jobPending}
+	m.jobs = append(m.jobs, j)
+	return j
+}
+
+func (m *Metrics) add(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.job(name)
+}
+
+// Track records the opened stream of a running job.
+func (m *Metrics) Track(name string, s *Stream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.job(name)
+	j.state, j.stream, j.stats = jobRunning, s, nil
+	j.sample = rateSample{}
+}
+
+func (m *Metrics) start(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.job(name).state = jobRunning
+}
+
+// Done records the end of a job, the last counters of its stream are kept.
+func (m *Metrics) Done(report Report) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.job(report.Name)
+	j.err = report.Err
+	switch {
+	case report.Skipped:
+		j.state = jobSkipped
+	case report.Partial:
+		j.state = jobPartial
+	case report.Err != nil:
+		j.state = jobFailed
+	default:
+		j.state = jobOK
+	}
+	if j.stream != nil {
+		j.stats = j.stream.Stats()
+		j.stream = nil
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WriteTo(w)
+	case "/healthz":
+		m.health(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *Metrics) health(w http.ResponseWriter) {
+	m.mu.Lock()
+	var failed []string
+	for _, j := range m.jobs {
+		if j.state == jobFailed {
+			failed = append(failed, fmt.Sprintf("%v: %v", j.name, j.err))
+		}
+	}
+	m.mu.Unlock()
+
+	if len(failed) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "failed\n%v\n", strings.Join(failed, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// label values escaped as the text format wants
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(kv ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%v="%v"`, kv[i], labelEscaper.Replace(kv[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+type metricFamily struct {
+	name, typ, help string
+	lines           []string
+}
+
+func (f *metricFamily) add(lbl string, v any) {
+	f.lines = append(f.lines, fmt.Sprintf("%v%v %v", f.name, lbl, v))
+}
+
+// current throughput since the previous scrape, or the average rate of the
+// stream on the first one
+func (j *trackedJob) throughput(st *Stats, now time.Time) (float64, float64) {
+	var input, output int64
+	if len(st.Stages) > 0 {
+		input, output = st.Stages[0].BytesOut, st.Stages[len(st.Stages)-1].BytesIn
+	}
+	prev := j.sample
+	j.sample = rateSample{at: now, input: input, output: output}
+	if prev.at.IsZero() {
+		return st.InputRate(), st.OutputRate()
+	}
+	d := now.Sub(prev.at).Seconds()
+	if d <= 0 {
+		return 0, 0
+	}
+	return float64(input-prev.input) / d, float64(output-prev.output) / d
+}
+
+// WriteTo writes all the metrics in the prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	up := &metricFamily{name: "stream_cast_stream_up", typ: "gauge",
+		help: "1 while the stream is running"}
+	failed := &metricFamily{name: "stream_cast_stream_failed", typ: "gauge",
+		help: "1 if the stream failed"}
+	bytes := &metricFamily{name: "stream_cast_stage_bytes_total", typ: "counter",
+		help: "Bytes that went in and out of a stage"}
+	wait := &metricFamily{name: "stream_cast_stage_wait_seconds_total", typ: "counter",
+		help: "Time the next stage was blocked reading or writing a stage"}
+	errs := &metricFamily{name: "stream_cast_stage_errors_total", typ: "counter",
+		help: "Failed reads or writes of a stage"}
+	children := &metricFamily{name: "stream_cast_stage_children", typ: "gauge",
+		help: "Children of a cat input or a tee output"}
+	alive := &metricFamily{name: "stream_cast_stage_children_alive", typ: "gauge",
+		help: "Children of a cat input or a tee output that didn't fail"}
+	reconnects := &metricFamily{name: "stream_cast_reconnects_total", typ: "counter",
+		help: "Retried opens of the input and the output"}
+	rate := &metricFamily{name: "stream_cast_throughput_bytes_per_second", typ: "gauge",
+		help: "Bytes per second read from the input or written to the output since the last scrape"}
+
+	m.mu.Lock()
+	now := time.Now()
+	for _, j := range m.jobs {
+		name := labels("stream", j.name)
+		running, fail := 0, 0
+		if j.state == jobRunning {
+			running = 1
+		}
+		if j.state == jobFailed {
+			fail = 1
+		}
+		up.add(name, running)
+		failed.add(name, fail)
+
+		st := j.stats
+		if j.stream != nil {
+			st = j.stream.Stats()
+		}
+		if st == nil {
+			continue
+		}
+		for _, stage := range st.Stages {
+			l := func(kv ...string) string {
+				return labels(append([]string{"stream", j.name, "stage", stage.Stage, "type", stage.Type}, kv...)...)
+			}
+			bytes.add(l("direction", "in"), stage.BytesIn)
+			bytes.add(l("direction", "out"), stage.BytesOut)
+			if stage.ReadWait > 0 {
+				wait.add(l("direction", "read"), stage.ReadWait.Seconds())
+			}
+			if stage.WriteWait > 0 {
+				wait.add(l("direction", "write"), stage.WriteWait.Seconds())
+			}
+			errs.add(l(), stage.Errors)
+			if stage.Children > 0 {
+				children.add(l(), stage.Children)
+				alive.add(l(), stage.Alive)
+			}
+		}
+		reconnects.add(name, st.Reconnects)
+		var in, out float64
+		if j.stream != nil {
+			in, out = j.throughput(st, now)
+		}
+		rate.add(labels("stream", j.name, "direction", "input"), in)
+		rate.add(labels("stream", j.name, "direction", "output"), out)
+	}
+	m.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range []*metricFamily{up, failed, bytes, wait, errs, children, alive, reconnects, rate} {
+		if len(f.lines) == 0 {
+			continue
+		}
+		sort.Strings(f.lines)
+		fmt.Fprintf(&b, "# HELP %v %v\n# TYPE %v %v\n", f.name, f.help, f.name, f.typ)
+		for _, line := range f.lines {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
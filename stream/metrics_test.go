@@ -0,0 +1,103 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func httpGet(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestMetrics(t *testing.T) {
+	RegisterOutputStream("failing", func(node *yaml.Node) (io.WriteCloser, error) {
+		return &failingWriter{after: 1000}, nil
+	})
+	defer DefaultRegistry.Unregister(KindOutput, "failing")
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, testData(1<<20), 0600); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := LoadBatch(strings.NewReader(fmt.Sprintf(`
+policy: {on_failure: continue}
+metrics: {listen: 127.0.0.1:0}
+streams:
+  - name: good
+    input: {type: local, name: %v}
+    output: {type: local, name: %v}
+  - name: tee
+    input: {type: local, name: %v}
+    output:
+      type: tee
+      child:
+        - {type: local, name: %v}
+        - {type: failing}
+`, src, filepath.Join(dir, "good"), src, filepath.Join(dir, "tee"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", batch.Metrics.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	batch.Monitor = NewMetrics()
+	go http.Serve(l, batch.Monitor)
+	url := "http://" + l.Addr().String()
+
+	if code, body := httpGet(t, url+"/healthz"); code != http.StatusOK {
+		t.Errorf("healthz before run: %v %q", code, body)
+	}
+	reports := batch.Run(context.Background())
+	if reports[0].Err != nil || reports[1].Err == nil {
+		t.Fatalf("reports: %+v", reports)
+	}
+
+	code, body := httpGet(t, url+"/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("metrics: %v", code)
+	}
+	for _, want := range []string{
+		`stream_cast_stream_up{stream="good"} 0`,
+		`stream_cast_stream_failed{stream="tee"} 1`,
+		`stream_cast_stage_bytes_total{stream="good",stage="output",type="local",direction="in"} 1048576`,
+		`stream_cast_stage_errors_total{stream="tee",stage="output",type="tee"} 1`,
+		`stream_cast_stage_children{stream="tee",stage="output",type="tee"} 2`,
+		`stream_cast_stage_children_alive{stream="tee",stage="output",type="tee"} 1`,
+		`stream_cast_reconnects_total{stream="good"} 0`,
+		"# TYPE stream_cast_throughput_bytes_per_second gauge",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics: missing %v", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+
+	code, body = httpGet(t, url+"/healthz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "tee: ") {
+		t.Errorf("healthz after failure: %v %q", code, body)
+	}
+}
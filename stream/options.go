@@ -0,0 +1,505 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A stream type may bind its options to a struct, the tags of the fields
+// say how they are checked:
+//
+// type fooOptions struct {
+//     Name    string        `yaml:"name" required:"true"`
+//     Level   int           `yaml:"level" default:"6" min:"1" max:"9"`
+//     Mode    string        `yaml:"mode" default:"fast" enum:"fast,best"`
+//     Timeout time.Duration `yaml:"timeout" default:"10s" min:"1s"`
+//     Token   string        `yaml:"token" secret:"true"`
+//     Path    string        `yaml:"path" arg:"1"`
+// }
+//
+// Unknown keys are rejected, except the ones every stage has: `type`,
+// `retry` for inputs and outputs, `buffer` for codecs. An options struct
+// with a `Validate() error` method is checked by it after the tags. The
+// `arg` fields are the positional arguments of an inline stage, see
+// inline.go.
+//
+// A type without an options struct gets them as Options, whatever the
+// format of the config.
+
+var common_options = map[Kind][]string{
+	KindInput:   {"type", "retry"},
+	KindOutput:  {"type", "retry"},
+	KindDecoder: {"type", "buffer"},
+	KindEncoder: {"type", "buffer"},
+}
+
+// OptionError is an invalid option, Line and Column locate it in the config.
+type OptionError struct {
+	Option string // empty if the error is about the whole stage
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *OptionError) Error() string {
+	// the stages of a Builder have no position
+	if e.Line == 0 {
+		if e.Option == "" {
+			return Redact(e.Err.Error())
+		}
+		return Redact(fmt.Sprintf("`%v`: %v", e.Option, e.Err))
+	}
+	if e.Option == "" {
+		return Redact(fmt.Sprintf("line %v, column %v: %v", e.Line, e.Column, e.Err))
+	}
+	return Redact(fmt.Sprintf("line %v, column %v: `%v`: %v", e.Line, e.Column, e.Option, e.Err))
+}
+
+func (e *OptionError) Unwrap() error {
+	return e.Err
+}
+
+type optionField struct {
+	index    int
+	name     string
+	def      string // default, yaml encoded
+	required bool
+	min, max *float64
+	enum     []string
+	secret   bool // see Redact
+	arg      int  // position in an inline stage, 0 if it isn't positional
+}
+
+// optionSpec is the parsed options struct of a stream type.
+type optionSpec struct {
+	typ    reflect.Type
+	fields []*optionField
+}
+
+func optionName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+	return name
+}
+
+// parseBound reads a min/max tag, durations are in nanoseconds.
+func parseBound(t reflect.Type, s string) (*float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if t == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		v := float64(d)
+		return &v, err
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return &v, err
+}
+
+// newOptionSpec parses the tags of the options struct, a bad tag is a bug
+// of the stream type so it panics.
+func newOptionSpec(t reflect.Type) *optionSpec {
+	if t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("options of %v should be a struct", t))
+	}
+	spec := &optionSpec{typ: t}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Tag.Get("yaml") == "-" {
+			continue
+		}
+		of := &optionField{
+			index:    i,
+			name:     optionName(f),
+			def:      f.Tag.Get("default"),
+			required: f.Tag.Get("required") == "true",
+			secret:   f.Tag.Get("secret") == "true",
+		}
+		var err error
+		if arg := f.Tag.Get("arg"); arg != "" {
+			if of.arg, err = strconv.Atoi(arg); err != nil || of.arg < 1 {
+				panic(fmt.Sprintf("%v.%v: bad arg: %v", t, f.Name, arg))
+			}
+		}
+		if of.min, err = parseBound(f.Type, f.Tag.Get("min")); err != nil {
+			panic(fmt.Sprintf("%v.%v: bad min: %v", t, f.Name, err))
+		}
+		if of.max, err = parseBound(f.Type, f.Tag.Get("max")); err != nil {
+			panic(fmt.Sprintf("%v.%v: bad max: %v", t, f.Name, err))
+		}
+		if enum := f.Tag.Get("enum"); enum != "" {
+			of.enum = strings.Split(enum, ",")
+		}
+		if of.def != "" {
+			if err = yaml.Unmarshal([]byte(of.def), reflect.New(f.Type).Interface()); err != nil {
+				panic(fmt.Sprintf("%v.%v: bad default: %v", t, f.Name, err))
+			}
+		}
+		spec.fields = append(spec.fields, of)
+	}
+	return spec
+}
+
+func (spec *optionSpec) field(name string) *optionField {
+	for _, f := range spec.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func isCommonOption(kind Kind, name string) bool {
+	for _, key := range common_options[kind] {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// numeric value of a field for the range checks
+func numeric(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+func (f *optionField) check(v reflect.Value) error {
+	if x, ok := numeric(v); ok {
+		format := func(b float64) string {
+			if v.Type() == reflect.TypeOf(time.Duration(0)) {
+				return time.Duration(b).String()
+			}
+			return strconv.FormatFloat(b, 'g', -1, 64)
+		}
+		if (f.min != nil && x < *f.min) || (f.max != nil && x > *f.max) {
+			lo, hi := "", ""
+			if f.min != nil {
+				lo = format(*f.min)
+			}
+			if f.max != nil {
+				hi = format(*f.max)
+			}
+			return fmt.Errorf("%v is out of range [%v, %v]", format(x), lo, hi)
+		}
+	}
+	// an empty string is an unset optional value
+	if len(f.enum) > 0 && v.Kind() == reflect.String && (v.String() != "" || f.required) {
+		for _, e := range f.enum {
+			if v.String() == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid value %q, should be one of %v", v.String(), strings.Join(f.enum, ", "))
+	}
+	return nil
+}
+
+// typeErrorMessage drops the `yaml: unmarshal errors: line N:` decoration,
+// the position is already in the OptionError.
+func typeErrorMessage(err error) error {
+	var te *yaml.TypeError
+	if !errors.As(err, &te) || len(te.Errors) == 0 {
+		return err
+	}
+	msg := te.Errors[0]
+	if _, rest, ok := strings.Cut(msg, ": "); ok && strings.HasPrefix(msg, "line ") {
+		msg = rest
+	}
+	return errors.New(msg)
+}
+
+var errUnknownOption = errors.New("unknown option")
+
+// decode fills a new options struct from the stage node: defaults first,
+// then the keys of the node, then the checks. It returns the first error.
+func (spec *optionSpec) decode(kind Kind, node *yaml.Node) (reflect.Value, error) {
+	v, errs := spec.decodeAll(kind, node)
+	if len(errs) > 0 {
+		return v, errs[0]
+	}
+	return v, nil
+}
+
+// decodeAll is decode going on after an error, for the diagnostics.
+func (spec *optionSpec) decodeAll(kind Kind, node *yaml.Node) (reflect.Value, []*OptionError) {
+	v := reflect.New(spec.typ)
+	if node.Kind != yaml.MappingNode {
+		return v, []*OptionError{{Line: node.Line, Column: node.Column,
+			Err: fmt.Errorf("%v should be a map", kind)}}
+	}
+	for _, f := range spec.fields {
+		if f.def != "" {
+			yaml.Unmarshal([]byte(f.def), v.Elem().Field(f.index).Addr().Interface())
+		}
+	}
+
+	var errs []*OptionError
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		f := spec.field(key.Value)
+		if f == nil {
+			if !isCommonOption(kind, key.Value) {
+				errs = append(errs, &OptionError{Option: key.Value, Line: key.Line, Column: key.Column,
+					Err: errUnknownOption})
+			}
+			continue
+		}
+		seen[f.name] = true
+		fv := v.Elem().Field(f.index)
+		if err := value.Decode(fv.Addr().Interface()); err != nil {
+			errs = append(errs, &OptionError{Option: f.name, Line: value.Line, Column: value.Column,
+				Err: typeErrorMessage(err)})
+			continue
+		}
+		if f.secret && fv.Kind() == reflect.String {
+			addSecret(fv.String())
+		}
+		if err := f.check(fv); err != nil {
+			errs = append(errs, &OptionError{Option: f.name, Line: value.Line, Column: value.Column, Err: err})
+		}
+	}
+
+	for _, f := range spec.fields {
+		if f.required && !seen[f.name] {
+			errs = append(errs, &OptionError{Option: f.name, Line: node.Line, Column: node.Column,
+				Err: errors.New("is missing")})
+		}
+	}
+	if len(errs) > 0 {
+		return v, errs
+	}
+	if vd, ok := v.Interface().(interface{ Validate() error }); ok {
+		if err := vd.Validate(); err != nil {
+			return v, []*OptionError{{Line: node.Line, Column: node.Column, Err: err}}
+		}
+	}
+	return v, nil
+}
+
+// names of the options of the type, for the suggestions
+func (spec *optionSpec) names(kind Kind) []string {
+	names := append([]string{}, common_options[kind]...)
+	for _, f := range spec.fields {
+		names = append(names, f.name)
+	}
+	return names
+}
+
+func specOf[O any]() *optionSpec {
+	return newOptionSpec(reflect.TypeOf((*O)(nil)).Elem())
+}
+
+// openingUser is implemented by the options of the types that open other
+// stages, like cat and tee: they get how they are opened.
+type openingUser interface {
+	setOpening(op opening)
+}
+
+// decodeOptions decodes the options of a stage into O, for the functions
+// that get the node, like the resume ones.
+func decodeOptions[O any](kind Kind, node *yaml.Node) (*O, error) {
+	v, err := specOf[O]().decode(kind, node)
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface().(*O), nil
+}
+
+func decodeFor[O any](op opening, spec *optionSpec, kind Kind, name string, node *yaml.Node) (*O, error) {
+	check_type(node, name)
+	v, err := spec.decode(kind, node)
+	if err != nil {
+		return nil, err
+	}
+	opts := v.Interface().(*O)
+	if u, ok := any(opts).(openingUser); ok {
+		u.setOpening(op)
+	}
+	return opts, nil
+}
+
+// AddInput registers in reg an input type whose options are decoded into O.
+func AddInput[O any](reg *Registry, name string, fn func(opts *O) (io.ReadCloser, error)) error {
+	spec := specOf[O]()
+	return reg.add(KindInput, name, inputOpener(func(op opening, node *yaml.Node) (io.ReadCloser, error) {
+		opts, err := decodeFor[O](op, spec, KindInput, name, node)
+		if err != nil {
+			return nil, err
+		}
+		return fn(opts)
+	}), spec)
+}
+
+// AddOutput registers in reg an output type whose options are decoded into O.
+func AddOutput[O any](reg *Registry, name string, fn func(opts *O) (io.WriteCloser, error)) error {
+	spec := specOf[O]()
+	return reg.add(KindOutput, name, outputOpener(func(op opening, node *yaml.Node) (io.WriteCloser, error) {
+		opts, err := decodeFor[O](op, spec, KindOutput, name, node)
+		if err != nil {
+			return nil, err
+		}
+		return fn(opts)
+	}), spec)
+}
+
+// AddDecoder registers in reg a decoder type whose options are decoded into O.
+func AddDecoder[O any](reg *Registry, name string, fn func(opts *O, r io.ReadCloser) (io.ReadCloser, error)) error {
+	spec := specOf[O]()
+	return reg.add(KindDecoder, name, decoderOpener(func(r *Registry, node *yaml.Node, rc io.ReadCloser) (io.ReadCloser, error) {
+		opts, err := decodeFor[O](opening{reg: r}, spec, KindDecoder, name, node)
+		if err != nil {
+			return nil, err
+		}
+		return fn(opts, rc)
+	}), spec)
+}
+
+// AddEncoder registers in reg an encoder type whose options are decoded into O.
+func AddEncoder[O any](reg *Registry, name string, fn func(opts *O, w io.WriteCloser) (io.WriteCloser, error)) error {
+	spec := specOf[O]()
+	return reg.add(KindEncoder, name, encoderOpener(func(r *Registry, node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error) {
+		opts, err := decodeFor[O](opening{reg: r}, spec, KindEncoder, name, node)
+		if err != nil {
+			return nil, err
+		}
+		return fn(opts, w)
+	}), spec)
+}
+
+// RegisterInput is AddInput to DefaultRegistry, it panics if the name is taken.
+func RegisterInput[O any](name string, fn func(opts *O) (io.ReadCloser, error)) {
+	must(AddInput(DefaultRegistry, name, fn))
+}
+
+// RegisterOutput is AddOutput to DefaultRegistry, it panics if the name is taken.
+func RegisterOutput[O any](name string, fn func(opts *O) (io.WriteCloser, error)) {
+	must(AddOutput(DefaultRegistry, name, fn))
+}
+
+// RegisterDecoder is AddDecoder to DefaultRegistry, it panics if the name is taken.
+func RegisterDecoder[O any](name string, fn func(opts *O, r io.ReadCloser) (io.ReadCloser, error)) {
+	must(AddDecoder(DefaultRegistry, name, fn))
+}
+
+// RegisterEncoder is AddEncoder to DefaultRegistry, it panics if the name is taken.
+func RegisterEncoder[O any](name string, fn func(opts *O, w io.WriteCloser) (io.WriteCloser, error)) {
+	must(AddEncoder(DefaultRegistry, name, fn))
+}
+
+// NoOptions is the options of a type that has none, only the common keys
+// are accepted.
+type NoOptions struct{}
+
+// Options are the options of a stage for the types registered with the
+// Options functions, like RegisterInputOptions. They don't depend on the
+// format of the config.
+type Options interface {
+	// Type is the `type` of the stage.
+	Type() string
+	// Keys are the options set in the config, in order, `type` excepted.
+	Keys() []string
+	// Get decodes the option key into v, ok is false if it isn't set.
+	Get(key string, v any) (ok bool, err error)
+	// Decode decodes the options into the struct v, the `yaml` tag of a
+	// field names its option.
+	Decode(v any) error
+}
+
+type nodeOptions struct {
+	node *yaml.Node
+}
+
+func (o nodeOptions) Type() string {
+	typ, _ := getElementType(o.node)
+	return typ
+}
+
+func (o nodeOptions) Keys() []string {
+	var keys []string
+	for i := 0; i+1 < len(o.node.Content); i += 2 {
+		if key := o.node.Content[i].Value; key != "type" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (o nodeOptions) Get(key string, v any) (bool, error) {
+	i := getChildByTag(o.node, key)
+	if i < 0 || i+1 >= len(o.node.Content) {
+		return false, nil
+	}
+	value := o.node.Content[i+1]
+	if err := value.Decode(v); err != nil {
+		return true, &OptionError{Option: key, Line: value.Line, Column: value.Column,
+			Err: typeErrorMessage(err)}
+	}
+	return true, nil
+}
+
+func (o nodeOptions) Decode(v any) error {
+	if err := o.node.Decode(v); err != nil {
+		return &OptionError{Line: o.node.Line, Column: o.node.Column, Err: typeErrorMessage(err)}
+	}
+	return nil
+}
+
+func (reg *Registry) RegisterInputOptions(name string, fn func(opts Options) (io.ReadCloser, error)) error {
+	return reg.RegisterInputStream(name, func(node *yaml.Node) (io.ReadCloser, error) {
+		return fn(nodeOptions{node})
+	})
+}
+
+func (reg *Registry) RegisterOutputOptions(name string, fn func(opts Options) (io.WriteCloser, error)) error {
+	return reg.RegisterOutputStream(name, func(node *yaml.Node) (io.WriteCloser, error) {
+		return fn(nodeOptions{node})
+	})
+}
+
+func (reg *Registry) RegisterDecoderOptions(name string, fn func(opts Options, r io.ReadCloser) (io.ReadCloser, error)) error {
+	return reg.RegisterDecoderStream(name, func(node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error) {
+		return fn(nodeOptions{node}, r)
+	})
+}
+
+func (reg *Registry) RegisterEncoderOptions(name string, fn func(opts Options, w io.WriteCloser) (io.WriteCloser, error)) error {
+	return reg.RegisterEncoderStream(name, func(node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error) {
+		return fn(nodeOptions{node}, w)
+	})
+}
+
+// RegisterInputOptions registers in DefaultRegistry an input type that
+// reads its options itself, it panics if the name is taken.
+func RegisterInputOptions(name string, fn func(opts Options) (io.ReadCloser, error)) {
+	must(DefaultRegistry.RegisterInputOptions(name, fn))
+}
+
+func RegisterOutputOptions(name string, fn func(opts Options) (io.WriteCloser, error)) {
+	must(DefaultRegistry.RegisterOutputOptions(name, fn))
+}
+
+func RegisterDecoderOptions(name string, fn func(opts Options, r io.ReadCloser) (io.ReadCloser, error)) {
+	must(DefaultRegistry.RegisterDecoderOptions(name, fn))
+}
+
+func RegisterEncoderOptions(name string, fn func(opts Options, w io.WriteCloser) (io.WriteCloser, error)) {
+	must(DefaultRegistry.RegisterEncoderOptions(name, fn))
+}
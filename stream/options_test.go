@@ -0,0 +1,120 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOptionsLevel(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := testData(1 << 18)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := make(map[int]int64)
+	for _, level := range []int{0, 9} {
+		dst := filepath.Join(dir, fmt.Sprint(level))
+		s, err := NewStream(strings.NewReader(fmt.Sprintf(`
+input: {type: local, name: %v}
+encoder:
+  - type: gzip
+    level: %v
+output: {type: local, name: %v}
+`, src, level, dst)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.Copy(); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		fi, _ := os.Stat(dst)
+		sizes[level] = fi.Size()
+	}
+	// level 0 stores the data
+	if sizes[0] <= int64(len(data)) || sizes[9] >= sizes[0] {
+		t.Errorf("level is ignored: %v", sizes)
+	}
+}
+
+func TestOptionsLZW(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := testData(1 << 16)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	run := func(config string) {
+		s, err := NewStream(strings.NewReader(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Copy()
+		if err = errors.Join(err, s.Close()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(fmt.Sprintf(`
+input: {type: local, name: %v}
+encoder: [{type: lzw, order: MSB, litwidth: 8}]
+output: {type: local, name: %v/packed}
+`, src, dir))
+	run(fmt.Sprintf(`
+input: {type: local, name: %v/packed}
+decoder: [{type: lzw, order: MSB}]
+output: {type: local, name: %v/unpacked}
+`, dir, dir))
+	if got, err := os.ReadFile(filepath.Join(dir, "unpacked")); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("lzw MSB: %v bytes, %v", len(got), err)
+	}
+}
+
+func TestOptionsErrors(t *testing.T) {
+	for _, c := range []struct {
+		config string
+		want   string
+	}{
+		{"input: {type: stdin}\nencoder:\n  - type: gzip\n    level: 12\noutput: {type: stdout}\n",
+			"line 4, column 12: `level`: 12 is out of range [-2, 9]"},
+		{"input: {type: stdin}\nencoder:\n  - type: zlib\n    levle: 1\noutput: {type: stdout}\n",
+			"line 4, column 5: `levle`: unknown option"},
+		{"input: {type: stdin}\nencoder:\n  - {type: flate, level: high}\noutput: {type: stdout}\n",
+			"line 3, column 26: `level`: cannot unmarshal !!str `high` into int"},
+		{"input: {type: local, nme: x}\noutput: {type: stdout}\n",
+			"line 1, column 22: `nme`: unknown option"},
+		{"input: {type: stdin}\noutput:\n  type: local\n",
+			"line 3, column 3: `name`: is missing"},
+		{"input: {type: stdin}\noutput: {type: tcp, port: 1, role: both}\n",
+			"`role`: invalid value \"both\", should be one of server, client"},
+		{"input: {type: stdin}\noutput: {type: tcp, port: 1, role: server}\n",
+			"line 2, column 9: `role` server is not supported"},
+		{"input: {type: stdin}\ndecoder: [{type: lzw, litwidth: 9}]\noutput: {type: stdout}\n",
+			"`litwidth`: 9 is out of range [2, 8]"},
+		{"input: {type: cat, child: []}\noutput: {type: stdout}\n",
+			"`child` needs a non-empty list"},
+	} {
+		_, err := NewPlan(strings.NewReader(c.config))
+		var oe *OptionError
+		if !errors.As(err, &oe) || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("NewPlan(%q):\n got %v\nwant %v", c.config, err, c.want)
+		}
+	}
+
+	// the keys every stage has
+	if _, err := NewPlan(strings.NewReader(`
+input: {type: local, name: a, retry: {attempts: 2}}
+encoder: [{type: gzip, buffer: {size: 1024}}]
+output: {type: stdout}
+`)); err != nil {
+		t.Errorf("common options: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Concurrent syntax:
+// concurrent: true
+// buffer:            # default for every stage
+//   size: 65536      # bytes per chunk
+//   depth: 4         # chunks in flight
+// decoder:
+//   - type: gzip
+//     buffer:        # buffer feeding this decoder
+//       depth: 8
+// encoder:
+//   - type: zlib
+//     buffer:        # buffer draining this encoder
+//       size: 1048576
+//
+// In concurrent mode every decoder and encoder runs in its own goroutine.
+// Adjacent stages are linked by a bufferPipe, so at most size*depth bytes
+// are queued between two stages.
+
+const (
+	defaultBufferSize  = 32 * 1024
+	defaultBufferDepth = 4
+)
+
+var errPipeClosed = errors.New("stream: read/write on closed pipe")
+
+type bufferConfig struct {
+	Size  int
+	Depth int
+}
+
+// merge fills the unset fields of bc from def.
+func (bc bufferConfig) merge(def bufferConfig) bufferConfig {
+	if bc.Size <= 0 {
+		bc.Size = def.Size
+	}
+	if bc.Depth <= 0 {
+		bc.Depth = def.Depth
+	}
+	return bc
+}
+
+// bufferPipe is a bounded, chunked in-memory pipe. There must be a single
+// writer goroutine, the reader side may be closed from any goroutine.
+type bufferPipe struct {
+	size  int
+	depth int
+
+	data chan []byte // filled chunks
+	free chan []byte // recycled chunks
+	nbuf int         // chunks allocated, owned by the writer
+
+	cur []byte // unread part of the current chunk, owned by the reader
+	buf []byte // the current chunk
+
+	rdone chan struct{} // closed when the reader side is closed
+	ronce sync.Once
+	rerr  error // reported to the writer
+
+	wonce sync.Once
+	werr  error // reported to the reader after the data is drained
+
+	amu    sync.Mutex
+	abort  chan struct{} // closed by abortWrite, see blocked
+	aerr   error
+	closed bool
+}
+
+func newBufferPipe(bc bufferConfig) *bufferPipe {
+	bc = bc.merge(bufferConfig{Size: defaultBufferSize, Depth: defaultBufferDepth})
+	return &bufferPipe{
+		size:  bc.Size,
+		depth: bc.Depth,
+		data:  make(chan []byte, bc.Depth),
+		free:  make(chan []byte, bc.Depth),
+		rdone: make(chan struct{}),
+		abort: make(chan struct{}),
+	}
+}
+
+// blocked is the channel and the error of abortWrite, for a write that would
+// block.
+func (p *bufferPipe) blocked() (<-chan struct{}, error) {
+	p.amu.Lock()
+	defer p.amu.Unlock()
+	return p.abort, p.aerr
+}
+
+// abortWrite fails the writes that would block on a full pipe with err,
+// until resumeWrite. Unlike CloseRead, the queued chunks are still read.
+func (p *bufferPipe) abortWrite(err error) {
+	p.amu.Lock()
+	defer p.amu.Unlock()
+	if !p.closed {
+		p.aerr, p.closed = err, true
+		close(p.abort)
+	}
+}
+
+func (p *bufferPipe) resumeWrite() {
+	p.amu.Lock()
+	defer p.amu.Unlock()
+	if p.closed {
+		p.abort, p.aerr, p.closed = make(chan struct{}), nil, false
+	}
+}
+
+func (p *bufferPipe) chunk() ([]byte, error) {
+	select {
+	case b := <-p.free:
+		return b, nil
+	case <-p.rdone:
+		return nil, p.rerr
+	default:
+	}
+	if p.nbuf < p.depth {
+		p.nbuf++
+		return make([]byte, p.size), nil
+	}
+	abort, aerr := p.blocked()
+	select {
+	case b := <-p.free:
+		return b, nil
+	case <-p.rdone:
+		return nil, p.rerr
+	case <-abort:
+		return nil, aerr
+	}
+}
+
+func (p *bufferPipe) Write(b []byte) (int, error) {
+	nw := 0
+	for len(b) > 0 {
+		buf, err := p.chunk()
+		if err != nil {
+			return nw, err
+		}
+		n := copy(buf[:cap(buf)], b)
+		select {
+		case p.data <- buf[:n]:
+		default:
+			abort, aerr := p.blocked()
+			select {
+			case p.data <- buf[:n]:
+			case <-p.rdone:
+				return nw, p.rerr
+			case <-abort:
+				p.free <- buf
+				return nw, aerr
+			}
+		}
+		nw += n
+		b = b[n:]
+	}
+	return nw, nil
+}
+
+func (p *bufferPipe) Read(b []byte) (int, error) {
+	if len(p.cur) == 0 {
+		select {
+		case <-p.rdone:
+			return 0, p.rerr
+		default:
+		}
+		select {
+		case buf, ok := <-p.data:
+			if !ok {
+				return 0, p.werr
+			}
+			p.cur, p.buf = buf, buf
+		case <-p.rdone:
+			return 0, p.rerr
+		}
+	}
+	n := copy(b, p.cur)
+	if p.cur = p.cur[n:]; len(p.cur) == 0 {
+		p.free <- p.buf[:cap(p.buf)]
+		p.buf = nil
+	}
+	return n, nil
+}
+
+// CloseWrite marks the end of data, the reader gets err (io.EOF if nil)
+// once the queued chunks are consumed. Only the writer goroutine may call it.
+func (p *bufferPipe) CloseWrite(err error) {
+	p.wonce.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+		p.werr = err
+		close(p.data)
+	})
+}
+
+// CloseRead discards the queued chunks and fails pending and later writes
+// with err (errPipeClosed if nil).
+func (p *bufferPipe) CloseRead(err error) {
+	p.ronce.Do(func() {
+		if err == nil {
+			err = errPipeClosed
+		}
+		p.rerr = err
+		close(p.rdone)
+	})
+}
+
+// pump moves bytes across a bufferPipe in its own goroutine.
+//
+// A reader pump copies src into the pipe, the next decoder reads the pipe.
+// A writer pump copies the pipe into dst, the previous encoder writes the pipe.
+type pump struct {
+	pipe *bufferPipe
+	done chan struct{}
+	err  error
+}
+
+func (p *pump) wait() error {
+	<-p.done
+	return p.err
+}
+
+// pumpReader is the read end handed to a decoder in concurrent mode.
+type pumpReader struct {
+	pump
+}
+
+func newPumpReader(src io.Reader, bc bufferConfig) *pumpReader {
+	pr := &pumpReader{pump{pipe: newBufferPipe(bc), done: make(chan struct{})}}
+	go func() {
+		defer close(pr.done)
+		_, err := io.Copy(pr.pipe, src)
+		pr.err = err
+		pr.pipe.CloseWrite(err)
+	}()
+	return pr
+}
+
+func (pr *pumpReader) Read(b []byte) (int, error) {
+	return pr.pipe.Read(b)
+}
+
+// Close stops the pump at its next write, it doesn't close src.
+func (pr *pumpReader) Close() error {
+	pr.pipe.CloseRead(nil)
+	return nil
+}
+
+// pumpWriter is the write end handed to an encoder in concurrent mode.
+type pumpWriter struct {
+	pump
+	dst     io.Writer
+	timeout atomic.Int64 // of a write into dst, see setWriteTimeout
+}
+
+func newPumpWriter(dst io.Writer, bc bufferConfig) *pumpWriter {
+	pw := &pumpWriter{pump: pump{pipe: newBufferPipe(bc), done: make(chan struct{})}, dst: dst}
+	go func() {
+		defer close(pw.done)
+		if _, err := io.Copy(timeoutWriter{pw}, pw.pipe); err != nil {
+			pw.err = err
+			pw.pipe.CloseRead(err)
+		}
+	}()
+	return pw
+}
+
+// setWriteTimeout fails a write into dst that doesn't complete within d,
+// the pending one too. The writes that make progress go on.
+func (pw *pumpWriter) setWriteTimeout(d time.Duration) {
+	pw.timeout.Store(int64(d))
+	setWriteDeadline(pw.dst, time.Now().Add(d))
+}
+
+// timeoutWriter is the dst of a pump, with the timeout of the pump.
+type timeoutWriter struct {
+	pw *pumpWriter
+}
+
+func (tw timeoutWriter) Write(b []byte) (int, error) {
+	if d := tw.pw.timeout.Load(); d > 0 {
+		setWriteDeadline(tw.pw.dst, time.Now().Add(time.Duration(d)))
+	}
+	return tw.pw.dst.Write(b)
+}
+
+func (pw *pumpWriter) Write(b []byte) (int, error) {
+	return pw.pipe.Write(b)
+}
+
+// Close flushes the queued chunks to dst and reports the pump error,
+// it doesn't close dst.
+func (pw *pumpWriter) Close() error {
+	pw.pipe.CloseWrite(nil)
+	return pw.wait()
+}
@@ -0,0 +1,223 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func testData(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "line %d: stream_cast pipeline test data\n", i)
+	}
+	return buf.Bytes()[:n]
+}
+
+func copyConfig(t *testing.T, config string) {
+	s, err := NewStream(strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("NewStream: %v", err)
+	}
+	if _, err = s.Copy(); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestBufferPipe(t *testing.T) {
+	data := testData(10000)
+	p := newBufferPipe(bufferConfig{Size: 7, Depth: 2})
+	go func() {
+		_, err := p.Write(data)
+		p.CloseWrite(err)
+	}()
+	got, err := io.ReadAll(p)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("pipe corrupted data")
+	}
+
+	p = newBufferPipe(bufferConfig{Size: 7, Depth: 2})
+	e := errors.New("reader gone")
+	p.CloseRead(e)
+	if _, err = p.Write(data); err != e {
+		t.Errorf("Write after CloseRead: %v", err)
+	}
+}
+
+func TestConcurrentRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	packed := filepath.Join(dir, "packed")
+	dst := filepath.Join(dir, "dst")
+	data := testData(1 << 20)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	copyConfig(t, fmt.Sprintf(`
+concurrent: true
+buffer:
+  size: 4096
+  depth: 2
+input:
+  type: local
+  name: %v
+encoder:
+  - type: zlib
+  - type: gzip
+    buffer:
+      size: 100
+output:
+  type: local
+  name: %v
+`, src, packed))
+
+	copyConfig(t, fmt.Sprintf(`
+concurrent: true
+input:
+  type: local
+  name: %v
+decoder:
+  - type: zlib
+  - type: gzip
+    buffer:
+      depth: 1
+output:
+  type: local
+  name: %v
+`, packed, dst))
+
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("round trip mismatch: %v bytes, want %v", len(got), len(data))
+	}
+}
+
+type failingWriter struct {
+	after int
+}
+
+func (fw *failingWriter) Write(b []byte) (int, error) {
+	if fw.after -= len(b); fw.after < 0 {
+		return 0, errors.New("disk full")
+	}
+	return len(b), nil
+}
+
+func (fw *failingWriter) Close() error { return nil }
+
+func TestConcurrentWriteError(t *testing.T) {
+	RegisterOutputStream("failing", func(node *yaml.Node) (io.WriteCloser, error) {
+		return &failingWriter{after: 1000}, nil
+	})
+	defer DefaultRegistry.Unregister(KindOutput, "failing")
+
+	// incompressible, so flate keeps writing
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStream(strings.NewReader(fmt.Sprintf(`
+concurrent: true
+input:
+  type: local
+  name: %v
+encoder:
+  - type: flate
+output:
+  type: failing
+`, src)))
+	if err != nil {
+		t.Fatalf("NewStream: %v", err)
+	}
+	if _, err = s.Copy(); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("Copy: got %v, want disk full", err)
+	}
+	if err = s.Close(); err == nil {
+		t.Errorf("Close: want the pump error")
+	}
+}
+
+// probeReader records a Close while a Read is in progress
+type probeReader struct {
+	io.ReadCloser
+	reading, closedInRead atomic.Bool
+}
+
+func (pr *probeReader) Read(b []byte) (int, error) {
+	pr.reading.Store(true)
+	defer pr.reading.Store(false)
+	return pr.ReadCloser.Read(b)
+}
+
+func (pr *probeReader) Close() error {
+	if pr.reading.Load() {
+		pr.closedInRead.Store(true)
+	}
+	return nil
+}
+
+func TestConcurrentCloseIdle(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	idle := make(chan struct{})
+	defer close(idle)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-idle
+	}()
+
+	var probes []*probeReader
+	reg := DefaultRegistry.Clone()
+	reg.RegisterDecoderStream("probe", func(node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error) {
+		pr := &probeReader{ReadCloser: r}
+		probes = append(probes, pr)
+		return pr, nil
+	})
+	s, err := reg.NewStream(strings.NewReader(fmt.Sprintf(`
+concurrent: true
+input: tcp://%v
+decoder: [{type: probe}, {type: probe}]
+output: {type: local, name: %v/dst}
+`, ln.Addr(), t.TempDir())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pump of the second decoder reads the first one
+	for !probes[0].reading.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	s.Close()
+	if probes[0].closedInRead.Load() {
+		t.Errorf("the first decoder was closed while its pump read it")
+	}
+}
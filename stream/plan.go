@@ -0,0 +1,258 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A Plan is a parsed and validated stream config. Building a plan has no
+// side effect: nothing is opened, dialed or truncated until Open.
+
+type Kind string
+
+const (
+	KindInput   Kind = "input"
+	KindDecoder Kind = "decoder"
+	KindEncoder Kind = "encoder"
+	KindOutput  Kind = "output"
+)
+
+// ValidateFunc checks the options of a stream type without opening
+// anything. It's the validation-only path of the matching InputFunc,
+// OutputFunc, DecoderFunc or EncoderFunc.
+type ValidateFunc func(node *yaml.Node) error
+
+func RegisterValidator(kind Kind, name string, fn ValidateFunc) {
+	must(DefaultRegistry.RegisterValidator(kind, name, fn))
+}
+
+// Stage is a validated input, codec or output. Children are the `child`
+// list of composite endpoints like cat and tee.
+type Stage struct {
+	Kind     Kind
+	Type     string
+	Children []*Stage
+	node     *yaml.Node
+}
+
+type Plan struct {
+	Input    *Stage
+	Decoders []*Stage
+	Encoders []*Stage
+	Output   *Stage
+	config   streamConfig
+	reg      *Registry
+
+	checkpoint *checkpoint // set if the config has a checkpoint section
+
+	// the input and output of a Builder, used instead of opening the stages
+	reader io.ReadCloser
+	writer io.WriteCloser
+}
+
+// planStage plans the stage of node, the errors of a stage of another file
+// start with its file and line, see sources.
+func (reg *Registry) planStage(kind Kind, node *yaml.Node, src sources) (*Stage, error) {
+	stage, err := reg.planNode(kind, node, src)
+	return stage, src.wrap(node, err)
+}
+
+func (reg *Registry) planNode(kind Kind, node *yaml.Node, src sources) (*Stage, error) {
+	if err := reg.expandURL(kind, node); err != nil {
+		return nil, fmt.Errorf("line %v: %w", node.Line, err)
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("invalid yaml format: %v should be map, line %v", kind, node.Line)
+	}
+	typ, err := getElementType(node)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", kind, err)
+	}
+	if !reg.registered(kind, typ) {
+		return nil, fmt.Errorf("%v '%v' not found", kind, typ)
+	}
+	if err = expandStage(node); err != nil {
+		return nil, fmt.Errorf("%v '%v': %w", kind, typ, err)
+	}
+	if fn := reg.validator(kind, typ); fn != nil {
+		if err = fn(node); err != nil {
+			return nil, fmt.Errorf("%v '%v': %w", kind, typ, err)
+		}
+	}
+	stage := &Stage{Kind: kind, Type: typ, node: node}
+	if kind == KindInput || kind == KindOutput {
+		if _, err = parseRetry(node); err != nil {
+			return nil, fmt.Errorf("%v '%v': %w", kind, typ, err)
+		}
+		for i, n := range getList(node, "child") {
+			child, err := reg.planStage(kind, n, src)
+			if err != nil {
+				return nil, fmt.Errorf("%v '%v' child[%v]: %w", kind, typ, i, err)
+			}
+			stage.Children = append(stage.Children, child)
+		}
+	}
+	return stage, nil
+}
+
+func (reg *Registry) planList(kind Kind, list []*yaml.Node, src sources) ([]*Stage, error) {
+	var stages []*Stage
+	for i, node := range list {
+		stage, err := reg.planStage(kind, node, src)
+		if err != nil {
+			return nil, fmt.Errorf("%v[%v]: %w", kind, i, err)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+func NewPlan(r io.Reader) (*Plan, error) {
+	return DefaultRegistry.NewPlan(r)
+}
+
+// NewPlan is NewPlan with the types of the registry.
+func (reg *Registry) NewPlan(r io.Reader) (*Plan, error) {
+	node, src, err := loadDocument(r)
+	if err != nil {
+		return nil, err
+	}
+	return reg.newPlan(node, src)
+}
+
+// newPlan validates the mapping that holds input, output, decoder and encoder.
+func (reg *Registry) newPlan(node *yaml.Node, src sources) (*Plan, error) {
+	plan := Plan{reg: reg}
+	if err := node.Decode(&plan.config); err != nil {
+		return nil, err
+	}
+
+	input, err := getInputOuputMap(node, "input")
+	if err != nil {
+		return nil, err
+	}
+	if plan.Input, err = reg.planStage(KindInput, input, src); err != nil {
+		return nil, err
+	}
+	output, err := getInputOuputMap(node, "output")
+	if err != nil {
+		return nil, err
+	}
+	if plan.Output, err = reg.planStage(KindOutput, output, src); err != nil {
+		return nil, err
+	}
+	if plan.Decoders, err = reg.planList(KindDecoder, getList(node, "decoder"), src); err != nil {
+		return nil, err
+	}
+	if plan.Encoders, err = reg.planList(KindEncoder, getList(node, "encoder"), src); err != nil {
+		return nil, err
+	}
+	if plan.config.Checkpoint != nil {
+		if err = plan.checkCheckpoint(node); err != nil {
+			return nil, err
+		}
+	}
+	return &plan, nil
+}
+
+func stageNodes(stages []*Stage) []*yaml.Node {
+	var nodes []*yaml.Node
+	for _, stage := range stages {
+		nodes = append(nodes, stage.node)
+	}
+	return nodes
+}
+
+// ErrAuth is wrapped by the errors of an endpoint that refused the
+// credentials, like a token that doesn't match or an HTTP 401 or 403.
+var ErrAuth = errors.New("authentication failed")
+
+// OpenError reports the stage that failed to open. Everything opened before
+// it has been closed in reverse order, CloseErr holds the errors of that.
+type OpenError struct {
+	Stage    string // input, output, decoder[i], encoder[i] or a graph node
+	Type     string
+	Err      error
+	CloseErr error
+}
+
+func (e *OpenError) Error() string {
+	msg := fmt.Sprintf("open %v '%v': %v", e.Stage, e.Type, e.Err)
+	if e.CloseErr != nil {
+		msg += fmt.Sprintf(" (rollback: %v)", e.CloseErr)
+	}
+	return Redact(msg)
+}
+
+func (e *OpenError) Unwrap() []error {
+	return []error{e.Err, e.CloseErr}
+}
+
+// Open opens the input, the output and the codecs of the plan. On failure
+// the stages opened so far are closed and an *OpenError is returned.
+// may read bytes that will be blocked
+func (p *Plan) Open() (*Stream, error) {
+	return p.OpenContext(context.Background())
+}
+
+// OpenContext is Open, ctx stops the retries of the input and the output.
+func (p *Plan) OpenContext(ctx context.Context) (*Stream, error) {
+	stream := &Stream{
+		concurrent: p.config.Concurrent,
+		buffer:     p.config.Buffer,
+		plan:       p,
+	}
+
+	if p.checkpoint != nil {
+		c := *p.checkpoint
+		stream.checkpoint = &c
+		input, output, oe := stream.openResumed(ctx)
+		if input != nil {
+			stream.input = input
+		}
+		if oe != nil {
+			return nil, stream.rollback(oe)
+		}
+		stream.output = output
+	} else {
+		// input
+		stream.input, stream.output = p.reader, p.writer
+		if stream.input == nil {
+			input, err := p.reg.openInput(ctx, p.Input.Type, p.Input.node, &stream.reconnects)
+			if err != nil {
+				return nil, stream.rollback(&OpenError{Stage: "input", Type: p.Input.Type, Err: err})
+			}
+			stream.input = input
+		}
+
+		// output
+		if stream.output == nil {
+			output, err := p.reg.openOutput(ctx, p.Output.Type, p.Output.node, &stream.reconnects)
+			if err != nil {
+				return nil, stream.rollback(&OpenError{Stage: "output", Type: p.Output.Type, Err: err})
+			}
+			stream.output = output
+		}
+	}
+	// a drain or a cancel stops at a deadline of the input
+	stream.input = withDeadline(stream.input)
+
+	// decoder
+	if err := stream.parseDecoder(stageNodes(p.Decoders)); err != nil {
+		i := len(stream.decoder)
+		return nil, stream.rollback(&OpenError{
+			Stage: fmt.Sprintf("decoder[%v]", i), Type: p.Decoders[i].Type, Err: err})
+	}
+
+	// encoder
+	if err := stream.parseEncoder(stageNodes(p.Encoders)); err != nil {
+		i := len(stream.encoder)
+		return nil, stream.rollback(&OpenError{
+			Stage: fmt.Sprintf("encoder[%v]", i), Type: p.Encoders[i].Type, Err: err})
+	}
+	return stream, nil
+}
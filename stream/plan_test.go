@@ -0,0 +1,179 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPlanNoSideEffect(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, name := range []string{src, dst} {
+		if err := os.WriteFile(name, []byte("keep me"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan, err := NewPlan(strings.NewReader(fmt.Sprintf(`
+input:
+  type: local
+  name: %v
+encoder:
+  - type: gzip
+output:
+  type: tee
+  child:
+    - type: local
+      name: %v
+    - type: tcp
+      host: 127.0.0.1
+      port: 1
+`, src, dst)))
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != "keep me" {
+		t.Errorf("NewPlan touched the output: %q", b)
+	}
+	if plan.Input.Type != "local" || len(plan.Encoders) != 1 || plan.Encoders[0].Type != "gzip" {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+	if out := plan.Output; out.Type != "tee" || len(out.Children) != 2 || out.Children[1].Type != "tcp" {
+		t.Errorf("unexpected output: %+v", out)
+	}
+
+	for _, config := range []string{
+		"input: {type: stdin}\noutput: {type: stdout}\ndecoder:\n  - type: nope\n",
+		"input: {type: local}\noutput: {type: stdout}\n",
+		"input: {type: stdin}\noutput: {type: tcp, host: localhost}\n",
+		"input: {type: stdin}\noutput: {type: tcp, port: 1, role: both}\n",
+		"input: {type: cat}\noutput: {type: stdout}\n",
+		"input: {type: cat, child: [{type: local}]}\noutput: {type: stdout}\n",
+		"input: {type: stdin}\n",
+	} {
+		if _, err := NewPlan(strings.NewReader(config)); err == nil {
+			t.Errorf("NewPlan(%q): want error", config)
+		}
+	}
+}
+
+type probe struct {
+	name   string
+	closed *[]string
+	w      io.Writer // of an encoder, written on Close
+}
+
+func (p *probe) Read(b []byte) (int, error) { return 0, io.EOF }
+func (p *probe) Write(b []byte) (int, error) {
+	if p.name == "output" {
+		*p.closed = append(*p.closed, "written")
+	}
+	return len(b), nil
+}
+func (p *probe) Close() error {
+	if p.w != nil {
+		// a trailer
+		p.w.Write([]byte("end"))
+	}
+	*p.closed = append(*p.closed, p.name)
+	return nil
+}
+
+func TestOpenRollback(t *testing.T) {
+	var closed []string
+	RegisterInputStream("probe", func(node *yaml.Node) (io.ReadCloser, error) {
+		return &probe{name: "input", closed: &closed}, nil
+	})
+	RegisterOutputStream("probe", func(node *yaml.Node) (io.WriteCloser, error) {
+		return &probe{name: "output", closed: &closed}, nil
+	})
+	RegisterDecoderStream("probe", func(node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error) {
+		return &probe{name: "decoder", closed: &closed}, nil
+	})
+	RegisterDecoderStream("broken", func(node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error) {
+		return nil, errors.New("bad header")
+	})
+	RegisterEncoderStream("probe", func(node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error) {
+		return &probe{name: "encoder", closed: &closed, w: w}, nil
+	})
+	RegisterEncoderStream("broken", func(node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error) {
+		return nil, errors.New("bad level")
+	})
+	defer func() {
+		DefaultRegistry.Unregister(KindInput, "probe")
+		DefaultRegistry.Unregister(KindOutput, "probe")
+		DefaultRegistry.Unregister(KindDecoder, "probe")
+		DefaultRegistry.Unregister(KindDecoder, "broken")
+		DefaultRegistry.Unregister(KindEncoder, "probe")
+		DefaultRegistry.Unregister(KindEncoder, "broken")
+	}()
+
+	for _, concurrent := range []bool{false, true} {
+		closed = nil
+		_, err := NewStream(strings.NewReader(fmt.Sprintf(`
+concurrent: %v
+input: {type: probe}
+decoder:
+  - type: probe
+  - type: broken
+output: {type: probe}
+`, concurrent)))
+		var oe *OpenError
+		if !errors.As(err, &oe) || oe.Stage != "decoder[1]" || oe.Type != "broken" {
+			t.Fatalf("got %v, want an OpenError of decoder[1]", err)
+		}
+		if got := strings.Join(closed, ","); got != "output,decoder,input" {
+			t.Errorf("concurrent=%v: closed %v", concurrent, got)
+		}
+
+		// the trailer of an encoder isn't written to the abandoned output
+		closed = nil
+		_, err = NewStream(strings.NewReader(fmt.Sprintf(`
+concurrent: %v
+input: {type: probe}
+encoder:
+  - type: probe
+  - type: broken
+output: {type: probe}
+`, concurrent)))
+		if !errors.As(err, &oe) || oe.Stage != "encoder[1]" {
+			t.Fatalf("got %v, want an OpenError of encoder[1]", err)
+		}
+		if got := strings.Join(closed, ","); got != "output,encoder,input" {
+			t.Errorf("concurrent=%v: closed %v", concurrent, got)
+		}
+	}
+
+	closed = nil
+	g, err := LoadGraph(strings.NewReader(`
+graph:
+  - id: in
+    input: {type: probe}
+  - id: out
+    output: {type: probe}
+    from: in
+  - id: bad
+    output: {type: local, name: /nonexistent/dir/file}
+    from: in
+`))
+	if err != nil {
+		t.Fatalf("LoadGraph: %v", err)
+	}
+	_, err = g.Run(context.Background())
+	var oe *OpenError
+	if !errors.As(err, &oe) || oe.Stage != "output 'bad'" {
+		t.Fatalf("graph: got %v, want an OpenError of output 'bad'", err)
+	}
+	if got := strings.Join(closed, ","); got != "output,input" {
+		t.Errorf("graph: closed %v", got)
+	}
+}
@@ -0,0 +1,190 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A plugin is a codec type run by a command, declared by a manifest in a
+// plugins directory, any format of config (see format.go):
+//
+// # plugins/zstd.yaml
+// name: zstd
+// description: Zstandard, by the zstd command
+// decoder:
+//   command: zstd           # in the directory of the manifest, or in PATH
+//   args: [-d, -c, -q]
+// encoder:
+//   command: zstd
+//   args: [-c, -q]
+//
+// The decoder and the encoder take the options of exec. A stage of the
+// type appends its `args` and adds its `env`:
+//
+// encoder:
+//   - type: zstd
+//     args: [-19]
+
+// PluginOptions are the options of the stages of a plugin type.
+type PluginOptions struct {
+	Args []string          `yaml:"args" desc:"appended to the args of the manifest"`
+	Env  map[string]string `yaml:"env" desc:"added to the env of the manifest"`
+}
+
+// with returns the exec options of a stage.
+func (opts *PluginOptions) with(base *ExecOptions) *ExecOptions {
+	eo := *base
+	eo.Args = append(append([]string{}, base.Args...), opts.Args...)
+	eo.Env = make(map[string]string)
+	for k, v := range base.Env {
+		eo.Env[k] = v
+	}
+	for k, v := range opts.Env {
+		eo.Env[k] = v
+	}
+	return &eo
+}
+
+type pluginManifest struct {
+	Name        string
+	Description string
+	Decoder     *ExecOptions
+	Encoder     *ExecOptions
+}
+
+var manifestKeys = []string{"name", "description", "decoder", "encoder"}
+
+// readManifest reads the manifest of a plugin, the codecs are checked like
+// the options of exec.
+func readManifest(path string) (*pluginManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	root, err := decodeDocument(f, FormatOf(path))
+	if err != nil {
+		return nil, err
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("the manifest should be a map")
+	}
+	m := &pluginManifest{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case "name":
+			m.Name = value.Value
+		case "description":
+			m.Description = value.Value
+		case "decoder", "encoder":
+			opts, err := decodeOptions[ExecOptions](Kind(key.Value), value)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", key.Value, err)
+			}
+			if key.Value == "decoder" {
+				m.Decoder = opts
+			} else {
+				m.Encoder = opts
+			}
+		default:
+			return nil, &OptionError{Option: key.Value, Line: key.Line, Column: key.Column,
+				Err: errUnknownOption}
+		}
+	}
+	if m.Name == "" {
+		return nil, errors.New("`name` is missing")
+	}
+	if m.Decoder == nil && m.Encoder == nil {
+		return nil, errors.New("needs a decoder or an encoder")
+	}
+	// a command next to the manifest
+	for _, opts := range []*ExecOptions{m.Decoder, m.Encoder} {
+		if opts == nil || filepath.IsAbs(opts.Command) {
+			continue
+		}
+		local := filepath.Join(filepath.Dir(path), opts.Command)
+		if fi, err := os.Stat(local); err == nil && !fi.IsDir() {
+			opts.Command, _ = filepath.Abs(local)
+		}
+	}
+	return m, nil
+}
+
+// LoadPlugins registers the plugins of the manifests of dir, the files
+// with a config extension. It returns the names of the plugins it
+// registered, the manifests in error are skipped and reported.
+func (reg *Registry) LoadPlugins(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	var errs []error
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".yaml", ".yml", ".json", ".toml":
+		default:
+			continue
+		}
+		if e.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		m, err := readManifest(path)
+		if err == nil {
+			err = reg.addPlugin(m)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("plugin %v: %w", path, err))
+			continue
+		}
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	return names, errors.Join(errs...)
+}
+
+func (m *pluginManifest) describe(opts *ExecOptions) string {
+	if m.Description != "" {
+		return m.Description
+	}
+	return "plugin, runs " + filepath.Base(opts.Command)
+}
+
+func (reg *Registry) addPlugin(m *pluginManifest) error {
+	if m.Decoder != nil && reg.registered(KindDecoder, m.Name) ||
+		m.Encoder != nil && reg.registered(KindEncoder, m.Name) {
+		return fmt.Errorf("'%v': %w", m.Name, ErrDuplicateType)
+	}
+	if base := m.Decoder; base != nil {
+		err := AddDecoder(reg, m.Name, func(opts *PluginOptions, r io.ReadCloser) (io.ReadCloser, error) {
+			return exec_decoder(opts.with(base), r)
+		})
+		if err != nil {
+			return err
+		}
+		reg.Describe(KindDecoder, m.Name, m.describe(base))
+	}
+	if base := m.Encoder; base != nil {
+		err := AddEncoder(reg, m.Name, func(opts *PluginOptions, w io.WriteCloser) (io.WriteCloser, error) {
+			return exec_encoder(opts.with(base), w)
+		})
+		if err != nil {
+			return err
+		}
+		reg.Describe(KindEncoder, m.Name, m.describe(base))
+	}
+	return nil
+}
+
+// LoadPlugins registers the plugins of dir in DefaultRegistry.
+func LoadPlugins(dir string) ([]string, error) {
+	return DefaultRegistry.LoadPlugins(dir)
+}
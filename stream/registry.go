@@ -0,0 +1,282 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A Registry holds the stream types a config may use. The Register
+// functions of the package fill DefaultRegistry, where the types of this
+// package are. A process can run pipelines restricted to some types with a
+// registry of their own:
+//
+//	reg := stream.DefaultRegistry.Clone()
+//	reg.Unregister(stream.KindInput, "local")
+//	s, err := reg.NewStream(config)
+//
+// A Registry is safe for concurrent use.
+
+var ErrDuplicateType = errors.New("already registered")
+
+// opening is how an input or output is opened: composites like cat and tee
+// open their children from the same registry, with the same context and
+// reconnects counter.
+type opening struct {
+	reg        *Registry
+	ctx        context.Context
+	reconnects *int64 // nil if not counted
+}
+
+type inputOpener func(op opening, node *yaml.Node) (io.ReadCloser, error)
+type outputOpener func(op opening, node *yaml.Node) (io.WriteCloser, error)
+
+// the decoders and encoders get the registry that opens them too
+type decoderOpener func(reg *Registry, node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error)
+type encoderOpener func(reg *Registry, node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error)
+
+type Registry struct {
+	mu           sync.RWMutex
+	inputs       map[string]inputOpener
+	outputs      map[string]outputOpener
+	decoders     map[string]decoderOpener
+	encoders     map[string]encoderOpener
+	validators   map[Kind]map[string]ValidateFunc
+	options      map[Kind]map[string]*optionSpec
+	descriptions map[Kind]map[string]string
+
+	// see checkpoint.go
+	resumeInputs       map[string]ResumeInputFunc
+	resumeOutputs      map[string]ResumeOutputFunc
+	checkpointEncoders map[string]bool
+
+	schemes map[string]SchemeFunc // see url.go
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{
+		inputs:             make(map[string]inputOpener),
+		outputs:            make(map[string]outputOpener),
+		decoders:           make(map[string]decoderOpener),
+		encoders:           make(map[string]encoderOpener),
+		validators:         make(map[Kind]map[string]ValidateFunc),
+		options:            make(map[Kind]map[string]*optionSpec),
+		descriptions:       make(map[Kind]map[string]string),
+		resumeInputs:       make(map[string]ResumeInputFunc),
+		resumeOutputs:      make(map[string]ResumeOutputFunc),
+		checkpointEncoders: make(map[string]bool),
+		schemes:            make(map[string]SchemeFunc),
+	}
+	for _, kind := range kinds {
+		r.validators[kind] = make(map[string]ValidateFunc)
+		r.options[kind] = make(map[string]*optionSpec)
+		r.descriptions[kind] = make(map[string]string)
+	}
+	return r
+}
+
+// DefaultRegistry is used by the package level functions.
+var DefaultRegistry = NewRegistry()
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// Clone returns a registry with the same types, changing one of them
+// doesn't change the other.
+func (r *Registry) Clone() *Registry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c := &Registry{
+		inputs:             copyMap(r.inputs),
+		outputs:            copyMap(r.outputs),
+		decoders:           copyMap(r.decoders),
+		encoders:           copyMap(r.encoders),
+		validators:         make(map[Kind]map[string]ValidateFunc),
+		options:            make(map[Kind]map[string]*optionSpec),
+		descriptions:       make(map[Kind]map[string]string),
+		resumeInputs:       copyMap(r.resumeInputs),
+		resumeOutputs:      copyMap(r.resumeOutputs),
+		checkpointEncoders: copyMap(r.checkpointEncoders),
+		schemes:            copyMap(r.schemes),
+	}
+	for _, kind := range kinds {
+		c.validators[kind] = copyMap(r.validators[kind])
+		c.options[kind] = copyMap(r.options[kind])
+		c.descriptions[kind] = copyMap(r.descriptions[kind])
+	}
+	return c
+}
+
+// Unregister removes a type and everything declared about it.
+func (r *Registry) Unregister(kind Kind, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch kind {
+	case KindInput:
+		delete(r.inputs, name)
+		delete(r.resumeInputs, name)
+	case KindDecoder:
+		delete(r.decoders, name)
+	case KindEncoder:
+		delete(r.encoders, name)
+		delete(r.checkpointEncoders, name)
+	case KindOutput:
+		delete(r.outputs, name)
+		delete(r.resumeOutputs, name)
+	}
+	delete(r.validators[kind], name)
+	delete(r.options[kind], name)
+	delete(r.descriptions[kind], name)
+}
+
+func (r *Registry) registeredLocked(kind Kind, name string) bool {
+	var ok bool
+	switch kind {
+	case KindInput:
+		_, ok = r.inputs[name]
+	case KindDecoder:
+		_, ok = r.decoders[name]
+	case KindEncoder:
+		_, ok = r.encoders[name]
+	case KindOutput:
+		_, ok = r.outputs[name]
+	}
+	return ok
+}
+
+func (r *Registry) registered(kind Kind, name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.registeredLocked(kind, name)
+}
+
+// add registers the function of a type, with the options it is decoded
+// with if it's typed.
+func (r *Registry) add(kind Kind, name string, fn any, spec *optionSpec) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.registeredLocked(kind, name) {
+		return fmt.Errorf("%v '%v': %w", kind, name, ErrDuplicateType)
+	}
+	switch kind {
+	case KindInput:
+		r.inputs[name] = fn.(inputOpener)
+	case KindDecoder:
+		r.decoders[name] = fn.(decoderOpener)
+	case KindEncoder:
+		r.encoders[name] = fn.(encoderOpener)
+	case KindOutput:
+		r.outputs[name] = fn.(outputOpener)
+	}
+	if spec != nil {
+		r.options[kind][name] = spec
+		r.validators[kind][name] = func(node *yaml.Node) error {
+			_, err := spec.decode(kind, node)
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) RegisterInputStream(name string, fn InputFunc) error {
+	return r.add(KindInput, name, inputOpener(func(op opening, node *yaml.Node) (io.ReadCloser, error) {
+		return fn(node)
+	}), nil)
+}
+
+func (r *Registry) RegisterOutputStream(name string, fn OutputFunc) error {
+	return r.add(KindOutput, name, outputOpener(func(op opening, node *yaml.Node) (io.WriteCloser, error) {
+		return fn(node)
+	}), nil)
+}
+
+func (r *Registry) RegisterDecoderStream(name string, fn DecoderFunc) error {
+	return r.add(KindDecoder, name, decoderOpener(func(reg *Registry, node *yaml.Node, rc io.ReadCloser) (io.ReadCloser, error) {
+		return fn(node, rc)
+	}), nil)
+}
+
+func (r *Registry) RegisterEncoderStream(name string, fn EncoderFunc) error {
+	return r.add(KindEncoder, name, encoderOpener(func(reg *Registry, node *yaml.Node, wc io.WriteCloser) (io.WriteCloser, error) {
+		return fn(node, wc)
+	}), nil)
+}
+
+// RegisterValidator sets the validation-only path of a type registered
+// without an options struct.
+func (r *Registry) RegisterValidator(kind Kind, name string, fn ValidateFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.validators[kind][name]; ok {
+		return fmt.Errorf("validator of %v '%v': %w", kind, name, ErrDuplicateType)
+	}
+	r.validators[kind][name] = fn
+	return nil
+}
+
+func (r *Registry) validator(kind Kind, name string) ValidateFunc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.validators[kind][name]
+}
+
+func (r *Registry) optionSpec(kind Kind, name string) *optionSpec {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.options[kind][name]
+}
+
+// decoder returns the decoder function of a type, opened by r.
+func (r *Registry) decoder(name string) (DecoderFunc, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok := r.decoders[name]
+	if !ok {
+		return nil, false
+	}
+	return func(node *yaml.Node, rc io.ReadCloser) (io.ReadCloser, error) {
+		return fn(r, node, rc)
+	}, true
+}
+
+// encoder returns the encoder function of a type, opened by r.
+func (r *Registry) encoder(name string) (EncoderFunc, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok := r.encoders[name]
+	if !ok {
+		return nil, false
+	}
+	return func(node *yaml.Node, wc io.WriteCloser) (io.WriteCloser, error) {
+		return fn(r, node, wc)
+	}, true
+}
+
+func (r *Registry) input(name string) (inputOpener, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok := r.inputs[name]
+	return fn, ok
+}
+
+func (r *Registry) output(name string) (outputOpener, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok := r.outputs[name]
+	return fn, ok
+}
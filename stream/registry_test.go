@@ -0,0 +1,151 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRegistryDuplicate(t *testing.T) {
+	reg := NewRegistry()
+	open := func(opts *LocalOptions) (io.ReadCloser, error) { return os.Open(opts.Name) }
+	if err := AddInput(reg, "file", open); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddInput(reg, "file", open); !errors.Is(err, ErrDuplicateType) {
+		t.Errorf("duplicate input: %v", err)
+	}
+	// the same name may be another kind
+	if err := AddOutput(reg, "file", func(opts *LocalOptions) (io.WriteCloser, error) { return os.Create(opts.Name) }); err != nil {
+		t.Errorf("output: %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering local twice should panic")
+		}
+	}()
+	RegisterInput("local", open)
+}
+
+func TestRegistryClone(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := DefaultRegistry.Clone()
+	reg.Unregister(KindInput, "local")
+	config := fmt.Sprintf("input: {type: local, name: %v}\noutput: {type: stdout}\n", src)
+	if _, err := reg.NewPlan(strings.NewReader(config)); err == nil {
+		t.Errorf("local is not in the clone")
+	}
+	if _, err := NewPlan(strings.NewReader(config)); err != nil {
+		t.Errorf("local is still in the default registry: %v", err)
+	}
+	if _, ok := reg.LookupType(KindInput, "local"); ok {
+		t.Errorf("local is described by the clone")
+	}
+
+	// the children of cat are opened from the registry of the stream
+	var opened []string
+	if err := AddInput(reg, "local", func(opts *LocalOptions) (io.ReadCloser, error) {
+		opened = append(opened, opts.Name)
+		return os.Open(opts.Name)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := reg.NewStream(strings.NewReader(fmt.Sprintf(`
+input:
+  type: cat
+  child:
+    - {type: local, name: %v}
+    - {type: local, name: %v}
+output: {type: local, name: %v/dst}
+`, src, src, dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Copy()
+	if err = errors.Join(err, s.Close()); err != nil {
+		t.Fatal(err)
+	}
+	if len(opened) != 2 {
+		t.Errorf("cat opened %v from the clone", opened)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "dst")); string(got) != "hellohello" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// openedOptions records the registry that opens the stage
+type openedOptions struct {
+	reg *Registry
+}
+
+func (opts *openedOptions) setOpening(op opening) {
+	opts.reg = op.reg
+}
+
+func TestRegistryCodecClone(t *testing.T) {
+	base := NewRegistry()
+	var opened []*Registry
+	if err := AddDecoder(base, "nop", func(opts *openedOptions, r io.ReadCloser) (io.ReadCloser, error) {
+		opened = append(opened, opts.reg)
+		return r, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddEncoder(base, "nop", func(opts *openedOptions, w io.WriteCloser) (io.WriteCloser, error) {
+		opened = append(opened, opts.reg)
+		return w, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reg := base.Clone()
+	must(reg.RegisterInputStream("empty", func(node *yaml.Node) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("")), nil
+	}))
+	must(reg.RegisterOutputStream("discard", func(node *yaml.Node) (io.WriteCloser, error) {
+		return &nopWriteCloser{io.Discard}, nil
+	}))
+	s, err := reg.NewStream(strings.NewReader(`
+input: {type: empty}
+decoder: [{type: nop}]
+encoder: [{type: nop}]
+output: {type: discard}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if len(opened) != 2 || opened[0] != reg || opened[1] != reg {
+		t.Errorf("the codecs are opened from %v, not the clone", opened)
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	reg := DefaultRegistry.Clone()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprint("null", i)
+			AddOutput(reg, name, std_output)
+			reg.Describe(KindOutput, name, "discards")
+			reg.Types()
+			reg.NewPlan(strings.NewReader("input: {type: stdin}\noutput: {type: " + name + "}\n"))
+			reg.Unregister(KindOutput, name)
+		}(i)
+	}
+	wg.Wait()
+}
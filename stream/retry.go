@@ -0,0 +1,192 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RETRY syntax, for any input or output:
+// input:
+//   type: tcp
+//   ...
+//   retry:
+//     attempts: 10            # including the first one, default 5
+//     initial_backoff: 200ms  # default 100ms, doubled after every attempt
+//     max_backoff: 5s         # default 10s
+//     jitter: 0.2             # 0-1, part of the backoff randomized, default 0.1
+//     on: [refused, dns]      # retryable errors, default all but `any`
+//
+// error classes:
+//   refused      connection refused
+//   reset        connection reset or aborted
+//   unreachable  host or network unreachable
+//   timeout      dial or i/o timeout
+//   dns          name resolution failure
+//   not_found    file doesn't exist (yet)
+//   any          every error
+
+const (
+	defaultRetryAttempts = 5
+	defaultInitBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff    = 10 * time.Second
+	defaultRetryJitter   = 0.1
+)
+
+var retry_classes = map[string]func(err error) bool{
+	"refused": func(err error) bool { return errors.Is(err, syscall.ECONNREFUSED) },
+	"reset": func(err error) bool {
+		return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED)
+	},
+	"unreachable": func(err error) bool {
+		return errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+	},
+	"timeout": func(err error) bool {
+		var ne net.Error
+		return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+	},
+	"dns": func(err error) bool {
+		var de *net.DNSError
+		return errors.As(err, &de)
+	},
+	"not_found": func(err error) bool { return errors.Is(err, fs.ErrNotExist) },
+	"any":       func(err error) bool { return true },
+}
+
+type retryConfig struct {
+	Attempts       int
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	Jitter         float64
+	On             []string
+}
+
+// parseRetry reads the `retry` block of an input or output, nil if there's
+// none.
+func parseRetry(node *yaml.Node) (*retryConfig, error) {
+	i := getChildByTag(node, "retry")
+	if i < 0 || i+1 >= len(node.Content) {
+		return nil, nil
+	}
+	config := retryConfig{
+		Attempts:       defaultRetryAttempts,
+		InitialBackoff: defaultInitBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+		Jitter:         defaultRetryJitter,
+	}
+	if err := node.Content[i+1].Decode(&config); err != nil {
+		return nil, fmt.Errorf("retry: %w", err)
+	}
+	if config.Attempts < 1 {
+		return nil, fmt.Errorf("retry: invalid attempts: %v", config.Attempts)
+	}
+	if config.InitialBackoff <= 0 || config.MaxBackoff < config.InitialBackoff {
+		return nil, fmt.Errorf("retry: invalid backoff: %v-%v", config.InitialBackoff, config.MaxBackoff)
+	}
+	if config.Jitter < 0 || config.Jitter > 1 {
+		return nil, fmt.Errorf("retry: invalid jitter: %v", config.Jitter)
+	}
+	for _, class := range config.On {
+		if _, ok := retry_classes[class]; !ok {
+			return nil, fmt.Errorf("retry: unknown error class: %v", class)
+		}
+	}
+	return &config, nil
+}
+
+func (rc *retryConfig) retryable(err error) bool {
+	if len(rc.On) == 0 {
+		for class, fn := range retry_classes {
+			if class != "any" && fn(err) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, class := range rc.On {
+		if retry_classes[class](err) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff is the wait before the attempt following the n-th one.
+func (rc *retryConfig) backoff(n int) time.Duration {
+	d := rc.InitialBackoff
+	for i := 1; i < n && d < rc.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > rc.MaxBackoff {
+		d = rc.MaxBackoff
+	}
+	return d + time.Duration(float64(d)*rc.Jitter*(2*rand.Float64()-1))
+}
+
+// withRetry calls open as the `retry` block of node says. Every retried
+// attempt is added to reconnects if it's not nil.
+func withRetry[T any](ctx context.Context, node *yaml.Node, reconnects *int64, open func() (T, error)) (T, error) {
+	rc, err := parseRetry(node)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	if rc == nil {
+		return open()
+	}
+	for n := 1; ; n++ {
+		v, err := open()
+		if err == nil {
+			return v, nil
+		}
+		var zero T
+		if n >= rc.Attempts || !rc.retryable(err) {
+			if n > 1 {
+				err = fmt.Errorf("after %v attempts: %w", n, err)
+			}
+			return zero, err
+		}
+		timer := time.NewTimer(rc.backoff(n))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return zero, fmt.Errorf("%w (retrying: %v)", ctx.Err(), err)
+		case <-timer.C:
+		}
+		if reconnects != nil {
+			atomic.AddInt64(reconnects, 1)
+		}
+	}
+}
+
+func (reg *Registry) openInput(ctx context.Context, typ string, node *yaml.Node, reconnects *int64) (io.ReadCloser, error) {
+	fn, ok := reg.input(typ)
+	if !ok {
+		return nil, fmt.Errorf("input '%v' not found", typ)
+	}
+	op := opening{reg, ctx, reconnects}
+	return withRetry(ctx, node, reconnects, func() (io.ReadCloser, error) {
+		return fn(op, node)
+	})
+}
+
+func (reg *Registry) openOutput(ctx context.Context, typ string, node *yaml.Node, reconnects *int64) (io.WriteCloser, error) {
+	fn, ok := reg.output(typ)
+	if !ok {
+		return nil, fmt.Errorf("output '%v' not found", typ)
+	}
+	op := opening{reg, ctx, reconnects}
+	return withRetry(ctx, node, reconnects, func() (io.WriteCloser, error) {
+		return fn(op, node)
+	})
+}
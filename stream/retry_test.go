@@ -0,0 +1,181 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryOpen(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := testData(1 << 16)
+
+	// the receiver starts listening after the sender
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(src, data, 0600)
+		l, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		b, _ := io.ReadAll(conn)
+		conn.Close()
+		received <- b
+	}()
+
+	plan, err := NewPlan(strings.NewReader(fmt.Sprintf(`
+input:
+  type: local
+  name: %v
+  retry: {attempts: 50, initial_backoff: 10ms, max_backoff: 20ms, on: [not_found]}
+output:
+  type: tcp
+  host: 127.0.0.1
+  port: %v
+  retry: {attempts: 50, initial_backoff: 10ms, max_backoff: 20ms}
+`, src, addr.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := plan.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err = s.Copy(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-received; string(b) != string(data) {
+		t.Errorf("received %v bytes, want %v", len(b), len(data))
+	}
+	if n := s.Stats().Reconnects; n == 0 {
+		t.Errorf("no reconnect counted")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	// not retryable
+	plan, err := NewPlan(strings.NewReader(fmt.Sprintf(`
+input: {type: local, name: %v, retry: {attempts: 3, initial_backoff: 1s, on: [refused]}}
+output: {type: stdout}
+`, missing)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = plan.Open()
+	if !errors.Is(err, os.ErrNotExist) || strings.Contains(err.Error(), "attempts") {
+		t.Errorf("got %v, want a single attempt", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("waited for a non retryable error")
+	}
+
+	// gives up
+	plan, err = NewPlan(strings.NewReader(fmt.Sprintf(`
+input: {type: local, name: %v, retry: {attempts: 3, initial_backoff: 1ms, jitter: 0}}
+output: {type: stdout}
+`, missing)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = plan.Open(); !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("got %v, want 3 attempts", err)
+	}
+
+	// canceled while waiting
+	plan, err = NewPlan(strings.NewReader(fmt.Sprintf(`
+input: {type: local, name: %v, retry: {attempts: 100, initial_backoff: 1s}}
+output: {type: stdout}
+`, missing)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = plan.OpenContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context error", err)
+	}
+
+	for _, retry := range []string{
+		"{attempts: 0}",
+		"{jitter: 2}",
+		"{initial_backoff: 1s, max_backoff: 10ms}",
+		"{on: [oops]}",
+		"{initial_backoff: soon}",
+	} {
+		config := "input: {type: stdin}\noutput: {type: stdout, retry: " + retry + "}\n"
+		if _, err := NewPlan(strings.NewReader(config)); err == nil || !strings.Contains(err.Error(), "retry") {
+			t.Errorf("NewPlan(%q): got %v, want a retry error", config, err)
+		}
+	}
+}
+
+func TestRetryChild(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	plan, err := NewPlan(strings.NewReader(fmt.Sprintf(`
+input:
+  type: cat
+  child:
+    - type: local
+      name: %v
+      retry: {attempts: 1000, initial_backoff: 10ms, max_backoff: 10ms, on: [not_found]}
+output: file://%v
+`, src, filepath.Join(dir, "dst"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the retries of a child stop with the context of the open
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = plan.OpenContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("OpenContext: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("OpenContext returned after %v", d)
+	}
+
+	// and are counted by the stream
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.WriteFile(src, []byte("hello"), 0600)
+	}()
+	s, err := plan.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := s.Stats().Reconnects; n == 0 {
+		t.Errorf("no reconnect counted")
+	}
+}
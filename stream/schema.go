@@ -0,0 +1,271 @@
+package stream
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// JSONSchema describes the config files (a stream, a graph or a batch) in
+// JSON Schema draft-07, built from the registered types. Every input,
+// decoder, encoder and output is one of the schemas of its kind, picked by
+// the `type` const. The `child` lists of cat and tee refer to their own
+// kind, so they nest.
+
+const durationPattern = `^([0-9]+(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$`
+
+type schema = map[string]any
+
+func ref(name string) schema {
+	return schema{"$ref": "#/definitions/" + name}
+}
+
+func durationSchema(desc string) schema {
+	return schema{
+		"description": desc,
+		"oneOf": []any{
+			schema{"type": "string", "pattern": durationPattern},
+			schema{"type": "integer", "description": "nanoseconds"},
+		},
+	}
+}
+
+func object(props schema, required ...string) schema {
+	s := schema{"type": "object", "properties": props, "additionalProperties": false}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// the value of a scalar option may be set by the environment or a file,
+// see expand.go
+const variablePattern = `\$\{`
+
+func referenceSchema() schema {
+	return schema{"oneOf": []any{
+		object(schema{"file": schema{"type": "string"}}, "file"),
+		object(schema{"env": schema{"type": "string"}}, "env"),
+	}}
+}
+
+func optionSchema(kind Kind, opt OptionInfo) schema {
+	var s schema
+	scalar := true
+	switch opt.Type {
+	case "duration":
+		s = durationSchema("")
+		delete(s, "description")
+	case "integer", "number":
+		s = schema{"type": opt.Type}
+		if v, err := strconv.ParseFloat(opt.Min, 64); err == nil {
+			s["minimum"] = v
+		}
+		if v, err := strconv.ParseFloat(opt.Max, 64); err == nil {
+			s["maximum"] = v
+		}
+	case "list":
+		// a list of stages of the same kind, like `child`
+		s, scalar = schema{"type": "array", "items": ref(string(kind)), "minItems": 1}, false
+	case "array":
+		s, scalar = schema{"type": "array"}, false
+	case "map":
+		s, scalar = schema{"type": "object"}, false
+	case "any":
+		s, scalar = schema{}, false
+	default:
+		s = schema{"type": opt.Type}
+	}
+	if len(opt.Enum) > 0 {
+		s["enum"] = opt.Enum
+	}
+	if scalar {
+		// a typed value, a ${VAR} string or a {file: } or {env: } reference
+		alts := []any{s}
+		if opt.Type != "string" || len(opt.Enum) > 0 {
+			// a plain string matches already
+			alts = append(alts, schema{"type": "string", "pattern": variablePattern})
+		}
+		s = schema{"oneOf": append(alts, referenceSchema())}
+	}
+	if opt.Description != "" {
+		s["description"] = opt.Description
+	}
+	if opt.Secret {
+		s["writeOnly"] = true
+	}
+	if opt.Default != "" {
+		var def any
+		if yaml.Unmarshal([]byte(opt.Default), &def) == nil {
+			s["default"] = def
+		}
+	}
+	return s
+}
+
+// typeSchema is the schema of one registered type.
+func typeSchema(info TypeInfo) schema {
+	props := schema{"type": schema{"const": info.Name}}
+	for _, key := range common_options[info.Kind] {
+		if key != "type" {
+			props[key] = ref(key)
+		}
+	}
+	if info.Options == nil {
+		// unknown options
+		return schema{
+			"type":        "object",
+			"description": info.Description,
+			"properties":  props,
+			"required":    []string{"type"},
+		}
+	}
+	required := []string{"type"}
+	for _, opt := range info.Options {
+		props[opt.Name] = optionSchema(info.Kind, opt)
+		if opt.Required {
+			required = append(required, opt.Name)
+		}
+	}
+	s := object(props, required...)
+	if info.Description != "" {
+		s["description"] = info.Description
+	}
+	return s
+}
+
+func retrySchema() schema {
+	var classes []string
+	for class := range retry_classes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return object(schema{
+		"attempts":        schema{"type": "integer", "minimum": 1, "default": defaultRetryAttempts},
+		"initial_backoff": durationSchema("wait after the first failure, doubled after every attempt"),
+		"max_backoff":     durationSchema("longest wait"),
+		"jitter":          schema{"type": "number", "minimum": 0, "maximum": 1, "default": defaultRetryJitter},
+		"on":              schema{"type": "array", "items": schema{"enum": classes}},
+	})
+}
+
+// stream properties, shared by a stream file and the streams of a batch
+func streamProps() schema {
+	return schema{
+		"input":      ref("input"),
+		"decoder":    schema{"type": "array", "items": ref("decoder")},
+		"encoder":    schema{"type": "array", "items": ref("encoder")},
+		"output":     ref("output"),
+		"concurrent": schema{"type": "boolean"},
+		"buffer":     ref("buffer"),
+		"checkpoint": object(schema{
+			"file":     schema{"type": "string"},
+			"interval": durationSchema("time between checkpoints"),
+		}, "file"),
+	}
+}
+
+func graphNodeSchema() schema {
+	from := schema{"oneOf": []any{
+		schema{"type": "string"},
+		schema{"type": "array", "items": schema{"type": "string"}},
+	}}
+	var nodes []any
+	for _, kind := range kinds {
+		nodes = append(nodes, object(schema{
+			"id":         schema{"type": "string"},
+			"from":       from,
+			string(kind): ref(string(kind)),
+		}, "id", string(kind)))
+	}
+	return schema{"oneOf": nodes}
+}
+
+func batchProps() schema {
+	return schema{
+		"policy": object(schema{
+			"mode":        schema{"enum": []string{PolicySequential, PolicyParallel}},
+			"concurrency": schema{"type": "integer", "minimum": 0},
+			"on_failure":  schema{"enum": []string{PolicyStop, PolicyContinue}},
+		}),
+		"metrics": object(schema{"listen": schema{"type": "string"}}),
+		"include": schema{"oneOf": []any{
+			schema{"type": "string"},
+			schema{"type": "array", "items": schema{"type": "string"}},
+		}},
+		"profiles": schema{"type": "object", "additionalProperties": schema{"anyOf": []any{
+			schema{"type": "array", "items": schema{"anyOf": []any{ref("decoder"), ref("encoder")}}},
+			ref("input"),
+			ref("output"),
+		}}},
+	}
+}
+
+// useSchema is a stage replaced by a profile, see include.go
+func useSchema() schema {
+	return schema{
+		"type":       "object",
+		"properties": schema{"use": schema{"type": "string"}},
+		"required":   []string{"use"},
+	}
+}
+
+// mergeProps returns the union of the property maps
+func mergeProps(maps ...schema) schema {
+	props := schema{}
+	for _, m := range maps {
+		for k, v := range m {
+			props[k] = v
+		}
+	}
+	return props
+}
+
+// JSONSchema returns the schema of the config files with the types of
+// DefaultRegistry.
+func JSONSchema() map[string]any {
+	return DefaultRegistry.JSONSchema()
+}
+
+// JSONSchema returns the schema of the config files with the types of the
+// registry.
+func (reg *Registry) JSONSchema() map[string]any {
+	defs := schema{
+		"retry":  retrySchema(),
+		"buffer": object(schema{"size": schema{"type": "integer", "minimum": 0}, "depth": schema{"type": "integer", "minimum": 0}}),
+		"node":   graphNodeSchema(),
+	}
+	for _, kind := range kinds {
+		types := []any{useSchema()}
+		for _, name := range reg.typeNames(kind) {
+			if info, ok := reg.LookupType(kind, name); ok {
+				types = append(types, typeSchema(info))
+			}
+		}
+		if kind == KindInput || kind == KindOutput {
+			types = append(types, schema{"type": "string", "description": "URL of the " + string(kind) +
+				", one of the schemes " + strings.Join(reg.Schemes(), ", ") + " or - for stdio"})
+		}
+		defs[string(kind)] = schema{"oneOf": types}
+	}
+
+	graph := schema{"graph": schema{"type": "array", "items": ref("node"), "minItems": 1}}
+	name := schema{"name": schema{"type": "string"}}
+	defs["stream"] = object(mergeProps(streamProps(), batchProps()), "input", "output")
+	defs["graph"] = object(mergeProps(graph, batchProps()), "graph")
+	defs["batch"] = object(mergeProps(batchProps(), schema{
+		"streams": schema{"type": "array", "minItems": 1, "items": schema{"oneOf": []any{
+			object(mergeProps(streamProps(), name), "name", "input", "output"),
+			object(mergeProps(graph, name), "name", "graph"),
+		}}},
+	}), "streams")
+
+	return schema{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       "stream_cast config",
+		"definitions": defs,
+		"oneOf":       []any{ref("stream"), ref("graph"), ref("batch")},
+	}
+}
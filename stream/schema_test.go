@@ -0,0 +1,83 @@
+package stream
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// find returns the schema of a type in the oneOf of its kind
+func findType(t *testing.T, defs map[string]any, kind Kind, name string) map[string]any {
+	for _, s := range defs[string(kind)].(map[string]any)["oneOf"].([]any) {
+		s := s.(map[string]any)
+		// a URL has no properties
+		props, _ := s["properties"].(map[string]any)
+		// the use of a profile has no type
+		if typ, ok := props["type"].(map[string]any); ok && typ["const"] == name {
+			return s
+		}
+	}
+	t.Fatalf("%v '%v' not in the schema", kind, name)
+	return nil
+}
+
+func TestJSONSchema(t *testing.T) {
+	b, err := json.Marshal(JSONSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root map[string]any
+	if err = json.Unmarshal(b, &root); err != nil {
+		t.Fatal(err)
+	}
+	defs := root["definitions"].(map[string]any)
+
+	gzip := findType(t, defs, KindEncoder, "gzip")
+	level := gzip["properties"].(map[string]any)["level"].(map[string]any)
+	alts, _ := level["oneOf"].([]any)
+	if len(alts) != 3 || level["default"] != -1.0 {
+		t.Fatalf("gzip level: %v", level)
+	}
+	typed := alts[0].(map[string]any)
+	if typed["type"] != "integer" || typed["minimum"] != -2.0 || typed["maximum"] != 9.0 {
+		t.Errorf("gzip level: %v", typed)
+	}
+	// ${GZIP_LEVEL} or {env: GZIP_LEVEL}
+	if v := alts[1].(map[string]any); v["type"] != "string" || v["pattern"] != variablePattern {
+		t.Errorf("gzip level variable: %v", v)
+	}
+	refs, _ := json.Marshal(alts[2])
+	if string(refs) != `{"oneOf":[{"additionalProperties":false,"properties":{"file":{"type":"string"}},"required":["file"],"type":"object"},`+
+		`{"additionalProperties":false,"properties":{"env":{"type":"string"}},"required":["env"],"type":"object"}]}` {
+		t.Errorf("gzip level reference: %s", refs)
+	}
+	if gzip["additionalProperties"] != false {
+		t.Errorf("gzip accepts unknown keys")
+	}
+
+	for kind, name := range map[Kind]string{KindInput: "cat", KindOutput: "tee"} {
+		s := findType(t, defs, kind, name)
+		child := s["properties"].(map[string]any)["child"].(map[string]any)
+		items := child["items"].(map[string]any)
+		if child["type"] != "array" || items["$ref"] != "#/definitions/"+string(kind) {
+			t.Errorf("%v child: %v", name, child)
+		}
+	}
+
+	local := findType(t, defs, KindOutput, "local")
+	if required, _ := json.Marshal(local["required"]); string(required) != `["type","name"]` {
+		t.Errorf("local required: %s", required)
+	}
+	// a string matches a ${VAR} already, it's only one of the oneOf
+	name := local["properties"].(map[string]any)["name"].(map[string]any)
+	if alts, _ := name["oneOf"].([]any); len(alts) != 2 || alts[0].(map[string]any)["type"] != "string" {
+		t.Errorf("local name: %v", name)
+	}
+	if _, ok := local["properties"].(map[string]any)["retry"]; !ok {
+		t.Errorf("local has no retry")
+	}
+	for _, def := range []string{"stream", "graph", "batch", "retry", "buffer"} {
+		if _, ok := defs[def]; !ok {
+			t.Errorf("no definition of %v", def)
+		}
+	}
+}
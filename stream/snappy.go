@@ -4,20 +4,30 @@ import (
 	"io"
 
 	"github.com/golang/snappy"
-	"gopkg.in/yaml.v3"
 )
 
-func snappy_decoder(node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error) {
-	check_type(node, "snappy")
+func snappy_decoder(opts *NoOptions, r io.ReadCloser) (io.ReadCloser, error) {
 	return io.NopCloser(snappy.NewReader(r)), nil
 }
 
-func snappy_encoder(node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error) {
-	check_type(node, "zlib")
-	return snappy.NewBufferedWriter(w), nil
+// snappyWriter flushes its chunk at every checkpoint, the framing format
+// allows the stream identifier of the next run in the middle of a stream.
+type snappyWriter struct {
+	*snappy.Writer
+}
+
+func (sw *snappyWriter) Checkpoint() error {
+	return sw.Writer.Flush()
+}
+
+func snappy_encoder(opts *NoOptions, w io.WriteCloser) (io.WriteCloser, error) {
+	return &snappyWriter{snappy.NewBufferedWriter(w)}, nil
 }
 
 func init() {
-	RegisterDecoderStream("snappy", snappy_decoder)
-	RegisterEncoderStream("snappy", snappy_encoder)
+	RegisterDecoder("snappy", snappy_decoder)
+	RegisterEncoder("snappy", snappy_encoder)
+	RegisterCheckpointEncoder("snappy")
+	Describe(KindDecoder, "snappy", "snappy framing format")
+	Describe(KindEncoder, "snappy", "snappy framing format")
 }
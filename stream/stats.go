@@ -0,0 +1,192 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// A meter counts the bytes and the time spent in the Read or Write calls
+// between two stages.
+type meter struct {
+	bytes  atomic.Int64
+	nanos  atomic.Int64
+	errors atomic.Int64 // errors other than io.EOF
+}
+
+func (m *meter) add(n int, start time.Time, err error) {
+	m.bytes.Add(int64(n))
+	m.nanos.Add(int64(time.Since(start)))
+	if err != nil && err != io.EOF {
+		m.errors.Add(1)
+	}
+}
+
+type meteredReader struct {
+	io.ReadCloser
+	m *meter
+}
+
+func (mr *meteredReader) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := mr.ReadCloser.Read(b)
+	mr.m.add(n, start, err)
+	return n, err
+}
+
+type meteredWriter struct {
+	io.WriteCloser
+	m *meter
+}
+
+func (mw *meteredWriter) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := mw.WriteCloser.Write(b)
+	mw.m.add(n, start, err)
+	return n, err
+}
+
+// StageStats are the counters of one stage. ReadWait is the time a decoder
+// was blocked reading the stage before it, WriteWait the time an encoder was
+// blocked writing the stage after it. The stage whose neighbours wait the
+// most is the bottleneck.
+type StageStats struct {
+	Stage     string // input, decoder[i], encoder[i] or output
+	Type      string
+	BytesIn   int64
+	BytesOut  int64
+	ReadWait  time.Duration
+	WriteWait time.Duration
+	Errors    int64 // failed reads or writes of the stage
+
+	// children of cat/tee, Alive are those that didn't fail
+	Children int
+	Alive    int
+}
+
+// implemented by catReader and teeWriter
+type fanout interface {
+	children() (total, alive int)
+}
+
+func fanoutStats(st *StageStats, v any) {
+	if f, ok := v.(fanout); ok {
+		st.Children, st.Alive = f.children()
+	}
+}
+
+// Ratio is BytesOut/BytesIn, below 1 for an encoder that compresses.
+func (st *StageStats) Ratio() float64 {
+	if st.BytesIn == 0 {
+		return 0
+	}
+	return float64(st.BytesOut) / float64(st.BytesIn)
+}
+
+// Stats is a snapshot of the counters of a stream, from input to output.
+type Stats struct {
+	Stages     []StageStats
+	Elapsed    time.Duration // since Copy started
+	Reconnects int64         // retried opens of the input and the output
+}
+
+func (st *Stats) rate(bytes int64) float64 {
+	if st.Elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / st.Elapsed.Seconds()
+}
+
+// InputRate is the number of bytes per second read from the input.
+func (st *Stats) InputRate() float64 {
+	if len(st.Stages) == 0 {
+		return 0
+	}
+	return st.rate(st.Stages[0].BytesOut)
+}
+
+// OutputRate is the number of bytes per second written to the output.
+func (st *Stats) OutputRate() float64 {
+	if len(st.Stages) == 0 {
+		return 0
+	}
+	return st.rate(st.Stages[len(st.Stages)-1].BytesIn)
+}
+
+// Ratio is the number of bytes written to the output per byte read from
+// the input.
+func (st *Stats) Ratio() float64 {
+	if len(st.Stages) == 0 || st.Stages[0].BytesOut == 0 {
+		return 0
+	}
+	return float64(st.Stages[len(st.Stages)-1].BytesIn) / float64(st.Stages[0].BytesOut)
+}
+
+func stageType(stages []*Stage, i int) string {
+	if i >= len(stages) {
+		return ""
+	}
+	return stages[i].Type
+}
+
+// Stats returns a snapshot of the counters, it's safe to call while Copy
+// is running.
+func (s *Stream) Stats() *Stats {
+	var st Stats
+	var in, out string
+	var decoders, encoders []*Stage
+	if s.plan != nil {
+		in, out = s.plan.Input.Type, s.plan.Output.Type
+		decoders, encoders = s.plan.Decoders, s.plan.Encoders
+	}
+
+	if started := atomic.LoadInt64(&s.started); started != 0 {
+		end := time.Now().UnixNano()
+		if finished := atomic.LoadInt64(&s.finished); finished != 0 {
+			end = finished
+		}
+		st.Elapsed = time.Duration(end - started)
+	}
+
+	st.Reconnects = atomic.LoadInt64(&s.reconnects)
+
+	// the meters in front of the decoders and the one read by Copy
+	if len(s.rmeters) > 0 {
+		n := s.rmeters[0].bytes.Load()
+		input := StageStats{Stage: "input", Type: in, BytesIn: n, BytesOut: n,
+			Errors: s.rmeters[0].errors.Load()}
+		fanoutStats(&input, s.input)
+		st.Stages = append(st.Stages, input)
+	}
+	for i := 0; i+1 < len(s.rmeters) && i < len(s.decoder); i++ {
+		st.Stages = append(st.Stages, StageStats{
+			Stage:    fmt.Sprintf("decoder[%v]", i),
+			Type:     stageType(decoders, i),
+			BytesIn:  s.rmeters[i].bytes.Load(),
+			BytesOut: s.rmeters[i+1].bytes.Load(),
+			ReadWait: time.Duration(s.rmeters[i].nanos.Load()),
+			Errors:   s.rmeters[i+1].errors.Load(),
+		})
+	}
+
+	// the meters behind the encoders, from the one written by Copy
+	for i := len(s.encoder) - 1; i >= 0 && i+1 < len(s.wmeters); i-- {
+		st.Stages = append(st.Stages, StageStats{
+			Stage:     fmt.Sprintf("encoder[%v]", i),
+			Type:      stageType(encoders, i),
+			BytesIn:   s.wmeters[i+1].bytes.Load(),
+			BytesOut:  s.wmeters[i].bytes.Load(),
+			WriteWait: time.Duration(s.wmeters[i].nanos.Load()),
+			Errors:    s.wmeters[i+1].errors.Load(),
+		})
+	}
+	if len(s.wmeters) > 0 {
+		n := s.wmeters[0].bytes.Load()
+		output := StageStats{Stage: "output", Type: out, BytesIn: n, BytesOut: n,
+			Errors: s.wmeters[0].errors.Load()}
+		fanoutStats(&output, s.output)
+		st.Stages = append(st.Stages, output)
+	}
+	return &st
+}
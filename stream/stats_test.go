@@ -0,0 +1,80 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	data := testData(1 << 20)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(data)
+	zw.Close()
+	if err := os.WriteFile(src, gz.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrent := range []bool{false, true} {
+		s, err := NewStream(strings.NewReader(fmt.Sprintf(`
+concurrent: %v
+input: {type: local, name: %v}
+decoder:
+  - type: gzip
+encoder:
+  - type: zlib
+output: {type: local, name: %v}
+`, concurrent, src, dst)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				s.Stats()
+			}
+		}()
+		if _, err = s.Copy(); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		packed, _ := os.Stat(dst)
+		st := s.Stats()
+		var stages []string
+		for _, stage := range st.Stages {
+			stages = append(stages, stage.Stage+":"+stage.Type)
+		}
+		if got := strings.Join(stages, ","); got != "input:local,decoder[0]:gzip,encoder[0]:zlib,output:local" {
+			t.Fatalf("stages: %v", got)
+		}
+		in, dec, enc, out := st.Stages[0], st.Stages[1], st.Stages[2], st.Stages[3]
+		if in.BytesOut != int64(gz.Len()) || dec.BytesIn != in.BytesOut {
+			t.Errorf("input: %+v, decoder: %+v", in, dec)
+		}
+		if dec.BytesOut != int64(len(data)) || enc.BytesIn != dec.BytesOut {
+			t.Errorf("decoder: %+v, encoder: %+v", dec, enc)
+		}
+		if out.BytesIn != packed.Size() || enc.BytesOut != out.BytesIn {
+			t.Errorf("output: %+v, encoder: %+v, file %v", out, enc, packed.Size())
+		}
+		if r := enc.Ratio(); r <= 0 || r >= 0.5 {
+			t.Errorf("zlib ratio: %v", r)
+		}
+		if st.Elapsed <= 0 || st.InputRate() <= 0 {
+			t.Errorf("elapsed: %v, rate: %v", st.Elapsed, st.InputRate())
+		}
+	}
+}
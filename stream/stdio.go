@@ -3,20 +3,18 @@ package stream
 import (
 	"io"
 	"os"
-
-	"gopkg.in/yaml.v3"
 )
 
-func std_input(node *yaml.Node) (io.ReadCloser, error) {
-	check_type(node, "stdin")
+func std_input(opts *NoOptions) (io.ReadCloser, error) {
 	return os.Stdin, nil
 }
-func std_output(node *yaml.Node) (io.WriteCloser, error) {
-	check_type(node, "stdout")
+func std_output(opts *NoOptions) (io.WriteCloser, error) {
 	return os.Stdout, nil
 }
 
 func init() {
-	RegisterInputStream("stdin", std_input)
-	RegisterOutputStream("stdout", std_output)
+	RegisterInput("stdin", std_input)
+	RegisterOutput("stdout", std_output)
+	Describe(KindInput, "stdin", "standard input")
+	Describe(KindOutput, "stdout", "standard output")
 }
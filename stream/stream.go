@@ -4,27 +4,36 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// a config may be YAML, JSON or TOML, see format.go
+//
 // input:
 //
-//	type: stdin/local/tcp/unix/http/https/...
+//	type: stdin/local/tcp/unix/http/...
 //	...
 //
+// or a URL like file:///var/log/app.log, see url.go
+//
 // decoder:
 //   - type: gzip/zlib/...
-//     level: 12
-//   - type: gzip/zlib/...
+//   - type: lzw
 //     options: ...
 //
 // encoder:
 //   - type: gzip/zlib/...
-//     level: 12
+//     level: 9
 //   - type: gzip/zlib/...
 //     options: ...
 //
+// the options of every type are checked, see options.go, and may use
+// ${VAR} or {file: path}, see expand.go. A stage may be a profile of the
+// config, `use: name`, see include.go
+//
 // output:
 //
 //	type: stdout/local/tcp/unix/http/https/...
@@ -42,22 +51,19 @@ type OutputFunc func(node *yaml.Node) (io.WriteCloser, error)
 type DecoderFunc func(node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error)
 type EncoderFunc func(node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error)
 
-var input_funcs = make(map[string]InputFunc)
-var output_funcs = make(map[string]OutputFunc)
-var decoder_funcs = make(map[string]DecoderFunc)
-var encoder_funcs = make(map[string]EncoderFunc)
-
+// The Register functions add to DefaultRegistry, they panic if the name is
+// taken. See registry.go.
 func RegisterInputStream(name string, fn InputFunc) {
-	input_funcs[name] = fn
+	must(DefaultRegistry.RegisterInputStream(name, fn))
 }
 func RegisterOutputStream(name string, fn OutputFunc) {
-	output_funcs[name] = fn
+	must(DefaultRegistry.RegisterOutputStream(name, fn))
 }
 func RegisterDecoderStream(name string, fn DecoderFunc) {
-	decoder_funcs[name] = fn
+	must(DefaultRegistry.RegisterDecoderStream(name, fn))
 }
 func RegisterEncoderStream(name string, fn EncoderFunc) {
-	encoder_funcs[name] = fn
+	must(DefaultRegistry.RegisterEncoderStream(name, fn))
 }
 
 type Stream struct {
@@ -66,7 +72,37 @@ type Stream struct {
 	encoder []io.WriteCloser
 	output  io.WriteCloser
 
-	closed bool
+	// concurrent mode, see pipeline.go
+	concurrent bool
+	buffer     bufferConfig
+	rpipes     []*pumpReader // rpipes[i] feeds decoder[i]
+	wpipes     []*pumpWriter // wpipes[i] drains encoder[i]
+
+	// see stats.go
+	plan       *Plan
+	rmeters    []*meter // rmeters[i] is read by decoder[i], the last one by Copy
+	wmeters    []*meter // wmeters[i] is written by encoder[i], the last one by Copy
+	started    int64    // unix nanos, atomic
+	finished   int64
+	reconnects int64 // retried opens, atomic
+
+	checkpoint *checkpoint // see checkpoint.go
+
+	stopped    int32 // atomic, see DrainContext
+	rolledBack int32 // atomic, see rollback
+	closed     bool
+}
+
+// top-level options of a stream
+type streamConfig struct {
+	Concurrent bool
+	Buffer     bufferConfig
+	Checkpoint *checkpointConfig
+}
+
+// options shared by all codecs
+type stageConfig struct {
+	Buffer bufferConfig
 }
 
 func getChildByTag(node *yaml.Node, name string) int {
@@ -82,9 +118,10 @@ func getInputOuputMap(node *yaml.Node, name string) (*yaml.Node, error) {
 	if i < 0 || i+1 >= len(node.Content) {
 		return nil, fmt.Errorf("'%v' not found", name)
 	}
+	// a URL is made a map by the plan, see url.go
 	if node.Content[i].Kind != yaml.ScalarNode ||
-		node.Content[i+1].Kind != yaml.MappingNode {
-		return nil, fmt.Errorf("invalid '%v', needs a map", name)
+		(node.Content[i+1].Kind != yaml.MappingNode && node.Content[i+1].Kind != yaml.ScalarNode) {
+		return nil, fmt.Errorf("invalid '%v', needs a map or a URL", name)
 	}
 	return node.Content[i+1], nil
 }
@@ -103,209 +140,266 @@ func getList(node *yaml.Node, name string) []*yaml.Node {
 
 func getElementType(node *yaml.Node) (string, error) {
 	if node.Kind != yaml.MappingNode {
-		return "", fmt.Errorf("unexpected node kind: %v", node.Kind)
+		return "", fmt.Errorf("line %v: needs a map", node.Line)
 	}
 	i := getChildByTag(node, "type")
 	if i < 0 || i+1 >= len(node.Content) {
-		return "", fmt.Errorf("`input`. type is missing ")
+		return "", fmt.Errorf("line %v: `type` is missing", node.Line)
 	}
 	return node.Content[i+1].Value, nil
 }
 
-func parseInput(node *yaml.Node) (io.ReadCloser, error) {
-	// input
-	input, err := getInputOuputMap(node, "input")
-	if err != nil {
-		return nil, err
-	}
-	name, err := getElementType(input)
-	if err != nil {
-		return nil, fmt.Errorf("no `type` found in input stream")
-	}
-	fn, ok := input_funcs[name]
-	if !ok {
-		return nil, fmt.Errorf("no input registry: %v", name)
-	}
-	return fn(input)
-}
-
-func parseOutput(node *yaml.Node) (io.WriteCloser, error) {
-	// output
-	output, err := getInputOuputMap(node, "output")
-	if err != nil {
-		return nil, err
-	}
-	name, err := getElementType(output)
-	if err != nil {
-		return nil, fmt.Errorf("no `type` found in output stream")
-	}
-	fn, ok := output_funcs[name]
-	if !ok {
-		return nil, fmt.Errorf("no input registry: %v", name)
-	}
-	return fn(output)
-}
-
-func parseInputList(nodes []*yaml.Node) ([]io.ReadCloser, error) {
+func parseInputList(op opening, nodes []*yaml.Node) ([]io.ReadCloser, error) {
 	var list []io.ReadCloser
 	var rc io.ReadCloser
 	for _, node := range nodes {
+		if err := op.reg.expandURL(KindInput, node); err != nil {
+			return list, fmt.Errorf("child[%v]: %w", len(list), err)
+		}
 		name, err := getElementType(node)
 		if err != nil {
-			return list, fmt.Errorf("no `type` found in output stream")
+			return list, fmt.Errorf("child[%v]: input: %w", len(list), err)
 		}
-		fn, ok := input_funcs[name]
-		if !ok {
-			return list, fmt.Errorf("no input registry: %v", name)
+		if !op.reg.registered(KindInput, name) {
+			return list, fmt.Errorf("child[%v]: input '%v' not found", len(list), name)
 		}
-		if rc, err = fn(node); err != nil {
-			return list, err
+		if rc, err = op.reg.openInput(op.ctx, name, node, op.reconnects); err != nil {
+			return list, fmt.Errorf("child[%v] '%v': %w", len(list), name, err)
 		}
 		list = append(list, rc)
 	}
 	return list, nil
 }
 
-func parseOutputList(nodes []*yaml.Node) ([]io.WriteCloser, error) {
+func parseOutputList(op opening, nodes []*yaml.Node) ([]io.WriteCloser, error) {
 	var list []io.WriteCloser
 	var wc io.WriteCloser
 	for _, node := range nodes {
+		if err := op.reg.expandURL(KindOutput, node); err != nil {
+			return list, fmt.Errorf("child[%v]: %w", len(list), err)
+		}
 		name, err := getElementType(node)
 		if err != nil {
-			return list, fmt.Errorf("no `type` found in output stream")
+			return list, fmt.Errorf("child[%v]: output: %w", len(list), err)
 		}
-		fn, ok := output_funcs[name]
-		if !ok {
-			return list, fmt.Errorf("no input registry: %v", name)
+		if !op.reg.registered(KindOutput, name) {
+			return list, fmt.Errorf("child[%v]: output '%v' not found", len(list), name)
 		}
-		if wc, err = fn(node); err != nil {
-			return list, err
+		if wc, err = op.reg.openOutput(op.ctx, name, node, op.reconnects); err != nil {
+			return list, fmt.Errorf("child[%v] '%v': %w", len(list), name, err)
 		}
 		list = append(list, wc)
 	}
 	return list, nil
 }
 
-func parseEncoder(list []*yaml.Node, wc io.WriteCloser) ([]io.WriteCloser, error) {
-	var encoders []io.WriteCloser
-	for _, node := range list {
-		if node.Kind != yaml.MappingNode {
-			return encoders, fmt.Errorf("invalid yaml format: codec should be map: %v", node)
-		}
-		typname, err := getElementType(node)
-		if err != nil {
-			return encoders, err
-		}
-		fn, ok := encoder_funcs[typname]
-		if !ok {
-			return encoders, fmt.Errorf("encoder '%v' not found", typname)
-		}
-		wc, err = fn(node, wc)
-		if err != nil {
-			return encoders, err
-		}
-		encoders = append(encoders, wc)
+func newEncoder(reg *Registry, node *yaml.Node, wc io.WriteCloser) (io.WriteCloser, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("invalid yaml format: codec should be map: %v", node)
+	}
+	typname, err := getElementType(node)
+	if err != nil {
+		return nil, fmt.Errorf("encoder: %w", err)
+	}
+	fn, ok := reg.encoder(typname)
+	if !ok {
+		return nil, fmt.Errorf("encoder '%v' not found", typname)
 	}
-	return encoders, nil
+	return fn(node, wc)
 }
 
-func parseDecoder(list []*yaml.Node, rc io.ReadCloser) ([]io.ReadCloser, error) {
-	var decoders []io.ReadCloser
-	for _, node := range list {
-		if node.Kind != yaml.MappingNode {
-			return decoders, fmt.Errorf("invalid yaml format: codec should be map: %v", node)
-		}
-		typname, err := getElementType(node)
-		if err != nil {
-			return decoders, err
-		}
-		fn, ok := decoder_funcs[typname]
-		if !ok {
-			return decoders, fmt.Errorf("decoder '%v' not found", typname)
-		}
-		rc, err = fn(node, rc)
-		if err != nil {
-			return decoders, err
-		}
-		decoders = append(decoders, rc)
+func newDecoder(reg *Registry, node *yaml.Node, rc io.ReadCloser) (io.ReadCloser, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("invalid yaml format: codec should be map: %v", node)
+	}
+	typname, err := getElementType(node)
+	if err != nil {
+		return nil, fmt.Errorf("decoder: %w", err)
+	}
+	fn, ok := reg.decoder(typname)
+	if !ok {
+		return nil, fmt.Errorf("decoder '%v' not found", typname)
+	}
+	return fn(node, rc)
+}
+
+func (s *Stream) stageBuffer(node *yaml.Node) (bufferConfig, error) {
+	var config stageConfig
+	if err := node.Decode(&config); err != nil {
+		return config.Buffer, err
+	}
+	return config.Buffer.merge(s.buffer), nil
+}
+
+// abandonedWriter is the output under the first encoder, it fails the
+// writes once the stream is rolled back.
+type abandonedWriter struct {
+	io.WriteCloser
+	rolledBack *int32
+}
+
+func (aw abandonedWriter) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(aw.rolledBack) != 0 {
+		return 0, errPipeClosed
 	}
-	return decoders, nil
+	return aw.WriteCloser.Write(b)
 }
 
+// parseEncoder stacks the encoders on the output. Every encoder writes
+// through a meter, in concurrent mode through a pump as well.
 func (s *Stream) parseEncoder(list []*yaml.Node) error {
-	var err error
-	s.encoder, err = parseEncoder(list, s.output)
-	if err != nil {
-		return err
+	var wc io.WriteCloser = s.output
+	if !s.concurrent {
+		// in concurrent mode, the pump is stopped instead
+		wc = abandonedWriter{WriteCloser: s.output, rolledBack: &s.rolledBack}
 	}
-	return err
+	for _, node := range list {
+		if s.concurrent {
+			bc, err := s.stageBuffer(node)
+			if err != nil {
+				return err
+			}
+			pw := newPumpWriter(wc, bc)
+			s.wpipes = append(s.wpipes, pw)
+			wc = pw
+		}
+		m := &meter{}
+		s.wmeters = append(s.wmeters, m)
+		enc, err := newEncoder(s.registry(), node, &meteredWriter{WriteCloser: wc, m: m})
+		if err != nil {
+			return err
+		}
+		s.encoder = append(s.encoder, enc)
+		wc = enc
+	}
+	// written by Copy
+	s.wmeters = append(s.wmeters, &meter{})
+	return nil
 }
 
+// parseDecoder stacks the decoders on the input. Every decoder reads
+// through a meter, in concurrent mode through a pump as well.
 func (s *Stream) parseDecoder(list []*yaml.Node) error {
-	var err error
-	s.decoder, err = parseDecoder(list, s.input)
-	if err != nil {
-		return err
+	var rc io.ReadCloser = s.input
+	for _, node := range list {
+		if s.concurrent {
+			bc, err := s.stageBuffer(node)
+			if err != nil {
+				return err
+			}
+			pr := newPumpReader(rc, bc)
+			s.rpipes = append(s.rpipes, pr)
+			rc = pr
+		}
+		m := &meter{}
+		s.rmeters = append(s.rmeters, m)
+		dec, err := newDecoder(s.registry(), node, &meteredReader{ReadCloser: rc, m: m})
+		if err != nil {
+			return err
+		}
+		s.decoder = append(s.decoder, dec)
+		rc = dec
 	}
-	return err
+	// read by Copy
+	s.rmeters = append(s.rmeters, &meter{})
+	return nil
 }
 
+// NewStream plans the config and opens it, see NewPlan to validate a config
+// without opening anything.
 // may read bytes that will be blocked
 func NewStream(r io.Reader) (*Stream, error) {
-	var node yaml.Node
-	var stream Stream
-	err := yaml.NewDecoder(r).Decode(&node)
-	if err != nil {
-		return nil, err
-	}
-
-	// input
-	stream.input, err = parseInput(node.Content[0])
-	if err != nil {
-		return nil, err
-	}
+	return DefaultRegistry.NewStream(r)
+}
 
-	// output
-	stream.output, err = parseOutput(node.Content[0])
+// NewStream is NewStream with the types of the registry.
+func (reg *Registry) NewStream(r io.Reader) (*Stream, error) {
+	plan, err := reg.NewPlan(r)
 	if err != nil {
 		return nil, err
 	}
+	return plan.Open()
+}
 
-	// decoder
-	decoder := getList(node.Content[0], "decoder")
-	if decoder != nil {
-		if err = stream.parseDecoder(decoder); err != nil {
-			return nil, err
-		}
-	}
-
-	// encoder
-	encoder := getList(node.Content[0], "encoder")
-	if encoder != nil {
-		if err = stream.parseEncoder(encoder); err != nil {
-			return nil, err
-		}
+// the registry of the plan, the default one for a stream built by hand
+func (s *Stream) registry() *Registry {
+	if s.plan != nil && s.plan.reg != nil {
+		return s.plan.reg
 	}
-
-	return &stream, nil
+	return DefaultRegistry
 }
 
 func (s *Stream) Reader() io.ReadCloser {
 	if n := len(s.decoder); n > 0 {
-		return s.decoder[n-1]
+		return &meteredReader{ReadCloser: s.decoder[n-1], m: s.rmeters[n]}
 	}
-	return s.input
+	return &meteredReader{ReadCloser: s.input, m: s.rmeters[0]}
 }
 func (s *Stream) Writer() io.WriteCloser {
 	if n := len(s.encoder); n > 0 {
-		return s.encoder[n-1]
+		return &meteredWriter{WriteCloser: s.encoder[n-1], m: s.wmeters[n]}
 	}
-	return s.output
+	return &meteredWriter{WriteCloser: s.output, m: s.wmeters[0]}
 }
 func (s *Stream) Copy() (int64, error) {
-	r := s.Reader()
+	r := stoppableReader{Reader: s.Reader(), stopped: &s.stopped}
 	w := s.Writer()
-	return io.Copy(w, r)
+	atomic.CompareAndSwapInt64(&s.started, 0, time.Now().UnixNano())
+	var n int64
+	var err error
+	if s.checkpoint != nil {
+		n, err = s.copyCheckpoint(w, r)
+	} else {
+		n, err = io.Copy(w, r)
+	}
+	atomic.StoreInt64(&s.finished, time.Now().UnixNano())
+	if err != nil {
+		// stop the upstream pumps
+		for _, pr := range s.rpipes {
+			pr.pipe.CloseRead(err)
+		}
+	}
+	return n, err
+}
+
+// rollback closes a partially opened stream, in the reverse order of opening
+// but for the output: it's abandoned, so it's closed first and the encoders
+// flush nothing into it. They're still closed, an exec runs a process.
+func (s *Stream) rollback(oe *OpenError) error {
+	var errs []error
+	atomic.StoreInt32(&s.rolledBack, 1)
+	if s.output != nil {
+		errs = append(errs, s.output.Close())
+	}
+	for _, pw := range s.wpipes {
+		pw.pipe.CloseRead(nil)
+	}
+	for i := len(s.encoder) - 1; i >= 0; i-- {
+		// the flush fails
+		s.encoder[i].Close()
+	}
+	for _, pw := range s.wpipes {
+		pw.wait()
+	}
+	// in concurrent mode, a pipe is opened before the codec it links
+	n := len(s.decoder)
+	if len(s.rpipes) > n {
+		n = len(s.rpipes)
+	}
+	for i := n - 1; i >= 0; i-- {
+		if i < len(s.decoder) {
+			errs = append(errs, s.decoder[i].Close())
+		}
+		if i < len(s.rpipes) {
+			s.rpipes[i].Close()
+		}
+	}
+	if s.input != nil {
+		errs = append(errs, s.input.Close())
+	}
+	s.closed = true
+	oe.CloseErr = errors.Join(errs...)
+	return oe
 }
 
 func (s *Stream) Close() error {
@@ -313,11 +407,20 @@ func (s *Stream) Close() error {
 	if s.closed {
 		return nil
 	}
-	// close reader first
+	// close reader first. The pumps are stopped before: the pump of a
+	// decoder reads the decoder before it, which can't be closed under it.
+	// A decoder may wait for a read of the input, it ends at the deadline.
+	setReadDeadline(s.input, time.Unix(1, 0))
+	for _, pr := range s.rpipes {
+		pr.Close()
+	}
 	for i := len(s.decoder) - 1; i >= 0; i-- {
 		if e := s.decoder[i].Close(); e != nil {
 			errs = append(errs, e)
 		}
+		if s.concurrent && i > 0 {
+			s.rpipes[i].wait()
+		}
 	}
 	if e := s.input.Close(); e != nil {
 		errs = append(errs, e)
@@ -328,10 +431,19 @@ func (s *Stream) Close() error {
 		if e := s.encoder[i].Close(); e != nil {
 			errs = append(errs, e)
 		}
+		// drain the buffered bytes into the next stage
+		if s.concurrent {
+			if e := s.wpipes[i].Close(); e != nil {
+				errs = append(errs, e)
+			}
+		}
 	}
 	if e := s.output.Close(); e != nil {
 		errs = append(errs, e)
 	}
 	s.closed = true
+	if s.checkpoint != nil {
+		return s.finishCheckpoint(errors.Join(errs...))
+	}
 	return errors.Join(errs...)
 }
@@ -82,13 +82,13 @@ func encode(t *testing.T, r io.Reader, w io.WriteCloser) error {
 
 // decode: zlib(gzip(raw))
 func decode(t *testing.T, r io.ReadCloser) (io.ReadCloser, error) {
-	r1, err := zlib.NewReader(r)
+	r1, err := gzip.NewReader(r)
 	if err != nil {
-		t.Errorf("new zlib reader: %v", err)
+		t.Errorf("new gzip reader: %v", err)
 	}
-	r2, err := gzip.NewReader(r1)
+	r2, err := zlib.NewReader(r1)
 	if err != nil {
-		t.Errorf("new gzip reader: %v", err)
+		t.Errorf("new zlib reader: %v", err)
 	}
 
 	return r2, err
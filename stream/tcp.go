@@ -2,19 +2,25 @@ package stream
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-
-	"gopkg.in/yaml.v3"
 )
 
 type tcp_config struct {
-	Type  string
-	Host  string
-	Port  string
-	Role  string // server : client
-	Token string // 4 bytes-length + token
+	Host  string `yaml:"host" arg:"1" desc:"host to dial, empty for the local system"`
+	Port  string `yaml:"port" required:"true" arg:"2" desc:"port or service name"`
+	Role  string `yaml:"role" enum:"server,client" desc:"client only, both ends dial"`  // server : client
+	Token string `yaml:"token" secret:"true" desc:"shared secret sent before the data"` // 4 bytes-length + token
+}
+
+// Validate rejects the server role, a tcp stage doesn't listen.
+func (config *tcp_config) Validate() error {
+	if config.Role == "server" {
+		return errors.New("`role` server is not supported, a tcp stage dials host:port")
+	}
+	return nil
 }
 
 type conn_rw struct {
@@ -41,30 +47,15 @@ func (tr *tcpReader) Read(b []byte) (int, error) {
 			return 0, err
 		}
 		if tr.npos == ntoken && bytes.Compare(tr.buffer, tr.token) != 0 {
-			return 0, fmt.Errorf("authorized token doesn't match")
+			return 0, fmt.Errorf("authorized token doesn't match: %w", ErrAuth)
 		}
 	}
 
 	return tr.Conn.Read(b)
 }
 
-func tcp_prepare(config *tcp_config, node *yaml.Node) error {
-	err := node.Decode(config)
-	if err != nil {
-		return err
-	}
-	if config.Role != "" && config.Role != "server" && config.Role != "client" {
-		return fmt.Errorf("invalid role value: %v", config.Role)
-	}
-	return nil
-}
-
 // read/recv bytes, the first is token
-func tcp_input(node *yaml.Node) (io.ReadCloser, error) {
-	var config tcp_config
-	if err := tcp_prepare(&config, node); err != nil {
-		return nil, err
-	}
+func tcp_input(config *tcp_config) (io.ReadCloser, error) {
 	raddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(config.Host, config.Port))
 	if err != nil {
 		return nil, err
@@ -107,11 +98,7 @@ func (tr *tcpWriter) Write(b []byte) (int, error) {
 	return tr.Conn.Write(b)
 }
 
-func tcp_output(node *yaml.Node) (io.WriteCloser, error) {
-	var config tcp_config
-	if err := tcp_prepare(&config, node); err != nil {
-		return nil, err
-	}
+func tcp_output(config *tcp_config) (io.WriteCloser, error) {
 	raddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(config.Host, config.Port))
 	if err != nil {
 		return nil, err
@@ -133,6 +120,8 @@ func tcp_output(node *yaml.Node) (io.WriteCloser, error) {
 }
 
 func init() {
-	RegisterInputStream("tcp", tcp_input)
-	RegisterOutputStream("tcp", tcp_output)
+	RegisterInput("tcp", tcp_input)
+	RegisterOutput("tcp", tcp_output)
+	Describe(KindInput, "tcp", "dial a tcp address and read, checks the token first")
+	Describe(KindOutput, "tcp", "dial a tcp address and write, sends the token first")
 }
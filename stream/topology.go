@@ -0,0 +1,211 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// A Topology is the resolved chain of a job, after the includes, the
+// profiles and the URLs: every stage is a node, the bytes go along the
+// edges. The stages of a stream are named like in the stats, input,
+// decoder[i], encoder[i] and output, the children of cat and tee get
+// .child[i] after their parent. The nodes of a graph keep their id. The
+// options are the ones of the config, the secrets are hidden.
+
+type TopologyNode struct {
+	ID      string         `json:"id"`
+	Kind    Kind           `json:"kind"`
+	Type    string         `json:"type"`
+	Options map[string]any `json:"options,omitempty"`
+}
+
+type TopologyEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type Topology struct {
+	Name  string         `json:"name"`
+	Nodes []TopologyNode `json:"nodes"`
+	Edges []TopologyEdge `json:"edges"`
+}
+
+// stageOptions returns the options of a stage, but the type and the
+// children.
+func (reg *Registry) stageOptions(stage *Stage) map[string]any {
+	if stage.node == nil {
+		return nil
+	}
+	spec := reg.optionSpec(stage.Kind, stage.Type)
+	options := make(map[string]any)
+	for i := 0; i+1 < len(stage.node.Content); i += 2 {
+		key, value := stage.node.Content[i].Value, stage.node.Content[i+1]
+		if key == "type" || key == "child" {
+			continue
+		}
+		if spec != nil {
+			if f := spec.field(key); f != nil && f.secret {
+				options[key] = redacted
+				continue
+			}
+		}
+		var v any
+		if value.Decode(&v) != nil {
+			continue
+		}
+		if s, ok := v.(string); ok {
+			v = Redact(s)
+		}
+		options[key] = v
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
+
+// add adds the node of a stage and the ones of its children, the children
+// of an input read into it, the ones of an output are written by it.
+func (t *Topology) add(reg *Registry, id string, stage *Stage) {
+	for i, child := range stage.Children {
+		cid := fmt.Sprintf("%v.child[%v]", id, i)
+		if stage.Kind == KindInput {
+			t.add(reg, cid, child)
+			t.link(cid, id)
+		}
+	}
+	t.Nodes = append(t.Nodes, TopologyNode{ID: id, Kind: stage.Kind, Type: stage.Type,
+		Options: reg.stageOptions(stage)})
+	for i, child := range stage.Children {
+		cid := fmt.Sprintf("%v.child[%v]", id, i)
+		if stage.Kind == KindOutput {
+			t.link(id, cid)
+			t.add(reg, cid, child)
+		}
+	}
+}
+
+func (t *Topology) link(from, to string) {
+	t.Edges = append(t.Edges, TopologyEdge{From: from, To: to})
+}
+
+func (p *Plan) topology(name string) *Topology {
+	reg := p.reg
+	if reg == nil {
+		reg = DefaultRegistry
+	}
+	t := &Topology{Name: name}
+	t.add(reg, "input", p.Input)
+	last := "input"
+	for i, stage := range p.Decoders {
+		id := fmt.Sprintf("decoder[%v]", i)
+		t.add(reg, id, stage)
+		t.link(last, id)
+		last = id
+	}
+	// the bytes go through the last encoder of the config first
+	for i := len(p.Encoders) - 1; i >= 0; i-- {
+		id := fmt.Sprintf("encoder[%v]", i)
+		t.add(reg, id, p.Encoders[i])
+		t.link(last, id)
+		last = id
+	}
+	t.link(last, "output")
+	t.add(reg, "output", p.Output)
+	return t
+}
+
+func (g *Graph) topology(name string) *Topology {
+	t := &Topology{Name: name}
+	for _, gn := range g.nodes {
+		t.add(g.reg, gn.id, gn.stage)
+		for _, from := range gn.from {
+			t.link(from, gn.id)
+		}
+	}
+	return t
+}
+
+// Topology returns the resolved chain of the job.
+func (j *Job) Topology() *Topology {
+	if j.graph != nil {
+		return j.graph.topology(j.Name)
+	}
+	return j.plan.topology(j.Name)
+}
+
+// Topology returns the chains of the jobs, in order.
+func (b *Batch) Topology() []*Topology {
+	var list []*Topology
+	for _, job := range b.Jobs {
+		list = append(list, job.Topology())
+	}
+	return list
+}
+
+// optionString formats the options as key=value, sorted by key.
+func optionString(options map[string]any) string {
+	var names []string
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var list []string
+	for _, name := range names {
+		v := options[name]
+		if _, ok := v.(string); !ok {
+			if b, err := json.Marshal(v); err == nil {
+				v = string(b)
+			}
+		}
+		list = append(list, fmt.Sprintf("%v=%v", name, v))
+	}
+	return strings.Join(list, " ")
+}
+
+// WriteText writes the nodes of the topology in the order of the bytes,
+// with the nodes they read.
+func (t *Topology) WriteText(w io.Writer) error {
+	from := make(map[string][]string)
+	for _, e := range t.Edges {
+		from[e.To] = append(from[e.To], e.From)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%v\n", t.Name)
+	fmt.Fprintln(tw, "  ID\tKIND\tTYPE\tFROM\tOPTIONS")
+	for _, n := range t.Nodes {
+		fmt.Fprintf(tw, "  %v\t%v\t%v\t%v\t%v\n", n.ID, n.Kind, n.Type,
+			strings.Join(from[n.ID], ", "), optionString(n.Options))
+	}
+	return tw.Flush()
+}
+
+// WriteDOT writes the topologies as a Graphviz digraph, a cluster per job.
+func WriteDOT(w io.Writer, list []*Topology) error {
+	var b strings.Builder
+	b.WriteString("digraph stream_cast {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for i, t := range list {
+		id := func(node string) string {
+			return fmt.Sprintf("%q", t.Name+"/"+node)
+		}
+		fmt.Fprintf(&b, "\tsubgraph cluster_%v {\n\t\tlabel=%q;\n", i, t.Name)
+		for _, n := range t.Nodes {
+			label := fmt.Sprintf("%v\n%v %v", n.ID, n.Kind, n.Type)
+			if opts := optionString(n.Options); opts != "" {
+				label += "\n" + opts
+			}
+			fmt.Fprintf(&b, "\t\t%v [label=%q];\n", id(n.ID), label)
+		}
+		for _, e := range t.Edges {
+			fmt.Fprintf(&b, "\t\t%v -> %v;\n", id(e.From), id(e.To))
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,83 @@
+package stream
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTopology(t *testing.T) {
+	batch, err := LoadBatch(strings.NewReader(`
+streams:
+  - name: chain
+    input:
+      type: cat
+      child:
+        - file:///tmp/a
+        - {type: stdin}
+    decoder:
+      - type: gzip
+    encoder:
+      - type: zlib
+      - {type: gzip, level: 9}
+    output:
+      type: tee
+      child:
+        - {type: tcp, port: 9000, token: topology-secret}
+        - "-"
+  - name: fork
+    graph:
+      - {id: src, input: {type: stdin}}
+      - {id: raw, output: {type: stdout}, from: src}
+      - {id: packed, encoder: {type: gzip}, from: src}
+      - {id: dst, output: {type: local, name: /tmp/x}, from: packed}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := batch.Topology()
+	if len(list) != 2 {
+		t.Fatalf("%v topologies", len(list))
+	}
+
+	chain := list[0]
+	var ids []string
+	for _, n := range chain.Nodes {
+		ids = append(ids, n.ID)
+	}
+	want := "input.child[0] input.child[1] input decoder[0] encoder[1] encoder[0] output output.child[0] output.child[1]"
+	if got := strings.Join(ids, " "); got != want {
+		t.Errorf("nodes: %v", got)
+	}
+	var edges []string
+	for _, e := range chain.Edges {
+		edges = append(edges, e.From+">"+e.To)
+	}
+	want = "input.child[0]>input input.child[1]>input input>decoder[0] decoder[0]>encoder[1] " +
+		"encoder[1]>encoder[0] encoder[0]>output output>output.child[0] output>output.child[1]"
+	if got := strings.Join(edges, " "); got != want {
+		t.Errorf("edges: %v", got)
+	}
+	if n := chain.Nodes[0]; n.Type != "local" || n.Options["name"] != "/tmp/a" {
+		t.Errorf("url child: %+v", n)
+	}
+	if opts := chain.Nodes[7].Options; opts["token"] != redacted || opts["port"] != 9000 {
+		t.Errorf("tcp options: %v", opts)
+	}
+
+	var text, dot bytes.Buffer
+	if err = chain.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(text.String(), "topology-secret") || !strings.Contains(text.String(), "level=9") {
+		t.Errorf("text:\n%v", text.String())
+	}
+	if err = WriteDOT(&dot, list); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"chain/encoder[0]" -> "chain/output";`, `"fork/src" -> "fork/raw";`, "cluster_1"} {
+		if !strings.Contains(dot.String(), s) {
+			t.Errorf("dot has no %v:\n%v", s, dot.String())
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package stream
+
+import (
+	"io"
+	"net"
+)
+
+// UnixOptions are the options of the unix input and output, the token works
+// like the one of tcp.
+type UnixOptions struct {
+	Path  string `yaml:"path" required:"true" arg:"1" desc:"path of the socket"`
+	Token string `yaml:"token" secret:"true" desc:"shared secret sent before the data"`
+}
+
+func unix_input(opts *UnixOptions) (io.ReadCloser, error) {
+	conn, err := net.Dial("unix", opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Token == "" {
+		return conn, nil
+	}
+	return &tcpReader{
+		Conn:   conn,
+		token:  []byte(opts.Token),
+		buffer: make([]byte, len(opts.Token)),
+	}, nil
+}
+
+func unix_output(opts *UnixOptions) (io.WriteCloser, error) {
+	conn, err := net.Dial("unix", opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Token == "" {
+		return conn, nil
+	}
+	return &tcpWriter{Conn: conn, token: []byte(opts.Token)}, nil
+}
+
+func init() {
+	RegisterInput("unix", unix_input)
+	RegisterOutput("unix", unix_output)
+	Describe(KindInput, "unix", "dial a unix socket and read, checks the token first")
+	Describe(KindOutput, "unix", "dial a unix socket and write, sends the token first")
+}
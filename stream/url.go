@@ -0,0 +1,256 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// An input, an output or a child of cat and tee may be a URL instead of a
+// map:
+//
+//	input: file:///var/log/app.log
+//	output:
+//	  type: tee
+//	  child:
+//	    - tcp://backup:9000?token=secret
+//	    - unix:///run/sc.sock
+//	    - "-"                        # stdin for an input, stdout for an output
+//
+// The scheme of the URL says the type and the options of the endpoint, the
+// query of the URL holds the other options, except for http where it's a
+// part of the URL. The values of the query are converted like the ones of
+// an inline stage, see inline.go.
+
+// Endpoint is the stage a URL stands for.
+type Endpoint struct {
+	Type    string
+	Options map[string]string
+}
+
+// SchemeFunc maps a URL onto an endpoint of kind, KindInput or KindOutput.
+type SchemeFunc func(kind Kind, u *url.URL) (Endpoint, error)
+
+func (reg *Registry) RegisterScheme(scheme string, fn SchemeFunc) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	scheme = strings.ToLower(scheme)
+	if _, ok := reg.schemes[scheme]; ok {
+		return fmt.Errorf("scheme '%v': %w", scheme, ErrDuplicateType)
+	}
+	reg.schemes[scheme] = fn
+	return nil
+}
+
+// RegisterScheme is RegisterScheme of DefaultRegistry, it panics if the
+// scheme is taken.
+func RegisterScheme(scheme string, fn SchemeFunc) {
+	must(DefaultRegistry.RegisterScheme(scheme, fn))
+}
+
+func (reg *Registry) scheme(scheme string) (SchemeFunc, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	fn, ok := reg.schemes[strings.ToLower(scheme)]
+	return fn, ok
+}
+
+// Schemes returns the registered schemes, sorted.
+func (reg *Registry) Schemes() []string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	names := keys(reg.schemes)
+	sort.Strings(names)
+	return names
+}
+
+// queryOptions adds the query of the URL to the options.
+func queryOptions(u *url.URL, options map[string]string) (map[string]string, error) {
+	if options == nil {
+		options = make(map[string]string)
+	}
+	for key, values := range u.Query() {
+		if len(values) > 1 {
+			return nil, fmt.Errorf("`%v` is set twice", key)
+		}
+		if _, ok := options[key]; ok || key == "type" {
+			return nil, fmt.Errorf("`%v` is set by the URL", key)
+		}
+		options[key] = values[0]
+	}
+	return options, nil
+}
+
+// redactURL hides the password and the values of the query of a URL for
+// the errors: they may be secrets that Redact doesn't know yet, the options
+// of a URL are only checked once it's parsed.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		if i := strings.IndexByte(s, '?'); i >= 0 {
+			s = s[:i] + "?" + redacted
+		}
+		if i := strings.LastIndexByte(s, '@'); i >= 0 {
+			if j := strings.Index(s, "//"); j >= 0 && j < i {
+				s = s[:j+2] + redacted + s[i:]
+			}
+		}
+		return s
+	}
+	if u.RawQuery != "" {
+		query := strings.Split(u.RawQuery, "&")
+		for i, kv := range query {
+			if key, _, ok := strings.Cut(kv, "="); ok {
+				query[i] = key + "=" + redacted
+			}
+		}
+		u.RawQuery = strings.Join(query, "&")
+	}
+	return u.Redacted()
+}
+
+// ParseURL parses the URL of an endpoint into the node of a stage.
+func (reg *Registry) ParseURL(kind Kind, s string) (*yaml.Node, error) {
+	if kind != KindInput && kind != KindOutput {
+		return nil, fmt.Errorf("a %v can't be a URL", kind)
+	}
+	if s == "-" {
+		s = "stdio:"
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return nil, fmt.Errorf("%v %q: %w", kind, redactURL(s), err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("%v %q: the scheme is missing, like file:// or tcp://", kind, redactURL(s))
+	}
+	fn, ok := reg.scheme(u.Scheme)
+	if !ok {
+		return nil, fmt.Errorf("%v %q: unknown scheme '%v'", kind, redactURL(s), u.Scheme)
+	}
+	ep, err := fn(kind, u)
+	if err != nil {
+		return nil, fmt.Errorf("%v %q: %w", kind, redactURL(s), err)
+	}
+	if !reg.registered(kind, ep.Type) {
+		return nil, fmt.Errorf("%v %q: %v '%v' not found", kind, redactURL(s), kind, ep.Type)
+	}
+
+	spec := reg.optionSpec(kind, ep.Type)
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: "type"},
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: ep.Type},
+	}}
+	names := keys(ep.Options)
+	sort.Strings(names)
+	for _, name := range names {
+		var f *optionField
+		if spec != nil {
+			f = spec.field(name)
+		}
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name},
+			inlineValue(spec, f, ep.Options[name]))
+	}
+	return node, nil
+}
+
+func ParseURL(kind Kind, s string) (*yaml.Node, error) {
+	return DefaultRegistry.ParseURL(kind, s)
+}
+
+// setPosition gives the nodes of a parsed URL the position of the URL in
+// the config.
+func setPosition(node *yaml.Node, line, column int) {
+	node.Line, node.Column = line, column
+	for _, n := range node.Content {
+		setPosition(n, line, column)
+	}
+}
+
+// expandURL replaces in place an endpoint given as a URL by its map, a map
+// is left as it is.
+func (reg *Registry) expandURL(kind Kind, node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode || (kind != KindInput && kind != KindOutput) {
+		return nil
+	}
+	stage, err := reg.ParseURL(kind, node.Value)
+	if err != nil {
+		return err
+	}
+	setPosition(stage, node.Line, node.Column)
+	*node = *stage
+	return nil
+}
+
+var errNoPath = errors.New("the path is missing")
+
+func file_scheme(kind Kind, u *url.URL) (Endpoint, error) {
+	// file:///abs/path or file:relative/path
+	name := u.Path
+	if u.Opaque != "" {
+		name = u.Opaque
+	}
+	if name == "" {
+		return Endpoint{}, errNoPath
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return Endpoint{}, fmt.Errorf("the file is on host '%v'", u.Host)
+	}
+	options, err := queryOptions(u, map[string]string{"name": name})
+	return Endpoint{Type: "local", Options: options}, err
+}
+
+func tcp_scheme(kind Kind, u *url.URL) (Endpoint, error) {
+	if u.Port() == "" {
+		return Endpoint{}, errors.New("the port is missing")
+	}
+	options := map[string]string{"port": u.Port()}
+	if host := u.Hostname(); host != "" {
+		options["host"] = host
+	}
+	options, err := queryOptions(u, options)
+	return Endpoint{Type: "tcp", Options: options}, err
+}
+
+func unix_scheme(kind Kind, u *url.URL) (Endpoint, error) {
+	name := u.Path
+	if u.Opaque != "" {
+		name = u.Opaque
+	}
+	if name == "" {
+		return Endpoint{}, errNoPath
+	}
+	options, err := queryOptions(u, map[string]string{"path": name})
+	return Endpoint{Type: "unix", Options: options}, err
+}
+
+func stdio_scheme(kind Kind, u *url.URL) (Endpoint, error) {
+	typ := "stdin"
+	if kind == KindOutput {
+		typ = "stdout"
+	}
+	options, err := queryOptions(u, nil)
+	return Endpoint{Type: typ, Options: options}, err
+}
+
+func http_scheme(kind Kind, u *url.URL) (Endpoint, error) {
+	return Endpoint{Type: "http", Options: map[string]string{"url": u.String()}}, nil
+}
+
+func init() {
+	RegisterScheme("file", file_scheme)
+	RegisterScheme("tcp", tcp_scheme)
+	RegisterScheme("unix", unix_scheme)
+	RegisterScheme("stdio", stdio_scheme)
+	RegisterScheme("http", http_scheme)
+	RegisterScheme("https", http_scheme)
+}
@@ -3,23 +3,21 @@ package stream
 import (
 	"compress/zlib"
 	"io"
-
-	"gopkg.in/yaml.v3"
 )
 
-// support options: level, dict
+// options: level, see LevelOptions
 
-func zlib_decoder(node *yaml.Node, r io.ReadCloser) (io.ReadCloser, error) {
-	check_type(node, "zlib")
+func zlib_decoder(opts *NoOptions, r io.ReadCloser) (io.ReadCloser, error) {
 	return zlib.NewReader(r)
 }
 
-func zlib_encoder(node *yaml.Node, w io.WriteCloser) (io.WriteCloser, error) {
-	check_type(node, "zlib")
-	return zlib.NewWriterLevel(w, zlib.DefaultCompression)
+func zlib_encoder(opts *LevelOptions, w io.WriteCloser) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(w, opts.Level)
 }
 
 func init() {
-	RegisterDecoderStream("zlib", zlib_decoder)
-	RegisterEncoderStream("zlib", zlib_encoder)
+	RegisterDecoder("zlib", zlib_decoder)
+	RegisterEncoder("zlib", zlib_encoder)
+	Describe(KindDecoder, "zlib", "zlib format (RFC 1950)")
+	Describe(KindEncoder, "zlib", "zlib format (RFC 1950)")
 }
@@ -4,39 +4,461 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/gfphoenix78/stream_cast/stream"
 )
 
 var yaml_file string
+var metrics_addr string
+var config_format string
+var plugins_dir string
+var print_config bool
+var plan_format string
+var daemon_dir string
+var status_addr string
+var poll_interval time.Duration
 
-func main() {
-	flag.StringVar(&yaml_file, "config", "", "yaml file to desc")
-	flag.Parse()
+// exit codes of run, validate and plan
+const (
+	exitIO      = 1 // the transfer failed
+	exitUsage   = 2 // bad flags, like the flag package
+	exitConfig  = 3 // the config is invalid
+	exitAuth    = 4 // an endpoint refused the credentials
+	exitPartial = 5 // interrupted, the outputs have what was read before
+)
 
-	file, err := os.Open(yaml_file)
-	if err != nil {
+// stages is a flag given once per stage
+type stages []string
+
+func (s *stages) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stages) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+var inline stream.Inline
+
+// loadPlugins registers the codecs of the manifests of dir, a bad manifest
+// is reported and skipped.
+func loadPlugins(dir string) {
+	if dir == "" {
+		return
+	}
+	if _, err := stream.LoadPlugins(dir); err != nil {
+		log.Printf("Plugins: %v", err)
+	}
+}
+
+func printReports(reports []stream.Report) {
+	tw := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tBYTES\tTIME\tERROR")
+	for _, r := range reports {
+		errmsg := ""
+		if r.Err != nil {
+			errmsg = stream.Redact(r.Err.Error())
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", r.Name, r.Status(), r.Bytes,
+			r.Duration.Round(time.Millisecond), errmsg)
+	}
+	tw.Flush()
+}
+
+func printStats(reports []stream.Report) {
+	tw := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTAGE\tTYPE\tIN\tOUT\tRATIO\tREAD WAIT\tWRITE WAIT")
+	for _, r := range reports {
+		if r.Stats == nil {
+			continue
+		}
+		for _, st := range r.Stats.Stages {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%.3f\t%v\t%v\n", r.Name, st.Stage, st.Type,
+				st.BytesIn, st.BytesOut, st.Ratio(),
+				st.ReadWait.Round(time.Microsecond), st.WriteWait.Round(time.Microsecond))
+		}
+		fmt.Fprintf(tw, "%v\ttotal\t\t%.0f B/s\t%.0f B/s\t%.3f\t\t\n", r.Name,
+			r.Stats.InputRate(), r.Stats.OutputRate(), r.Stats.Ratio())
+	}
+	tw.Flush()
+}
+
+func optionSummary(opt stream.OptionInfo) string {
+	s := opt.Name
+	switch {
+	case opt.Required:
+		s += "!"
+	case opt.Default != "":
+		s += "=" + opt.Default
+	}
+	if opt.Arg > 0 {
+		s += fmt.Sprintf(" #%v", opt.Arg)
+	}
+	if len(opt.Enum) > 0 {
+		s += " {" + strings.Join(opt.Enum, "|") + "}"
+	}
+	if opt.Min != "" || opt.Max != "" {
+		s += " [" + opt.Min + ".." + opt.Max + "]"
+	}
+	return s
+}
+
+// list prints the registered types, stream_cast list [-json] [-kind input]
+func list(args []string) int {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print JSON with the option details")
+	kind := fs.String("kind", "", "only list input, decoder, encoder or output types")
+	fs.Parse(args)
+
+	var types []stream.TypeInfo
+	for _, t := range stream.Types() {
+		if *kind == "" || string(t.Kind) == *kind {
+			types = append(types, t)
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(types); err != nil {
+			log.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAME\tOPTIONS\tDESCRIPTION")
+	for _, t := range types {
+		options := "?"
+		if t.Options != nil {
+			var list []string
+			for _, opt := range t.Options {
+				list = append(list, optionSummary(opt))
+			}
+			options = strings.Join(list, ", ")
+		}
+		desc := t.Description
+		if t.Resumable {
+			desc += " (resumable)"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", t.Kind, t.Name, options, desc)
+	}
+	tw.Flush()
+	return 0
+}
+
+// schema prints the JSON Schema of the config files
+func schema(args []string) int {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	fs.Parse(args)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(stream.JSONSchema()); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// configFlags adds the flags that give the config, a file or inline stages.
+func configFlags(fs *flag.FlagSet) {
+	fs.StringVar(&yaml_file, "config", "", "config file to desc")
+	fs.StringVar(&config_format, "format", "", "format of the config: yaml, json or toml, by default from the file extension")
+	fs.StringVar(&plugins_dir, "plugins", "", "load the codec plugins of the manifests of this directory, besides $STREAM_CAST_PLUGINS")
+	fs.Var((*stages)(&inline.Inputs), "i", "inline input, type[:arg...][,key=value...] or a URL, several are read by a cat")
+	fs.Var((*stages)(&inline.Decoders), "d", "inline decoder, in the order the bytes go through them")
+	fs.Var((*stages)(&inline.Encoders), "e", "inline encoder, in the order the bytes go through them")
+	fs.Var((*stages)(&inline.Outputs), "o", "inline output, several are written by a tee")
+}
+
+// isInline reports whether a stage is given by the flags, any of them
+// excludes -config.
+func isInline() bool {
+	return len(inline.Inputs) > 0 || len(inline.Decoders) > 0 ||
+		len(inline.Encoders) > 0 || len(inline.Outputs) > 0
+}
+
+// loadConfig checks the config of the flags and loads it, the problems are
+// printed. The code is 0 if it's valid.
+func loadConfig() (*stream.Batch, int) {
+	if plugins_dir != os.Getenv("STREAM_CAST_PLUGINS") {
+		loadPlugins(plugins_dir)
+	}
+
+	// the config file or the inline stages
+	var config io.ReadSeeker
+	format := config_format
+	if isInline() {
+		if yaml_file != "" {
+			log.Println("-config and the inline stages are exclusive")
+			return nil, exitUsage
+		}
+		data, err := stream.InlineYAML(inline)
+		if err != nil {
+			log.Printf("Inline stages: %v", err)
+			return nil, exitConfig
+		}
+		config, format = bytes.NewReader(data), stream.FormatYAML
+	} else {
+		if yaml_file == "" {
+			log.Println("needs -config or the inline stages")
+			return nil, exitUsage
+		}
+		file, err := os.Open(yaml_file)
+		if err != nil {
+			log.Println(err)
+			return nil, exitConfig
+		}
+		defer file.Close()
+		config = file
+	}
+
+	// every problem of the config at once
+	diags := stream.Check(stream.WithFormat(config, format))
+	for _, d := range diags {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	if diags.Err() != nil {
+		return nil, exitConfig
+	}
+	if _, err := config.Seek(0, io.SeekStart); err != nil {
 		log.Println(err)
-		os.Exit(1)
+		return nil, exitIO
+	}
+	batch, err := stream.LoadBatch(stream.WithFormat(config, format))
+	if err != nil {
+		log.Printf("Parse config: %v", err)
+		return nil, exitConfig
+	}
+	return batch, 0
+}
+
+// exitCode tells apart the refused credentials from the other failures.
+func exitCode(reports []stream.Report) int {
+	code := 0
+	for _, r := range reports {
+		switch {
+		case errors.Is(r.Err, stream.ErrAuth):
+			return exitAuth
+		case r.Partial:
+			if code == 0 {
+				code = exitPartial
+			}
+		case r.Err != nil || r.Skipped:
+			code = exitIO
+		}
+	}
+	return code
+}
+
+// handleSignals cancels the context on the first SIGINT or SIGTERM, the
+// streams drain and close their encoders and outputs. The second one exits
+// at once, like a shell for a killed process.
+func handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("%v: finishing the outputs, again to exit at once", sig)
+		cancel()
+		sig = <-sigs
+		log.Printf("%v: exit", sig)
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+}
+
+// run opens, copies and closes the streams of the config, the default
+// command.
+func run(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	configFlags(fs)
+	fs.StringVar(&metrics_addr, "metrics", "", "serve /metrics and /healthz on this address, overrides metrics.listen of the config")
+	fs.BoolVar(&print_config, "print-config", false, "print the YAML config of the inline stages and exit")
+	fs.Parse(args)
+
+	if print_config {
+		if !isInline() {
+			log.Println("-print-config needs the inline stages")
+			return exitUsage
+		}
+		data, err := stream.InlineYAML(inline)
+		if err != nil {
+			log.Printf("Inline stages: %v", err)
+			return exitConfig
+		}
+		os.Stdout.Write(data)
+		return 0
+	}
+	batch, code := loadConfig()
+	if batch == nil {
+		return code
+	}
+
+	if metrics_addr != "" {
+		batch.Metrics.Listen = metrics_addr
+	}
+	if batch.Metrics.Listen != "" {
+		l, err := net.Listen("tcp", batch.Metrics.Listen)
+		if err != nil {
+			log.Printf("Metrics: %v", err)
+			return exitIO
+		}
+		batch.Monitor = stream.NewMetrics()
+		go http.Serve(l, batch.Monitor)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+	batch.Drain = true
+
+	// stdout may be an output, the report goes to stderr
+	reports := batch.Run(ctx)
+	printReports(reports)
+	printStats(reports)
+	return exitCode(reports)
+}
+
+// validate checks the config without opening anything.
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFlags(fs)
+	fs.Parse(args)
+	batch, code := loadConfig()
+	if batch == nil {
+		return code
+	}
+	fmt.Fprintf(os.Stderr, "ok: %v stream(s)\n", len(batch.Jobs))
+	return 0
+}
+
+// plan prints the resolved chains of the config as text, JSON or DOT.
+func plan(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	configFlags(fs)
+	fs.StringVar(&plan_format, "as", "text", "text, json or dot")
+	fs.Parse(args)
+	switch plan_format {
+	case "text", "json", "dot":
+	default:
+		log.Printf("-as %v: should be text, json or dot", plan_format)
+		return exitUsage
+	}
+	batch, code := loadConfig()
+	if batch == nil {
+		return code
+	}
+
+	list := batch.Topology()
+	var err error
+	switch plan_format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(list)
+	case "dot":
+		err = stream.WriteDOT(os.Stdout, list)
+	default:
+		for i, t := range list {
+			if i > 0 {
+				fmt.Println()
+			}
+			if err = t.WriteText(os.Stdout); err != nil {
+				break
+			}
+		}
 	}
-	s, err := stream.NewStream(file)
 	if err != nil {
-		log.Printf("Parse config file: %v", err)
-		os.Exit(1)
+		log.Println(err)
+		return exitIO
 	}
-	if err = file.Close(); err != nil {
-		log.Printf("Close %v: %v", yaml_file, err)
+	return 0
+}
+
+// daemon runs the configs of a directory until SIGINT or SIGTERM, SIGHUP
+// reloads the directory at once.
+func daemon(args []string) int {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	fs.StringVar(&daemon_dir, "dir", "/etc/stream_cast.d", "directory of the configs, a pipeline per .yaml, .yml, .json or .toml file")
+	fs.StringVar(&plugins_dir, "plugins", "", "load the codec plugins of the manifests of this directory, besides $STREAM_CAST_PLUGINS")
+	fs.StringVar(&status_addr, "status", "127.0.0.1:9465", "serve /status and /healthz on this address, empty to disable")
+	fs.DurationVar(&poll_interval, "interval", 2*time.Second, "how often the directory is polled")
+	fs.Parse(args)
+	if plugins_dir != os.Getenv("STREAM_CAST_PLUGINS") {
+		loadPlugins(plugins_dir)
+	}
+
+	d := stream.NewDaemon(daemon_dir)
+	d.Interval = poll_interval
+	if status_addr != "" {
+		l, err := net.Listen("tcp", status_addr)
+		if err != nil {
+			log.Printf("Status: %v", err)
+			return exitIO
+		}
+		go http.Serve(l, d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("SIGHUP: reloading %v", daemon_dir)
+			d.Reload()
+		}
+	}()
+
+	if err := d.Run(ctx); err != nil {
+		log.Println(err)
+		return exitConfig
 	}
+	return 0
+}
+
+func main() {
+	// the secrets of the config never reach the logs
+	log.SetOutput(stream.RedactWriter{W: os.Stderr})
+	// the plugins are types for every subcommand
+	loadPlugins(os.Getenv("STREAM_CAST_PLUGINS"))
 
-	if n, err := s.Copy(); err != nil {
-		log.Println("Copy: %v %v", n, err)
-		os.Exit(1)
+	// without a command, the flags are the ones of run
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(run(os.Args[1:]))
 	}
-	if err = s.Close(); err != nil {
-		log.Printf("Close: %v", err)
-		os.Exit(1)
+	switch os.Args[1] {
+	case "run":
+		os.Exit(run(os.Args[2:]))
+	case "validate":
+		os.Exit(validate(os.Args[2:]))
+	case "plan":
+		os.Exit(plan(os.Args[2:]))
+	case "list":
+		os.Exit(list(os.Args[2:]))
+	case "schema":
+		os.Exit(schema(os.Args[2:]))
+	case "daemon":
+		os.Exit(daemon(os.Args[2:]))
 	}
+	fmt.Fprintf(os.Stderr, "unknown command %q, should be one of run, validate, plan, daemon, list, schema\n", os.Args[1])
+	os.Exit(exitUsage)
 }